@@ -1,5 +1,9 @@
 package accessors
 
+import "github.com/byuoitav/pi-designation-microservice/logging"
+
+var logger = logging.New("accessors")
+
 //allows aliasing of many mapping entries
 type Batch struct {
 	ID      int64                   `json:"name"`    //uniquely identifies an entry in a table of definitions
@@ -16,6 +20,7 @@ type ClassDesignationBatch struct {
 //common pieces of any mapping
 type Mapping struct {
 	ID          int64       `json:"id"`
+	Version     int64       `json:"version"`     //bumped by every edit - see the ETag header
 	Class       Class       `json:"class"`       //classes, e.g. av-control, scheduling, etc.
 	Designation Designation `json:"designation"` //designations exist inside classes
 }
@@ -23,8 +28,9 @@ type Mapping struct {
 //represents a complete microservice
 type MicroserviceMapping struct {
 	Mapping
-	Microservice Microservice `json:"microservice"`
-	YAML         string       `json:"yaml" db:"yaml"`
+	Microservice Microservice     `json:"microservice"`
+	YAML         string           `json:"yaml" db:"yaml"`
+	Overrides    MicroserviceSpec `json:"overrides"` //only used when YAML is empty
 }
 
 //represents a complete variable
@@ -32,6 +38,7 @@ type VariableMapping struct {
 	Mapping
 	Variable Variable `json:"variable"`
 	Value    string   `json:"value" db:"yaml"`
+	Default  bool     `json:"default"` //true when the value comes from the definition rather than a mapping
 }
 
 //common pieces of a mapping - types match DB
@@ -39,6 +46,7 @@ type DBMapping struct {
 	ID      int64 `db:"id"`
 	ClassID int64 `db:"class_id"`
 	DesigID int64 `db:"designation_id"`
+	Version int64 `db:"version"`
 }
 
 //row in variable mapping table of DB
@@ -51,8 +59,9 @@ type DBVariable struct {
 //row in microservice mapping table of DB
 type DBMicroservice struct {
 	DBMapping
-	MicroID int64  `db:"microservice_id"`
-	YAML    string `db:"yaml"`
+	MicroID   int64            `db:"microservice_id"`
+	YAML      string           `db:"yaml"`
+	Overrides MicroserviceSpec `db:"overrides"`
 }
 
 //basic pieces of any definition - types match DB table
@@ -60,6 +69,7 @@ type Definition struct {
 	ID          int64  `db:"id"`
 	Name        string `db:"name"`
 	Description string `db:"description"`
+	Version     int64  `db:"version"` //bumped by every edit - see the ETag header
 }
 
 //represents a pi function - AV control, Scheduling, etc.
@@ -70,10 +80,19 @@ type Class Definition
 //row in designation_definitions table
 type Designation Definition
 
-//represents a Variable name
+//represents a Variable name and the kind of value it holds
 //row in variable_definitions table
-type Variable Definition
+type Variable struct {
+	Definition
+	Type       string  `db:"type"`          //see VariableTypes
+	Validation string  `db:"validation"`    //comma-separated values for enum, pattern for regex
+	Default    *string `db:"default_value"` //used wherever the variable isn't mapped - nil means no default
+	Secret     bool    `db:"secret"`        //kept out of search results - see MIN_SECRET_LENGTH
+}
 
-//represents a Microservice name
+//represents a Microservice name and how to run it
 //row in microservice_definitions table
-type Microservice Definition
+type Microservice struct {
+	Definition
+	Spec MicroserviceSpec `db:"spec"`
+}
@@ -0,0 +1,605 @@
+package accessors
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/byuoitav/pi-designation-microservice/apierrors"
+	db "github.com/byuoitav/pi-designation-microservice/database"
+	"github.com/byuoitav/pi-designation-microservice/logging"
+	"github.com/jmoiron/sqlx"
+)
+
+//what Apply does to each mapping
+const (
+	ADD_CHANGE    = "add"
+	EDIT_CHANGE   = "edit"
+	DELETE_CHANGE = "delete"
+)
+
+//every variable value and microservice a class/designation should have, by name
+//anything it leaves out is deleted
+type DesiredState struct {
+	Variables     map[string]string          `json:"variables" yaml:"variables"`
+	Microservices map[string]DesiredMappings `json:"microservices" yaml:"microservices"`
+}
+
+//YAML or overrides, like any other microservice mapping
+type DesiredMicroservice struct {
+	YAML      string            `json:"yaml,omitempty" yaml:"yaml,omitempty"`
+	Overrides *MicroserviceSpec `json:"overrides,omitempty" yaml:"overrides,omitempty"`
+}
+
+//every mapping of one microservice - a single mapping can be given on its own instead of in a list
+type DesiredMappings []DesiredMicroservice
+
+func (mappings *DesiredMappings) UnmarshalJSON(data []byte) error {
+
+	var list []DesiredMicroservice
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		err := strictJSON(data, &list)
+		*mappings = list
+		return err
+	}
+
+	var mapping DesiredMicroservice
+	err := strictJSON(data, &mapping)
+	*mappings = DesiredMappings{mapping}
+	return err
+}
+
+func (mappings *DesiredMappings) UnmarshalYAML(unmarshal func(interface{}) error) error {
+
+	var list []DesiredMicroservice
+	err := unmarshal(&list)
+	if err == nil {
+		*mappings = list
+		return nil
+	}
+
+	var mapping DesiredMicroservice
+	err = unmarshal(&mapping)
+	if err != nil {
+		return err
+	}
+
+	*mappings = DesiredMappings{mapping}
+	return nil
+}
+
+//a custom unmarshaler doesn't get the decoder's settings, so unknown fields are refused again here
+func strictJSON(data []byte, output interface{}) error {
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	return decoder.Decode(output)
+}
+
+//what it takes to get a class/designation from where it is to a DesiredState
+type ApplyPlan struct {
+	ClassID       int64           `json:"class"`
+	DesignationID int64           `json:"designation"`
+	Applied       bool            `json:"applied"` //false for a dry run
+	Changes       []PlannedChange `json:"changes"`
+	Unchanged     int             `json:"unchanged"`
+	Deletion      *Deletion       `json:"deletion,omitempty"` //the deletes all go to the trash together - restore it to undo them
+}
+
+//values of secret variables show up as logging.REDACTED
+type PlannedChange struct {
+	Action string `json:"action"`
+	Kind   string `json:"kind"` //VARIABLE_MAPPING_RESULT or MICROSERVICE_MAPPING_RESULT
+	Name   string `json:"name"` //the variable or microservice
+	ID     int64  `json:"id"`   //the mapping - zero for adds on a dry run
+	From   string `json:"from,omitempty"`
+	To     string `json:"to,omitempty"`
+}
+
+//a definition by ID, or by name if it isn't a number - only live ones count
+func ResolveDefinition(ctx context.Context, table, value string) (int64, error) {
+
+	var id int64
+	var err error
+
+	if number, parseErr := strconv.ParseInt(value, 10, 64); parseErr == nil {
+		err = db.DB().Get(&id, fmt.Sprintf("SELECT id FROM %s WHERE id = ? AND deletion_id IS NULL", table), number)
+	} else {
+		err = db.DB().Get(&id, fmt.Sprintf("SELECT id FROM %s WHERE name = ? AND deletion_id IS NULL", table), value)
+	}
+
+	if err == sql.ErrNoRows {
+		return 0, apierrors.NotFound(fmt.Sprintf("%s not found in %s", value, table))
+	}
+
+	if err != nil {
+		msg := fmt.Sprintf("definition not found: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return 0, apierrors.Wrap(err, msg)
+	}
+
+	return id, nil
+}
+
+//makes a class/designation's variable and microservice mappings match desired in one transaction, and says what changed
+//a redacted value of a secret variable keeps whatever value is already there
+func Apply(ctx context.Context, classID, designationID int64, desired DesiredState, dryRun bool) (ApplyPlan, error) {
+
+	logger.Debugf(ctx, "applying desired state to class %d, designation %d (dry run %v)", classID, designationID, dryRun)
+
+	plan := ApplyPlan{ClassID: classID, DesignationID: designationID, Changes: []PlannedChange{}}
+
+	tx, err := db.DB().Beginx()
+	if err != nil {
+		msg := fmt.Sprintf("unable to start transaction: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return plan, apierrors.Wrap(err, msg)
+	}
+	defer tx.Rollback()
+
+	//holds the class and designation so nothing else can delete them out from under us
+	var names struct {
+		Class       string `db:"class"`
+		Designation string `db:"designation"`
+	}
+	err = tx.Get(&names, `SELECT c.name AS class, d.name AS designation FROM class_definitions c, designation_definitions d
+		WHERE c.id = ? AND d.id = ? AND c.deletion_id IS NULL AND d.deletion_id IS NULL FOR UPDATE`, classID, designationID)
+	if err == sql.ErrNoRows {
+		return plan, apierrors.NotFound(fmt.Sprintf("class %d or designation %d not found", classID, designationID))
+	}
+
+	if err != nil {
+		msg := fmt.Sprintf("class and designation not found: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return plan, apierrors.Wrap(err, msg)
+	}
+
+	//the deletes all go under one deletion, made when the first one comes along
+	var deletionID int64
+	trash := func(deletes []PlannedChange) error {
+
+		if len(deletes) == 0 {
+			return nil
+		}
+
+		if deletionID == 0 {
+			result, err := tx.Exec("INSERT INTO deletions (table_name, row_id, name) VALUES ('apply', 0, ?)",
+				fmt.Sprintf("left out of an apply to %s/%s on %s", names.Class, names.Designation, time.Now().UTC().Format(time.RFC3339)))
+			if err != nil {
+				msg := fmt.Sprintf("unable to record deletion: %s", err.Error())
+				logger.Errorf(ctx, "%s", msg)
+				return apierrors.Wrap(err, msg)
+			}
+
+			deletionID, err = result.LastInsertId()
+			if err != nil {
+				msg := fmt.Sprintf("last inserted ID not found: %s", err.Error())
+				logger.Errorf(ctx, "%s", msg)
+				return apierrors.Wrap(err, msg)
+			}
+		}
+
+		for _, change := range deletes {
+
+			table := "variable_mappings"
+			if change.Kind == MICROSERVICE_MAPPING_RESULT {
+				table = "microservice_mappings"
+			}
+
+			_, err := tx.Exec(fmt.Sprintf("UPDATE %s SET deletion_id = ?, alive = NULL WHERE id = ?", table), deletionID, change.ID)
+			if err != nil {
+				msg := fmt.Sprintf("unable to delete %d from %s: %s", change.ID, table, err.Error())
+				logger.Errorf(ctx, "%s", msg)
+				return apierrors.Wrap(err, msg)
+			}
+		}
+
+		return nil
+	}
+
+	variableDeletes, err := applyVariables(ctx, tx, &plan, desired.Variables)
+	if err == nil {
+		err = trash(variableDeletes)
+	}
+	if err != nil {
+		return plan, err
+	}
+
+	//the variables are where they'll end up, so templates are checked against what they'll be rendered with
+	err = checkMicroservices(ctx, tx, classID, designationID, desired.Microservices)
+	if err != nil {
+		return plan, err
+	}
+
+	microserviceDeletes, err := applyMicroservices(ctx, tx, &plan, desired.Microservices)
+	if err == nil {
+		err = trash(microserviceDeletes)
+	}
+	if err != nil {
+		return plan, err
+	}
+
+	plan.Changes = append(plan.Changes, variableDeletes...)
+	plan.Changes = append(plan.Changes, microserviceDeletes...)
+
+	if deletionID != 0 && !dryRun {
+		deletion, err := getDeletion(ctx, tx, deletionID, false)
+		if err != nil {
+			return plan, err
+		}
+
+		plan.Deletion = &deletion
+	}
+
+	//everything ran, so a dry run hits the same errors a real one would
+	if dryRun {
+		for i := range plan.Changes {
+			if plan.Changes[i].Action == ADD_CHANGE {
+				plan.Changes[i].ID = 0
+			}
+		}
+
+		return plan, nil
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		msg := fmt.Sprintf("unable to commit apply: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return plan, apierrors.Wrap(err, msg)
+	}
+
+	plan.Applied = true
+	return plan, nil
+}
+
+//adds and edits variable mappings - returns the deletes, which Apply does all at once
+func applyVariables(ctx context.Context, tx *sqlx.Tx, plan *ApplyPlan, desired map[string]string) ([]PlannedChange, error) {
+
+	var variables []Variable
+	err := tx.Select(&variables, "SELECT "+VARIABLE_COLUMNS+" FROM variable_definitions WHERE deletion_id IS NULL")
+	if err != nil {
+		msg := fmt.Sprintf("unable to get variables: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return nil, apierrors.Wrap(err, msg)
+	}
+
+	byName := make(map[string]*Variable)
+	byID := make(map[int64]*Variable)
+	for i := range variables {
+		byName[variables[i].Name] = &variables[i]
+		byID[variables[i].ID] = &variables[i]
+	}
+
+	var rows []DBVariable
+	err = tx.Select(&rows, "SELECT "+VARIABLE_MAPPING_COLUMNS+" FROM variable_mappings WHERE class_id = ? AND designation_id = ? AND deletion_id IS NULL ORDER BY id FOR UPDATE",
+		plan.ClassID, plan.DesignationID)
+	if err != nil {
+		msg := fmt.Sprintf("unable to get variable mappings: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return nil, apierrors.Wrap(err, msg)
+	}
+
+	current := make(map[int64]DBVariable)
+	for _, row := range rows {
+		current[row.VarID] = row
+	}
+
+	var names []string
+	for name := range desired {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	wanted := make(map[int64]bool)
+	for _, name := range names {
+
+		value := desired[name]
+
+		variable, ok := byName[name]
+		if !ok {
+			msg := fmt.Sprintf("there's no variable named '%s'", name)
+			return nil, apierrors.InvalidReference("variables."+name, msg)
+		}
+
+		wanted[variable.ID] = true
+		row, exists := current[variable.ID]
+
+		if variable.Secret && value == logging.REDACTED {
+			if !exists {
+				msg := fmt.Sprintf("%s is secret and has no value to keep - send the real one", name)
+				return nil, apierrors.Invalid("variables."+name, msg)
+			}
+
+			plan.Unchanged++
+			continue
+		}
+
+		err = ValidateVariableValue(variable, value)
+		if err != nil {
+			return nil, apierrors.Invalid("variables."+name, err.Error())
+		}
+
+		change := PlannedChange{Kind: VARIABLE_MAPPING_RESULT, Name: name, To: shown(variable, value)}
+
+		switch {
+		case !exists:
+
+			result, err := tx.Exec("INSERT INTO variable_mappings (variable_id, designation_id, class_id, value) VALUES (?, ?, ?, ?)",
+				variable.ID, plan.DesignationID, plan.ClassID, value)
+			if err != nil {
+				msg := fmt.Sprintf("unable to add %s: %s", name, err.Error())
+				logger.Errorf(ctx, "%s", msg)
+				return nil, apierrors.Wrap(err, msg)
+			}
+
+			change.Action = ADD_CHANGE
+			change.ID, _ = result.LastInsertId()
+
+		case row.Value == value:
+			plan.Unchanged++
+			continue
+
+		default:
+
+			_, err = tx.Exec("UPDATE variable_mappings SET value = ?, "+VERSION_BUMP+" WHERE id = ?", value, row.ID)
+			if err != nil {
+				msg := fmt.Sprintf("unable to edit %s: %s", name, err.Error())
+				logger.Errorf(ctx, "%s", msg)
+				return nil, apierrors.Wrap(err, msg)
+			}
+
+			change.Action = EDIT_CHANGE
+			change.ID = row.ID
+			change.From = shown(variable, row.Value)
+		}
+
+		plan.Changes = append(plan.Changes, change)
+	}
+
+	var deletes []PlannedChange
+	for _, row := range rows {
+
+		if wanted[row.VarID] {
+			continue
+		}
+
+		variable := byID[row.VarID]
+		deletes = append(deletes, PlannedChange{
+			Action: DELETE_CHANGE,
+			Kind:   VARIABLE_MAPPING_RESULT,
+			Name:   variable.Name,
+			ID:     row.ID,
+			From:   shown(variable, row.Value),
+		})
+	}
+
+	return deletes, nil
+}
+
+//how a value shows up in a plan
+func shown(variable *Variable, value string) string {
+
+	if variable.Secret {
+		return logging.REDACTED
+	}
+
+	return value
+}
+
+//test-renders every desired mapping the way the mapping handlers do, before any of them is planned
+func checkMicroservices(ctx context.Context, tx *sqlx.Tx, classID, designationID int64, desired map[string]DesiredMappings) error {
+
+	var names []string
+	for name := range desired {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var templateContext *TemplateContext
+	for _, name := range names {
+
+		var microservice Microservice
+		err := tx.Get(&microservice, "SELECT "+MICROSERVICE_COLUMNS+" FROM microservice_definitions WHERE name = ? AND deletion_id IS NULL", name)
+		if err == sql.ErrNoRows {
+			msg := fmt.Sprintf("there's no microservice named '%s'", name)
+			return apierrors.InvalidReference("microservices."+name, msg)
+		}
+
+		if err != nil {
+			msg := fmt.Sprintf("unable to get microservice %s: %s", name, err.Error())
+			logger.Errorf(ctx, "%s", msg)
+			return apierrors.Wrap(err, msg)
+		}
+
+		for _, mapping := range desired[name] {
+
+			if templateContext == nil && IsTemplate(mapping.YAML) {
+				loaded, err := loadTemplateContext(tx, classID, designationID)
+				if err != nil {
+					msg := fmt.Sprintf("unable to check templates: %s", err.Error())
+					logger.Errorf(ctx, "%s", msg)
+					return apierrors.Wrap(err, msg)
+				}
+				templateContext = &loaded
+			}
+
+			var current TemplateContext
+			if templateContext != nil {
+				current = *templateContext
+			}
+
+			err = CheckMicroserviceMapping(microservice, mapping.YAML, mapping.overrides(), current)
+			if err != nil {
+				return apierrors.Invalid("microservices."+name, fmt.Sprintf("microservices.%s: %s", name, err.Error()))
+			}
+		}
+	}
+
+	return nil
+}
+
+//adds and edits microservice mappings - returns the deletes, which Apply does all at once
+//mappings of the same microservice are matched like an import matches them - unchanged ones first, then edits of whatever's left over
+func applyMicroservices(ctx context.Context, tx *sqlx.Tx, plan *ApplyPlan, desired map[string]DesiredMappings) ([]PlannedChange, error) {
+
+	var microservices []Definition
+	err := tx.Select(&microservices, "SELECT "+DEFINITION_COLUMNS+" FROM microservice_definitions WHERE deletion_id IS NULL")
+	if err != nil {
+		msg := fmt.Sprintf("unable to get microservices: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return nil, apierrors.Wrap(err, msg)
+	}
+
+	byName := make(map[string]int64)
+	byID := make(map[int64]string)
+	for _, microservice := range microservices {
+		byName[microservice.Name] = microservice.ID
+		byID[microservice.ID] = microservice.Name
+	}
+
+	var rows []DBMicroservice
+	err = tx.Select(&rows, "SELECT "+MICROSERVICE_MAPPING_COLUMNS+" FROM microservice_mappings WHERE class_id = ? AND designation_id = ? AND deletion_id IS NULL ORDER BY id FOR UPDATE",
+		plan.ClassID, plan.DesignationID)
+	if err != nil {
+		msg := fmt.Sprintf("unable to get microservice mappings: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return nil, apierrors.Wrap(err, msg)
+	}
+
+	current := make(map[int64][]DBMicroservice)
+	for _, row := range rows {
+		current[row.MicroID] = append(current[row.MicroID], row)
+	}
+
+	var names []string
+	for name := range desired {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	kept := make(map[int64]bool) //mapping IDs
+	for _, name := range names {
+
+		microserviceID, ok := byName[name]
+		if !ok {
+			msg := fmt.Sprintf("there's no microservice named '%s'", name)
+			return nil, apierrors.InvalidReference("microservices."+name, msg)
+		}
+
+		existing := current[microserviceID]
+		used := make([]bool, len(existing))
+		var unmatched []DesiredMicroservice
+
+		//first the ones that haven't changed
+		for _, mapping := range desired[name] {
+
+			matched := false
+			for j, row := range existing {
+				if !used[j] && row.YAML == mapping.YAML && sameSpec(row.Overrides, mapping.overrides()) {
+					used[j] = true
+					matched = true
+					kept[row.ID] = true
+					plan.Unchanged++
+					break
+				}
+			}
+
+			if !matched {
+				unmatched = append(unmatched, mapping)
+			}
+		}
+
+		//then edits of whatever's left over, and adds once that runs out
+		for _, mapping := range unmatched {
+
+			change := PlannedChange{Kind: MICROSERVICE_MAPPING_RESULT, Name: name, To: describeMapping(mapping.YAML, mapping.overrides())}
+
+			j := 0
+			for j < len(existing) && used[j] {
+				j++
+			}
+
+			if j < len(existing) {
+
+				used[j] = true
+				row := existing[j]
+				kept[row.ID] = true
+
+				_, err = tx.Exec("UPDATE microservice_mappings SET yaml = ?, overrides = ?, "+VERSION_BUMP+" WHERE id = ?", mapping.YAML, mapping.overrides(), row.ID)
+				if err != nil {
+					msg := fmt.Sprintf("unable to edit %s: %s", name, err.Error())
+					logger.Errorf(ctx, "%s", msg)
+					return nil, apierrors.Wrap(err, msg)
+				}
+
+				change.Action = EDIT_CHANGE
+				change.ID = row.ID
+				change.From = describeMapping(row.YAML, row.Overrides)
+
+			} else {
+
+				result, err := tx.Exec("INSERT INTO microservice_mappings (microservice_id, designation_id, class_id, yaml, overrides) VALUES (?, ?, ?, ?, ?)",
+					microserviceID, plan.DesignationID, plan.ClassID, mapping.YAML, mapping.overrides())
+				if err != nil {
+					msg := fmt.Sprintf("unable to add %s: %s", name, err.Error())
+					logger.Errorf(ctx, "%s", msg)
+					return nil, apierrors.Wrap(err, msg)
+				}
+
+				change.Action = ADD_CHANGE
+				change.ID, _ = result.LastInsertId()
+			}
+
+			plan.Changes = append(plan.Changes, change)
+		}
+	}
+
+	var deletes []PlannedChange
+	for _, row := range rows {
+
+		if kept[row.ID] {
+			continue
+		}
+
+		deletes = append(deletes, PlannedChange{
+			Action: DELETE_CHANGE,
+			Kind:   MICROSERVICE_MAPPING_RESULT,
+			Name:   byID[row.MicroID],
+			ID:     row.ID,
+			From:   describeMapping(row.YAML, row.Overrides),
+		})
+	}
+
+	return deletes, nil
+}
+
+func (mapping DesiredMicroservice) overrides() MicroserviceSpec {
+
+	if mapping.Overrides == nil {
+		return MicroserviceSpec{}
+	}
+
+	return *mapping.Overrides
+}
+
+//the YAML of a mapping, or its overrides as JSON when it has none
+func describeMapping(yaml string, overrides MicroserviceSpec) string {
+
+	if len(yaml) > 0 {
+		return yaml
+	}
+
+	value, err := overrides.Value()
+	if err != nil {
+		return ""
+	}
+
+	return value.(string)
+}
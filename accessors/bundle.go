@@ -0,0 +1,1354 @@
+package accessors
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/byuoitav/pi-designation-microservice/apierrors"
+	db "github.com/byuoitav/pi-designation-microservice/database"
+	"github.com/byuoitav/pi-designation-microservice/logging"
+	"github.com/jmoiron/sqlx"
+)
+
+//bumped whenever the layout of a bundle changes in a way older versions can't read
+const BUNDLE_FORMAT = 1
+
+//how an import treats what's already in the database
+const (
+	MERGE_IMPORT   = "merge"   //adds and updates, and leaves everything the bundle doesn't mention alone
+	REPLACE_IMPORT = "replace" //makes the database match the bundle - definitions and mappings left out go to the trash
+)
+
+var ImportModes = []string{MERGE_IMPORT, REPLACE_IMPORT}
+
+//sections of a bundle - also how an import reports its changes
+const (
+	CLASSES_SECTION               = "classes"
+	DESIGNATIONS_SECTION          = "designations"
+	VARIABLES_SECTION             = "variables"
+	MICROSERVICES_SECTION         = "microservices"
+	VARIABLE_MAPPINGS_SECTION     = "variable-mappings"
+	MICROSERVICE_MAPPINGS_SECTION = "microservice-mappings"
+	REQUIRED_VARIABLES_SECTION    = "required-variables"
+	IMAGE_TAGS_SECTION            = "image-tags"
+	ROOMS_SECTION                 = "rooms"
+)
+
+//every definition and mapping in the database - everything refers to everything else by name, so a bundle loads into any database
+type Bundle struct {
+	Format               int                         `json:"format" yaml:"format"`
+	ExportedAt           time.Time                   `json:"exported-at" yaml:"exported-at"`
+	Classes              []BundleDefinition          `json:"classes" yaml:"classes"`
+	Designations         []BundleDefinition          `json:"designations" yaml:"designations"`
+	Variables            []BundleVariable            `json:"variables" yaml:"variables"`
+	Microservices        []BundleMicroservice        `json:"microservices" yaml:"microservices"`
+	VariableMappings     []BundleVariableMapping     `json:"variable-mappings" yaml:"variable-mappings"`
+	MicroserviceMappings []BundleMicroserviceMapping `json:"microservice-mappings" yaml:"microservice-mappings"`
+	ImageTags            []BundleImageTag            `json:"image-tags" yaml:"image-tags"`
+	Rooms                []BundleRoom                `json:"rooms" yaml:"rooms"`
+}
+
+type BundleDefinition struct {
+	Name        string `json:"name" yaml:"name" db:"name"`
+	Description string `json:"description,omitempty" yaml:"description,omitempty" db:"description"`
+}
+
+type BundleVariable struct {
+	Name        string   `json:"name" yaml:"name"`
+	Description string   `json:"description,omitempty" yaml:"description,omitempty"`
+	Type        string   `json:"type,omitempty" yaml:"type,omitempty"`
+	Validation  string   `json:"validation,omitempty" yaml:"validation,omitempty"`
+	Default     *string  `json:"default,omitempty" yaml:"default,omitempty"`
+	Secret      bool     `json:"secret,omitempty" yaml:"secret,omitempty"`
+	Required    []string `json:"required,omitempty" yaml:"required,omitempty"` //classes it has to have a value in
+}
+
+type BundleMicroservice struct {
+	Name        string            `json:"name" yaml:"name"`
+	Description string            `json:"description,omitempty" yaml:"description,omitempty"`
+	Spec        *MicroserviceSpec `json:"spec,omitempty" yaml:"spec,omitempty"`
+}
+
+type BundleVariableMapping struct {
+	Class       string `json:"class" yaml:"class" db:"class"`
+	Designation string `json:"designation" yaml:"designation" db:"designation"`
+	Variable    string `json:"variable" yaml:"variable" db:"variable"`
+	Value       string `json:"value" yaml:"value" db:"value"`
+}
+
+//YAML or overrides, like any other microservice mapping
+type BundleMicroserviceMapping struct {
+	Class        string            `json:"class" yaml:"class"`
+	Designation  string            `json:"designation" yaml:"designation"`
+	Microservice string            `json:"microservice" yaml:"microservice"`
+	YAML         string            `json:"yaml,omitempty" yaml:"yaml,omitempty"`
+	Overrides    *MicroserviceSpec `json:"overrides,omitempty" yaml:"overrides,omitempty"`
+}
+
+type BundleImageTag struct {
+	Microservice string `json:"microservice" yaml:"microservice" db:"microservice"`
+	Designation  string `json:"designation" yaml:"designation" db:"designation"`
+	Tag          string `json:"tag" yaml:"tag" db:"tag"`
+}
+
+type BundleRoom struct {
+	Designation     string `json:"designation" yaml:"designation" db:"designation"`
+	Name            string `json:"name" yaml:"name" db:"name"`
+	UIConfiguration string `json:"ui-configuration" yaml:"ui-configuration" db:"ui_configuation"`
+}
+
+//what an import did, or would do on a dry run
+type ImportResult struct {
+	Mode     string                  `json:"mode"`
+	DryRun   bool                    `json:"dry-run"`
+	Changes  map[string]*ImportCount `json:"changes"`            //by section of the bundle
+	Skipped  []string                `json:"skipped,omitempty"`  //redacted secrets with nothing to keep in their place
+	Deletion *Deletion               `json:"deletion,omitempty"` //the definitions and mappings a replace moved to the trash - restore it to undo that
+	Removed  []string                `json:"removed,omitempty"`  //required variables, image tags and rooms removed for good - restoring the deletion doesn't bring these back
+}
+
+type ImportCount struct {
+	Added     int `json:"added"`
+	Updated   int `json:"updated"`
+	Removed   int `json:"removed"`
+	Unchanged int `json:"unchanged"`
+}
+
+//a mapping's class, designation and whatever it maps
+type mappingKey struct {
+	class       int64
+	designation int64
+	definition  int64
+}
+
+//loads a bundle inside one transaction
+type importer struct {
+	ctx     context.Context
+	tx      *sqlx.Tx
+	mode    string
+	result  *ImportResult
+	ids     map[string]map[string]int64 //definition table -> name -> ID, of everything that's live once the bundle is in
+	removed map[string][]int64          //table -> IDs headed for the trash
+	checked map[int64]bool              //variables whose type or validation changed - their values get checked at the end
+	all     map[int64]*Variable         //every variable a mapping can refer to
+}
+
+//secrets says whether the values of secret variables go in, or logging.REDACTED
+func Export(ctx context.Context, secrets bool) (Bundle, error) {
+
+	logger.Debugf(ctx, "exporting everything...")
+
+	bundle := Bundle{
+		Format:               BUNDLE_FORMAT,
+		ExportedAt:           time.Now().UTC(),
+		Classes:              []BundleDefinition{},
+		Designations:         []BundleDefinition{},
+		Variables:            []BundleVariable{},
+		Microservices:        []BundleMicroservice{},
+		VariableMappings:     []BundleVariableMapping{},
+		MicroserviceMappings: []BundleMicroserviceMapping{},
+		ImageTags:            []BundleImageTag{},
+		Rooms:                []BundleRoom{},
+	}
+
+	//one transaction, so every section sees the same moment
+	tx, err := db.DB().Beginx()
+	if err != nil {
+		msg := fmt.Sprintf("unable to start transaction: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return bundle, apierrors.Wrap(err, msg)
+	}
+	defer tx.Rollback()
+
+	sections := []struct {
+		name    string
+		output  interface{}
+		command string
+	}{
+		{CLASSES_SECTION, &bundle.Classes, "SELECT name, description FROM class_definitions WHERE deletion_id IS NULL ORDER BY name"},
+		{DESIGNATIONS_SECTION, &bundle.Designations, "SELECT name, description FROM designation_definitions WHERE deletion_id IS NULL ORDER BY name"},
+		{IMAGE_TAGS_SECTION, &bundle.ImageTags, `SELECT x.name AS microservice, d.name AS designation, t.tag FROM microservice_tags t
+			JOIN microservice_definitions x ON x.id = t.microservice_id
+			JOIN designation_definitions d ON d.id = t.designation_id
+			WHERE x.deletion_id IS NULL AND d.deletion_id IS NULL ORDER BY x.name, d.name`},
+		{ROOMS_SECTION, &bundle.Rooms, `SELECT d.name AS designation, r.name, r.ui_configuation FROM rooms r
+			JOIN designation_definitions d ON d.id = r.designation_id
+			WHERE d.deletion_id IS NULL ORDER BY d.name, r.name`},
+	}
+
+	for _, section := range sections {
+
+		err = tx.Select(section.output, section.command)
+		if err != nil {
+			msg := fmt.Sprintf("unable to export %s: %s", section.name, err.Error())
+			logger.Errorf(ctx, "%s", msg)
+			return bundle, apierrors.Wrap(err, msg)
+		}
+	}
+
+	var variables []Variable
+	err = tx.Select(&variables, "SELECT "+VARIABLE_COLUMNS+" FROM variable_definitions WHERE deletion_id IS NULL ORDER BY name")
+	if err != nil {
+		msg := fmt.Sprintf("unable to export variables: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return bundle, apierrors.Wrap(err, msg)
+	}
+
+	var required []struct {
+		Variable int64  `db:"variable_id"`
+		Class    string `db:"name"`
+	}
+	err = tx.Select(&required, `SELECT r.variable_id, c.name FROM required_variables r
+		JOIN class_definitions c ON c.id = r.class_id WHERE c.deletion_id IS NULL ORDER BY c.name`)
+	if err != nil {
+		msg := fmt.Sprintf("unable to export required variables: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return bundle, apierrors.Wrap(err, msg)
+	}
+
+	classes := make(map[int64][]string)
+	for _, row := range required {
+		classes[row.Variable] = append(classes[row.Variable], row.Class)
+	}
+
+	for _, variable := range variables {
+
+		if variable.Secret && variable.Default != nil && !secrets {
+			redacted := logging.REDACTED
+			variable.Default = &redacted
+		}
+
+		bundle.Variables = append(bundle.Variables, BundleVariable{
+			Name:        variable.Name,
+			Description: variable.Description,
+			Type:        variable.Type,
+			Validation:  variable.Validation,
+			Default:     variable.Default,
+			Secret:      variable.Secret,
+			Required:    classes[variable.ID],
+		})
+	}
+
+	var microservices []Microservice
+	err = tx.Select(&microservices, "SELECT "+MICROSERVICE_COLUMNS+" FROM microservice_definitions WHERE deletion_id IS NULL ORDER BY name")
+	if err != nil {
+		msg := fmt.Sprintf("unable to export microservices: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return bundle, apierrors.Wrap(err, msg)
+	}
+
+	for i := range microservices {
+		bundle.Microservices = append(bundle.Microservices, BundleMicroservice{
+			Name:        microservices[i].Name,
+			Description: microservices[i].Description,
+			Spec:        specOrNil(microservices[i].Spec),
+		})
+	}
+
+	var variableMappings []struct {
+		BundleVariableMapping
+		Secret bool `db:"secret"`
+	}
+	err = tx.Select(&variableMappings, `SELECT c.name AS class, d.name AS designation, x.name AS variable, m.value, x.secret FROM variable_mappings m
+		JOIN class_definitions c ON c.id = m.class_id
+		JOIN designation_definitions d ON d.id = m.designation_id
+		JOIN variable_definitions x ON x.id = m.variable_id
+		WHERE m.deletion_id IS NULL ORDER BY c.name, d.name, x.name`)
+	if err != nil {
+		msg := fmt.Sprintf("unable to export variable mappings: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return bundle, apierrors.Wrap(err, msg)
+	}
+
+	for _, mapping := range variableMappings {
+
+		if mapping.Secret && !secrets {
+			mapping.Value = logging.REDACTED
+		}
+
+		bundle.VariableMappings = append(bundle.VariableMappings, mapping.BundleVariableMapping)
+	}
+
+	var microserviceMappings []struct {
+		Class        string           `db:"class"`
+		Designation  string           `db:"designation"`
+		Microservice string           `db:"microservice"`
+		YAML         string           `db:"yaml"`
+		Overrides    MicroserviceSpec `db:"overrides"`
+	}
+	err = tx.Select(&microserviceMappings, `SELECT c.name AS class, d.name AS designation, x.name AS microservice, m.yaml, m.overrides FROM microservice_mappings m
+		JOIN class_definitions c ON c.id = m.class_id
+		JOIN designation_definitions d ON d.id = m.designation_id
+		JOIN microservice_definitions x ON x.id = m.microservice_id
+		WHERE m.deletion_id IS NULL ORDER BY c.name, d.name, x.name, m.id`)
+	if err != nil {
+		msg := fmt.Sprintf("unable to export microservice mappings: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return bundle, apierrors.Wrap(err, msg)
+	}
+
+	for _, mapping := range microserviceMappings {
+		bundle.MicroserviceMappings = append(bundle.MicroserviceMappings, BundleMicroserviceMapping{
+			Class:        mapping.Class,
+			Designation:  mapping.Designation,
+			Microservice: mapping.Microservice,
+			YAML:         mapping.YAML,
+			Overrides:    specOrNil(mapping.Overrides),
+		})
+	}
+
+	if secrets {
+		logger.Warnf(ctx, "exported the values of secret variables")
+	}
+
+	return bundle, nil
+}
+
+func specOrNil(spec MicroserviceSpec) *MicroserviceSpec {
+
+	if spec.IsEmpty() {
+		return nil
+	}
+
+	return &spec
+}
+
+//Export only leaves out the values of secret variables - this hides them wherever else they turn up too, in microservice YAML, specs and overrides
+//for a bundle that's going somewhere secrets shouldn't, since importing it back would load logging.REDACTED in their place
+func RedactSecrets(bundle *Bundle) error {
+
+	secrets, err := getSecretValues()
+	if err != nil {
+		return errors.New(fmt.Sprintf("unable to get secret values: %s", err.Error()))
+	}
+
+	for i := range bundle.Microservices {
+		secrets.replaceSpec(bundle.Microservices[i].Spec)
+	}
+
+	for i := range bundle.MicroserviceMappings {
+		bundle.MicroserviceMappings[i].YAML = secrets.Replace(bundle.MicroserviceMappings[i].YAML)
+		secrets.replaceSpec(bundle.MicroserviceMappings[i].Overrides)
+	}
+
+	return nil
+}
+
+//loads a bundle in one transaction - nothing changes unless all of it goes in
+//secret values left as logging.REDACTED keep whatever value is already there
+func Import(ctx context.Context, bundle *Bundle, mode string, dryRun bool) (ImportResult, error) {
+
+	logger.Debugf(ctx, "importing a bundle (mode %s, dry run %v)...", mode, dryRun)
+
+	result := ImportResult{Mode: mode, DryRun: dryRun, Changes: make(map[string]*ImportCount)}
+
+	if mode != MERGE_IMPORT && mode != REPLACE_IMPORT {
+		msg := fmt.Sprintf("invalid mode '%s', expected one of %v", mode, ImportModes)
+		return result, apierrors.BadRequest("mode", msg)
+	}
+
+	if bundle.Format > BUNDLE_FORMAT {
+		msg := fmt.Sprintf("bundle format %d is newer than this service understands (%d)", bundle.Format, BUNDLE_FORMAT)
+		return result, apierrors.BadRequest("format", msg)
+	}
+
+	for _, section := range []string{CLASSES_SECTION, DESIGNATIONS_SECTION, VARIABLES_SECTION, MICROSERVICES_SECTION, VARIABLE_MAPPINGS_SECTION,
+		MICROSERVICE_MAPPINGS_SECTION, REQUIRED_VARIABLES_SECTION, IMAGE_TAGS_SECTION, ROOMS_SECTION} {
+		result.Changes[section] = &ImportCount{}
+	}
+
+	tx, err := db.DB().Beginx()
+	if err != nil {
+		msg := fmt.Sprintf("unable to start transaction: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return result, apierrors.Wrap(err, msg)
+	}
+	defer tx.Rollback()
+
+	in := importer{
+		ctx:     ctx,
+		tx:      tx,
+		mode:    mode,
+		result:  &result,
+		ids:     make(map[string]map[string]int64),
+		removed: make(map[string][]int64),
+		checked: make(map[int64]bool),
+		all:     make(map[int64]*Variable),
+	}
+
+	steps := []func(*Bundle) error{
+		func(bundle *Bundle) error {
+			return in.definitions("class_definitions", CLASSES_SECTION, bundle.Classes)
+		},
+		func(bundle *Bundle) error {
+			return in.definitions("designation_definitions", DESIGNATIONS_SECTION, bundle.Designations)
+		},
+		in.variables,
+		in.microservices,
+		in.variableMappings,
+		in.microserviceMappings,
+		in.imageTags,
+		in.rooms,
+		in.trash,
+		in.checkValues,
+		in.checkMicroserviceMappings,
+	}
+
+	for _, step := range steps {
+		err = step(bundle)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	if dryRun {
+		result.Deletion = nil
+		return result, nil
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		msg := fmt.Sprintf("unable to commit import: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return result, apierrors.Wrap(err, msg)
+	}
+
+	return result, nil
+}
+
+//section[index], for errors about one entry of a bundle
+func entry(section string, index int) string {
+	return fmt.Sprintf("%s[%d]", section, index)
+}
+
+//points err at an entry of the bundle
+func entryError(section string, index int, err error) error {
+
+	e := apierrors.From(err, http.StatusUnprocessableEntity, fmt.Sprintf("%s: %s", entry(section, index), err.Error()))
+	if len(e.Field) > 0 {
+		e.Field = entry(section, index) + "." + e.Field
+	} else {
+		e.Field = entry(section, index)
+	}
+
+	return e
+}
+
+//the ID of a definition by name, or an invalid_reference pointing at the entry that named it
+func (in *importer) id(table, name, section string, index int, field string) (int64, error) {
+
+	id, ok := in.ids[table][name]
+	if !ok {
+		msg := fmt.Sprintf("%s: there's no %s named '%s'", entry(section, index), field, name)
+		return 0, apierrors.InvalidReference(entry(section, index)+"."+field, msg)
+	}
+
+	return id, nil
+}
+
+func (in *importer) fail(err error, format string, args ...interface{}) error {
+
+	msg := fmt.Sprintf(format, args...) + ": " + err.Error()
+	logger.Errorf(in.ctx, "%s", msg)
+	return apierrors.Wrap(err, msg)
+}
+
+//names the bundle defines twice
+func duplicate(seen map[string]bool, name, section string, index int) error {
+
+	if len(name) == 0 {
+		return apierrors.Invalid(entry(section, index)+".name", fmt.Sprintf("%s: invalid definition name", entry(section, index)))
+	}
+
+	if seen[name] {
+		return apierrors.BadRequest(entry(section, index)+".name", fmt.Sprintf("%s: %s is in the bundle twice", entry(section, index), name))
+	}
+
+	seen[name] = true
+	return nil
+}
+
+//the live definitions of a table by name - in replace mode, whatever the bundle leaves out is headed for the trash
+func (in *importer) existing(table string, rows map[string]int64, seen map[string]bool) {
+
+	in.ids[table] = make(map[string]int64)
+
+	for name, id := range rows {
+		if seen[name] {
+			in.ids[table][name] = id
+		} else if in.mode == REPLACE_IMPORT {
+			in.removed[table] = append(in.removed[table], id)
+		} else {
+			in.ids[table][name] = id
+		}
+	}
+}
+
+func (in *importer) definitions(table, section string, definitions []BundleDefinition) error {
+
+	count := in.result.Changes[section]
+
+	var rows []Definition
+	err := in.tx.Select(&rows, fmt.Sprintf("SELECT %s FROM %s WHERE deletion_id IS NULL", DEFINITION_COLUMNS, table))
+	if err != nil {
+		return in.fail(err, "unable to get %s", section)
+	}
+
+	current := make(map[string]Definition)
+	names := make(map[string]int64)
+	for _, row := range rows {
+		current[row.Name] = row
+		names[row.Name] = row.ID
+	}
+
+	seen := make(map[string]bool)
+	for i, definition := range definitions {
+
+		err = duplicate(seen, definition.Name, section, i)
+		if err != nil {
+			return err
+		}
+
+		row, ok := current[definition.Name]
+		if !ok {
+
+			result, err := in.tx.Exec(fmt.Sprintf("INSERT INTO %s (name, description) VALUES (?, ?)", table), definition.Name, definition.Description)
+			if err != nil {
+				return entryError(section, i, err)
+			}
+
+			names[definition.Name], err = result.LastInsertId()
+			if err != nil {
+				return in.fail(err, "id not found")
+			}
+
+			count.Added++
+			continue
+		}
+
+		if row.Description == definition.Description {
+			count.Unchanged++
+			continue
+		}
+
+		_, err = in.tx.Exec(fmt.Sprintf("UPDATE %s SET description = ?, %s WHERE id = ?", table, VERSION_BUMP), definition.Description, row.ID)
+		if err != nil {
+			return entryError(section, i, err)
+		}
+
+		count.Updated++
+	}
+
+	in.existing(table, names, seen)
+	count.Removed = len(in.removed[table])
+
+	return nil
+}
+
+func (in *importer) variables(bundle *Bundle) error {
+
+	count := in.result.Changes[VARIABLES_SECTION]
+
+	var rows []Variable
+	err := in.tx.Select(&rows, "SELECT "+VARIABLE_COLUMNS+" FROM variable_definitions WHERE deletion_id IS NULL")
+	if err != nil {
+		return in.fail(err, "unable to get variables")
+	}
+
+	current := make(map[string]*Variable)
+	names := make(map[string]int64)
+	for i := range rows {
+		current[rows[i].Name] = &rows[i]
+		names[rows[i].Name] = rows[i].ID
+		in.all[rows[i].ID] = &rows[i]
+	}
+
+	var required []struct {
+		Variable int64 `db:"variable_id"`
+		Class    int64 `db:"class_id"`
+	}
+	err = in.tx.Select(&required, "SELECT variable_id, class_id FROM required_variables")
+	if err != nil {
+		return in.fail(err, "unable to get required variables")
+	}
+
+	requiredIn := make(map[int64]map[int64]bool)
+	for _, row := range required {
+		if requiredIn[row.Variable] == nil {
+			requiredIn[row.Variable] = make(map[int64]bool)
+		}
+		requiredIn[row.Variable][row.Class] = true
+	}
+
+	seen := make(map[string]bool)
+	for i, definition := range bundle.Variables {
+
+		err = duplicate(seen, definition.Name, VARIABLES_SECTION, i)
+		if err != nil {
+			return err
+		}
+
+		variable := &Variable{
+			Definition: Definition{Name: definition.Name, Description: definition.Description},
+			Type:       definition.Type,
+			Validation: definition.Validation,
+			Default:    definition.Default,
+			Secret:     definition.Secret,
+		}
+
+		row, exists := current[definition.Name]
+
+		if variable.Secret && variable.Default != nil && *variable.Default == logging.REDACTED {
+			if exists {
+				variable.Default = row.Default
+			} else {
+				variable.Default = nil
+				in.result.Skipped = append(in.result.Skipped, fmt.Sprintf("%s: redacted default of %s", entry(VARIABLES_SECTION, i), variable.Name))
+			}
+		}
+
+		err = ValidateVariableDefinition(variable)
+		if err != nil {
+			return entryError(VARIABLES_SECTION, i, err)
+		}
+
+		switch {
+		case !exists:
+
+			result, err := in.tx.Exec("INSERT INTO variable_definitions (name, description, type, validation, default_value, secret) VALUES (?, ?, ?, ?, ?, ?)",
+				variable.Name, variable.Description, variable.Type, variable.Validation, variable.Default, variable.Secret)
+			if err != nil {
+				return entryError(VARIABLES_SECTION, i, err)
+			}
+
+			variable.ID, err = result.LastInsertId()
+			if err != nil {
+				return in.fail(err, "id not found")
+			}
+
+			names[variable.Name] = variable.ID
+			count.Added++
+
+		case row.Description == variable.Description && row.Type == variable.Type && row.Validation == variable.Validation &&
+			sameDefault(row.Default, variable.Default) && row.Secret == variable.Secret:
+
+			variable.ID = row.ID
+			count.Unchanged++
+
+		default:
+
+			variable.ID = row.ID
+
+			_, err = in.tx.Exec("UPDATE variable_definitions SET description = ?, type = ?, validation = ?, default_value = ?, secret = ?, "+VERSION_BUMP+" WHERE id = ?",
+				variable.Description, variable.Type, variable.Validation, variable.Default, variable.Secret, variable.ID)
+			if err != nil {
+				return entryError(VARIABLES_SECTION, i, err)
+			}
+
+			if row.Type != variable.Type || row.Validation != variable.Validation {
+				in.checked[variable.ID] = true
+			}
+
+			count.Updated++
+		}
+
+		in.all[variable.ID] = variable
+
+		err = in.required(variable.ID, definition.Required, requiredIn[variable.ID], i)
+		if err != nil {
+			return err
+		}
+	}
+
+	in.existing("variable_definitions", names, seen)
+	count.Removed = len(in.removed["variable_definitions"])
+
+	return nil
+}
+
+func sameDefault(a, b *string) bool {
+
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+
+	return *a == *b
+}
+
+//makes the classes a variable is required in match the bundle
+func (in *importer) required(variableID int64, classes []string, current map[int64]bool, index int) error {
+
+	count := in.result.Changes[REQUIRED_VARIABLES_SECTION]
+
+	wanted := make(map[int64]bool)
+	for _, class := range classes {
+
+		classID, err := in.id("class_definitions", class, VARIABLES_SECTION, index, "required")
+		if err != nil {
+			return err
+		}
+
+		wanted[classID] = true
+
+		if current[classID] {
+			count.Unchanged++
+			continue
+		}
+
+		_, err = in.tx.Exec("INSERT INTO required_variables (variable_id, class_id) VALUES (?, ?)", variableID, classID)
+		if err != nil {
+			return entryError(VARIABLES_SECTION, index, err)
+		}
+
+		count.Added++
+	}
+
+	for classID := range current {
+
+		if wanted[classID] {
+			continue
+		}
+
+		err := in.removeForGood("required_variables", `SELECT r.id, CONCAT(v.name, ' required in ', c.name) AS summary FROM required_variables r
+			JOIN variable_definitions v ON v.id = r.variable_id
+			JOIN class_definitions c ON c.id = r.class_id
+			WHERE r.variable_id = ? AND r.class_id = ?`, variableID, classID)
+		if err != nil {
+			return err
+		}
+
+		count.Removed++
+	}
+
+	return nil
+}
+
+func (in *importer) microservices(bundle *Bundle) error {
+
+	count := in.result.Changes[MICROSERVICES_SECTION]
+
+	var rows []Microservice
+	err := in.tx.Select(&rows, "SELECT "+MICROSERVICE_COLUMNS+" FROM microservice_definitions WHERE deletion_id IS NULL")
+	if err != nil {
+		return in.fail(err, "unable to get microservices")
+	}
+
+	current := make(map[string]*Microservice)
+	names := make(map[string]int64)
+	for i := range rows {
+		current[rows[i].Name] = &rows[i]
+		names[rows[i].Name] = rows[i].ID
+	}
+
+	seen := make(map[string]bool)
+	for i, definition := range bundle.Microservices {
+
+		err = duplicate(seen, definition.Name, MICROSERVICES_SECTION, i)
+		if err != nil {
+			return err
+		}
+
+		var spec MicroserviceSpec
+		if definition.Spec != nil {
+			spec = *definition.Spec
+		}
+
+		row, exists := current[definition.Name]
+		switch {
+		case !exists:
+
+			result, err := in.tx.Exec("INSERT INTO microservice_definitions (name, description, spec) VALUES (?, ?, ?)", definition.Name, definition.Description, spec)
+			if err != nil {
+				return entryError(MICROSERVICES_SECTION, i, err)
+			}
+
+			names[definition.Name], err = result.LastInsertId()
+			if err != nil {
+				return in.fail(err, "id not found")
+			}
+
+			count.Added++
+
+		case row.Description == definition.Description && sameSpec(row.Spec, spec):
+			count.Unchanged++
+
+		default:
+
+			_, err = in.tx.Exec("UPDATE microservice_definitions SET description = ?, spec = ?, "+VERSION_BUMP+" WHERE id = ?", definition.Description, spec, row.ID)
+			if err != nil {
+				return entryError(MICROSERVICES_SECTION, i, err)
+			}
+
+			count.Updated++
+		}
+	}
+
+	in.existing("microservice_definitions", names, seen)
+	count.Removed = len(in.removed["microservice_definitions"])
+
+	return nil
+}
+
+//specs are stored as JSON, so they're the same if they store the same
+func sameSpec(a, b MicroserviceSpec) bool {
+
+	first, err := a.Value()
+	if err != nil {
+		return false
+	}
+
+	second, err := b.Value()
+	if err != nil {
+		return false
+	}
+
+	return first == second
+}
+
+//the class, designation and definition an entry of a mapping section names
+func (in *importer) key(section string, index int, class, designation, definitionTable, definitionField, definition string) (mappingKey, error) {
+
+	var key mappingKey
+	var err error
+
+	key.class, err = in.id("class_definitions", class, section, index, "class")
+	if err != nil {
+		return key, err
+	}
+
+	key.designation, err = in.id("designation_definitions", designation, section, index, "designation")
+	if err != nil {
+		return key, err
+	}
+
+	key.definition, err = in.id(definitionTable, definition, section, index, definitionField)
+	return key, err
+}
+
+func (in *importer) variableMappings(bundle *Bundle) error {
+
+	count := in.result.Changes[VARIABLE_MAPPINGS_SECTION]
+
+	var rows []DBVariable
+	err := in.tx.Select(&rows, "SELECT "+VARIABLE_MAPPING_COLUMNS+" FROM variable_mappings WHERE deletion_id IS NULL")
+	if err != nil {
+		return in.fail(err, "unable to get variable mappings")
+	}
+
+	current := make(map[mappingKey]DBVariable)
+	for _, row := range rows {
+		current[mappingKey{row.ClassID, row.DesigID, row.VarID}] = row
+	}
+
+	seen := make(map[mappingKey]bool)
+	for i, mapping := range bundle.VariableMappings {
+
+		key, err := in.key(VARIABLE_MAPPINGS_SECTION, i, mapping.Class, mapping.Designation, "variable_definitions", "variable", mapping.Variable)
+		if err != nil {
+			return err
+		}
+
+		if seen[key] {
+			msg := fmt.Sprintf("%s: %s already has a value in %s/%s", entry(VARIABLE_MAPPINGS_SECTION, i), mapping.Variable, mapping.Class, mapping.Designation)
+			return apierrors.BadRequest(entry(VARIABLE_MAPPINGS_SECTION, i), msg)
+		}
+		seen[key] = true
+
+		row, exists := current[key]
+		variable := in.all[key.definition]
+
+		if variable.Secret && mapping.Value == logging.REDACTED {
+			if exists {
+				count.Unchanged++
+			} else {
+				in.result.Skipped = append(in.result.Skipped, fmt.Sprintf("%s: redacted value of %s", entry(VARIABLE_MAPPINGS_SECTION, i), variable.Name))
+			}
+			continue
+		}
+
+		err = ValidateVariableValue(variable, mapping.Value)
+		if err != nil {
+			return entryError(VARIABLE_MAPPINGS_SECTION, i, err)
+		}
+
+		switch {
+		case !exists:
+
+			_, err = in.tx.Exec("INSERT INTO variable_mappings (variable_id, designation_id, class_id, value) VALUES (?, ?, ?, ?)",
+				key.definition, key.designation, key.class, mapping.Value)
+			if err != nil {
+				return entryError(VARIABLE_MAPPINGS_SECTION, i, err)
+			}
+
+			count.Added++
+
+		case row.Value == mapping.Value:
+			count.Unchanged++
+
+		default:
+
+			_, err = in.tx.Exec("UPDATE variable_mappings SET value = ?, "+VERSION_BUMP+" WHERE id = ?", mapping.Value, row.ID)
+			if err != nil {
+				return entryError(VARIABLE_MAPPINGS_SECTION, i, err)
+			}
+
+			count.Updated++
+		}
+	}
+
+	if in.mode != REPLACE_IMPORT {
+		return nil
+	}
+
+	for key, row := range current {
+		if !seen[key] {
+			in.removed["variable_mappings"] = append(in.removed["variable_mappings"], row.ID)
+			count.Removed++
+		}
+	}
+
+	return nil
+}
+
+//a class/designation can map a microservice more than once, so the bundle's mappings replace all of them
+//existing mappings are reused where they can be, so unchanged ones keep their IDs
+func (in *importer) microserviceMappings(bundle *Bundle) error {
+
+	count := in.result.Changes[MICROSERVICE_MAPPINGS_SECTION]
+
+	var rows []DBMicroservice
+	err := in.tx.Select(&rows, "SELECT "+MICROSERVICE_MAPPING_COLUMNS+" FROM microservice_mappings WHERE deletion_id IS NULL ORDER BY id")
+	if err != nil {
+		return in.fail(err, "unable to get microservice mappings")
+	}
+
+	current := make(map[mappingKey][]DBMicroservice)
+	for _, row := range rows {
+		key := mappingKey{row.ClassID, row.DesigID, row.MicroID}
+		current[key] = append(current[key], row)
+	}
+
+	var keys []mappingKey
+	wanted := make(map[mappingKey][]int) //indexes into bundle.MicroserviceMappings
+	for i, mapping := range bundle.MicroserviceMappings {
+
+		key, err := in.key(MICROSERVICE_MAPPINGS_SECTION, i, mapping.Class, mapping.Designation, "microservice_definitions", "microservice", mapping.Microservice)
+		if err != nil {
+			return err
+		}
+
+		if _, ok := wanted[key]; !ok {
+			keys = append(keys, key)
+		}
+		wanted[key] = append(wanted[key], i)
+	}
+
+	for _, key := range keys {
+
+		existing := current[key]
+		used := make([]bool, len(existing))
+		var unmatched []int
+
+		//first the ones that haven't changed
+		for _, i := range wanted[key] {
+
+			mapping := bundle.MicroserviceMappings[i]
+			matched := false
+
+			for j, row := range existing {
+				if !used[j] && row.YAML == mapping.YAML && sameSpec(row.Overrides, overrides(mapping)) {
+					used[j] = true
+					matched = true
+					count.Unchanged++
+					break
+				}
+			}
+
+			if !matched {
+				unmatched = append(unmatched, i)
+			}
+		}
+
+		//then edits of whatever's left over, and adds once that runs out
+		for _, i := range unmatched {
+
+			mapping := bundle.MicroserviceMappings[i]
+
+			j := 0
+			for j < len(existing) && used[j] {
+				j++
+			}
+
+			if j < len(existing) {
+
+				used[j] = true
+
+				_, err = in.tx.Exec("UPDATE microservice_mappings SET yaml = ?, overrides = ?, "+VERSION_BUMP+" WHERE id = ?", mapping.YAML, overrides(mapping), existing[j].ID)
+				if err != nil {
+					return entryError(MICROSERVICE_MAPPINGS_SECTION, i, err)
+				}
+
+				count.Updated++
+				continue
+			}
+
+			_, err = in.tx.Exec("INSERT INTO microservice_mappings (microservice_id, designation_id, class_id, yaml, overrides) VALUES (?, ?, ?, ?, ?)",
+				key.definition, key.designation, key.class, mapping.YAML, overrides(mapping))
+			if err != nil {
+				return entryError(MICROSERVICE_MAPPINGS_SECTION, i, err)
+			}
+
+			count.Added++
+		}
+
+		for j, row := range existing {
+			if !used[j] {
+				in.removed["microservice_mappings"] = append(in.removed["microservice_mappings"], row.ID)
+				count.Removed++
+			}
+		}
+	}
+
+	if in.mode != REPLACE_IMPORT {
+		return nil
+	}
+
+	for key, existing := range current {
+
+		if _, ok := wanted[key]; ok {
+			continue
+		}
+
+		for _, row := range existing {
+			in.removed["microservice_mappings"] = append(in.removed["microservice_mappings"], row.ID)
+			count.Removed++
+		}
+	}
+
+	return nil
+}
+
+func overrides(mapping BundleMicroserviceMapping) MicroserviceSpec {
+
+	if mapping.Overrides == nil {
+		return MicroserviceSpec{}
+	}
+
+	return *mapping.Overrides
+}
+
+func (in *importer) imageTags(bundle *Bundle) error {
+
+	count := in.result.Changes[IMAGE_TAGS_SECTION]
+
+	var rows []ImageTag
+	err := in.tx.Select(&rows, `SELECT t.* FROM microservice_tags t
+		JOIN microservice_definitions x ON x.id = t.microservice_id
+		JOIN designation_definitions d ON d.id = t.designation_id
+		WHERE x.deletion_id IS NULL AND d.deletion_id IS NULL`)
+	if err != nil {
+		return in.fail(err, "unable to get image tags")
+	}
+
+	type tagKey struct{ microservice, designation int64 }
+
+	current := make(map[tagKey]ImageTag)
+	for _, row := range rows {
+		current[tagKey{row.MicroserviceID, row.DesignationID}] = row
+	}
+
+	seen := make(map[tagKey]bool)
+	for i, tag := range bundle.ImageTags {
+
+		var key tagKey
+
+		key.microservice, err = in.id("microservice_definitions", tag.Microservice, IMAGE_TAGS_SECTION, i, "microservice")
+		if err != nil {
+			return err
+		}
+
+		key.designation, err = in.id("designation_definitions", tag.Designation, IMAGE_TAGS_SECTION, i, "designation")
+		if err != nil {
+			return err
+		}
+
+		if seen[key] {
+			msg := fmt.Sprintf("%s: %s already has a tag in %s", entry(IMAGE_TAGS_SECTION, i), tag.Microservice, tag.Designation)
+			return apierrors.BadRequest(entry(IMAGE_TAGS_SECTION, i), msg)
+		}
+		seen[key] = true
+
+		if !imageTagPattern.MatchString(tag.Tag) {
+			msg := fmt.Sprintf("%s: invalid tag '%s'", entry(IMAGE_TAGS_SECTION, i), tag.Tag)
+			return apierrors.Invalid(entry(IMAGE_TAGS_SECTION, i)+".tag", msg)
+		}
+
+		row, exists := current[key]
+		if exists && row.Tag == tag.Tag {
+			count.Unchanged++
+			continue
+		}
+
+		_, err = in.tx.Exec(`INSERT INTO microservice_tags (microservice_id, designation_id, tag) VALUES (?, ?, ?)
+			ON DUPLICATE KEY UPDATE tag = VALUES(tag)`, key.microservice, key.designation, tag.Tag)
+		if err != nil {
+			return entryError(IMAGE_TAGS_SECTION, i, err)
+		}
+
+		if exists {
+			count.Updated++
+		} else {
+			count.Added++
+		}
+	}
+
+	if in.mode != REPLACE_IMPORT {
+		return nil
+	}
+
+	for key, row := range current {
+
+		if seen[key] {
+			continue
+		}
+
+		err = in.removeForGood("microservice_tags", fmt.Sprintf(imageTagDependents, "id"), row.ID)
+		if err != nil {
+			return err
+		}
+
+		count.Removed++
+	}
+
+	return nil
+}
+
+func (in *importer) rooms(bundle *Bundle) error {
+
+	count := in.result.Changes[ROOMS_SECTION]
+
+	var rows []struct {
+		ID              int64  `db:"id"`
+		DesignationID   int64  `db:"designation_id"`
+		Name            string `db:"name"`
+		UIConfiguration string `db:"ui_configuation"`
+	}
+	err := in.tx.Select(&rows, `SELECT r.id, r.designation_id, r.name, r.ui_configuation FROM rooms r
+		JOIN designation_definitions d ON d.id = r.designation_id WHERE d.deletion_id IS NULL`)
+	if err != nil {
+		return in.fail(err, "unable to get rooms")
+	}
+
+	type roomKey struct {
+		designation int64
+		name        string
+	}
+
+	current := make(map[roomKey]int)
+	for i, row := range rows {
+		current[roomKey{row.DesignationID, row.Name}] = i
+	}
+
+	seen := make(map[roomKey]bool)
+	for i, room := range bundle.Rooms {
+
+		designationID, err := in.id("designation_definitions", room.Designation, ROOMS_SECTION, i, "designation")
+		if err != nil {
+			return err
+		}
+
+		if len(room.Name) == 0 {
+			return apierrors.Invalid(entry(ROOMS_SECTION, i)+".name", fmt.Sprintf("%s: invalid room name", entry(ROOMS_SECTION, i)))
+		}
+
+		key := roomKey{designationID, room.Name}
+		if seen[key] {
+			msg := fmt.Sprintf("%s: %s is in %s twice", entry(ROOMS_SECTION, i), room.Name, room.Designation)
+			return apierrors.BadRequest(entry(ROOMS_SECTION, i), msg)
+		}
+		seen[key] = true
+
+		index, exists := current[key]
+		switch {
+		case !exists:
+
+			_, err = in.tx.Exec("INSERT INTO rooms (designation_id, name, ui_configuation) VALUES (?, ?, ?)", designationID, room.Name, room.UIConfiguration)
+			if err != nil {
+				return entryError(ROOMS_SECTION, i, err)
+			}
+
+			count.Added++
+
+		case rows[index].UIConfiguration == room.UIConfiguration:
+			count.Unchanged++
+
+		default:
+
+			_, err = in.tx.Exec("UPDATE rooms SET ui_configuation = ? WHERE id = ?", room.UIConfiguration, rows[index].ID)
+			if err != nil {
+				return entryError(ROOMS_SECTION, i, err)
+			}
+
+			count.Updated++
+		}
+	}
+
+	if in.mode != REPLACE_IMPORT {
+		return nil
+	}
+
+	for key, index := range current {
+
+		if seen[key] {
+			continue
+		}
+
+		err = in.removeForGood("rooms", `SELECT r.id, CONCAT(r.name, ' in ', d.name) AS summary FROM rooms r
+			JOIN designation_definitions d ON d.id = r.designation_id WHERE r.id = ?`, rows[index].ID)
+		if err != nil {
+			return err
+		}
+
+		count.Removed++
+	}
+
+	return nil
+}
+
+//deletes a row that has no trash, and lists it in the result since restoring the import's deletion won't bring it back
+//summary finds the row with args and returns its id and summary, like the impact queries
+func (in *importer) removeForGood(table, summary string, args ...interface{}) error {
+
+	var removed DependentItem
+	err := sqlx.Get(in.tx, &removed, summary, args...)
+	if err != nil {
+		return in.fail(err, "unable to find what's being removed from %s", table)
+	}
+
+	_, err = in.tx.Exec(fmt.Sprintf("DELETE FROM %s WHERE id = ?", table), removed.ID)
+	if err != nil {
+		return in.fail(err, "unable to remove %s from %s", removed.Summary, table)
+	}
+
+	in.result.Removed = append(in.result.Removed, fmt.Sprintf("%s: %s", table, removed.Summary))
+	return nil
+}
+
+//moves everything a replace left out into the trash under one deletion
+func (in *importer) trash(bundle *Bundle) error {
+
+	total := 0
+	for _, ids := range in.removed {
+		total += len(ids)
+	}
+
+	if total == 0 {
+		return nil
+	}
+
+	result, err := in.tx.Exec("INSERT INTO deletions (table_name, row_id, name) VALUES ('import', 0, ?)",
+		fmt.Sprintf("left out of an import on %s", time.Now().UTC().Format(time.RFC3339)))
+	if err != nil {
+		return in.fail(err, "unable to record deletion")
+	}
+
+	deletionID, err := result.LastInsertId()
+	if err != nil {
+		return in.fail(err, "last inserted ID not found")
+	}
+
+	for _, table := range trashed {
+
+		ids := in.removed[table.table]
+		if len(ids) == 0 {
+			continue
+		}
+
+		command, args, err := sqlx.In(fmt.Sprintf("UPDATE %s SET deletion_id = ?, alive = NULL WHERE id IN (?)", table.table), deletionID, ids)
+		if err != nil {
+			return in.fail(err, "unable to build delete of %s", table.table)
+		}
+
+		_, err = in.tx.Exec(command, args...)
+		if err != nil {
+			return in.fail(err, "unable to delete from %s", table.table)
+		}
+	}
+
+	deletion, err := getDeletion(in.ctx, in.tx, deletionID, false)
+	if err != nil {
+		return err
+	}
+
+	in.result.Deletion = &deletion
+	return nil
+}
+
+//renders every microservice mapping in the bundle the way serving will, the same check a mapping gets when it's written through the API
+//it runs once everything else is in, so templates see the variables the bundle maps - nothing's committed unless they all pass
+func (in *importer) checkMicroserviceMappings(bundle *Bundle) error {
+
+	microservices := make(map[int64]Microservice)
+	contexts := make(map[[2]int64]TemplateContext) //class, designation
+
+	for i, mapping := range bundle.MicroserviceMappings {
+
+		key, err := in.key(MICROSERVICE_MAPPINGS_SECTION, i, mapping.Class, mapping.Designation, "microservice_definitions", "microservice", mapping.Microservice)
+		if err != nil {
+			return err
+		}
+
+		microservice, ok := microservices[key.definition]
+		if !ok {
+			err = in.tx.Get(&microservice, "SELECT "+MICROSERVICE_COLUMNS+" FROM microservice_definitions WHERE id = ?", key.definition)
+			if err != nil {
+				return in.fail(err, "unable to get microservice %s", mapping.Microservice)
+			}
+			microservices[key.definition] = microservice
+		}
+
+		scope := [2]int64{key.class, key.designation}
+		templateContext, ok := contexts[scope]
+		if !ok && IsTemplate(mapping.YAML) {
+			templateContext, err = loadTemplateContext(in.tx, key.class, key.designation)
+			if err != nil {
+				return in.fail(err, "unable to check templates for %s/%s", mapping.Class, mapping.Designation)
+			}
+			contexts[scope] = templateContext
+		}
+
+		err = CheckMicroserviceMapping(microservice, mapping.YAML, overrides(mapping), templateContext)
+		if err != nil {
+			return entryError(MICROSERVICE_MAPPINGS_SECTION, i, err)
+		}
+	}
+
+	return nil
+}
+
+//a variable whose type or validation changed has to fit every value it still has, not just the ones in the bundle
+func (in *importer) checkValues(bundle *Bundle) error {
+
+	for variableID := range in.checked {
+
+		var values []string
+		err := in.tx.Select(&values, "SELECT value FROM variable_mappings WHERE variable_id = ? AND deletion_id IS NULL", variableID)
+		if err != nil {
+			return in.fail(err, "unable to get values of variable %d", variableID)
+		}
+
+		for _, value := range values {
+
+			err = ValidateVariableValue(in.all[variableID], value)
+			if err != nil {
+				msg := fmt.Sprintf("%s no longer fits a value it's mapped to: %s", in.all[variableID].Name, err.Error())
+				return apierrors.Invalid(VARIABLES_SECTION, msg)
+			}
+		}
+	}
+
+	return nil
+}
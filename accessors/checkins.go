@@ -0,0 +1,127 @@
+package accessors
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/byuoitav/pi-designation-microservice/apierrors"
+	db "github.com/byuoitav/pi-designation-microservice/database"
+)
+
+//what a pi reports about itself after applying its configuration
+type Checkin struct {
+	ID            int64     `json:"id"`
+	Hostname      string    `json:"hostname"`
+	ClassID       int64     `json:"class"`
+	DesignationID int64     `json:"designation"`
+	Room          string    `json:"room"`
+	ConfigHash    string    `json:"config-hash"` //see fingerprint.Configuration
+	Containers    []string  `json:"containers"`  //names of running containers
+	CheckedInAt   time.Time `json:"checked-in-at"`
+}
+
+//row in device_checkins table
+type DBCheckin struct {
+	ID            int64     `db:"id"`
+	Hostname      string    `db:"hostname"`
+	ClassID       int64     `db:"class_id"`
+	DesignationID int64     `db:"designation_id"`
+	Room          string    `db:"room"`
+	ConfigHash    string    `db:"config_hash"`
+	Containers    string    `db:"containers"` //JSON array
+	CheckedInAt   time.Time `db:"checked_in_at"`
+}
+
+//each pi keeps exactly one row - the latest check-in replaces the last one
+func RecordCheckin(ctx context.Context, checkin *Checkin) error {
+
+	logger.Debugf(ctx, "recording check-in from %s...", checkin.Hostname)
+
+	if len(checkin.Hostname) == 0 {
+		msg := "invalid hostname"
+		logger.Errorf(ctx, "%s", msg)
+		return apierrors.Invalid("hostname", msg)
+	}
+
+	containers, err := json.Marshal(checkin.Containers)
+	if err != nil {
+		msg := fmt.Sprintf("unable to encode containers: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return apierrors.Wrap(err, msg)
+	}
+
+	command := `INSERT INTO device_checkins (hostname, class_id, designation_id, room, config_hash, containers, checked_in_at)
+		VALUES (?, ?, ?, ?, ?, ?, CURRENT_TIMESTAMP)
+		ON DUPLICATE KEY UPDATE class_id = VALUES(class_id), designation_id = VALUES(designation_id), room = VALUES(room),
+		config_hash = VALUES(config_hash), containers = VALUES(containers), checked_in_at = CURRENT_TIMESTAMP`
+
+	_, err = db.DB().Exec(command, checkin.Hostname, checkin.ClassID, checkin.DesignationID, checkin.Room, checkin.ConfigHash, string(containers))
+	if err != nil {
+		msg := fmt.Sprintf("check-in not recorded: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return apierrors.Wrap(err, msg)
+	}
+
+	return nil
+}
+
+//zero values and empty strings match everything
+func GetCheckins(ctx context.Context, classID, designationID int64, room string) ([]Checkin, error) {
+
+	logger.Debugf(ctx, "getting check-ins for class %d, designation %d, room '%s'", classID, designationID, room)
+
+	command := "SELECT * FROM device_checkins WHERE (? = 0 OR class_id = ?) AND (? = 0 OR designation_id = ?) AND (? = '' OR room = ?) ORDER BY hostname"
+
+	var rows []DBCheckin
+	err := db.DB().Select(&rows, command, classID, classID, designationID, designationID, room, room)
+	if err != nil {
+		msg := fmt.Sprintf("check-ins not found: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return []Checkin{}, apierrors.Wrap(err, msg)
+	}
+
+	output := []Checkin{}
+	for _, row := range rows {
+
+		checkin := Checkin{
+			ID:            row.ID,
+			Hostname:      row.Hostname,
+			ClassID:       row.ClassID,
+			DesignationID: row.DesignationID,
+			Room:          row.Room,
+			ConfigHash:    row.ConfigHash,
+			CheckedInAt:   row.CheckedInAt,
+		}
+
+		err = json.Unmarshal([]byte(row.Containers), &checkin.Containers)
+		if err != nil {
+			logger.Warnf(ctx, "unreadable containers for %s: %s", row.Hostname, err.Error())
+		}
+
+		output = append(output, checkin)
+	}
+
+	return output, nil
+}
+
+//names of the microservices mapped to a class/designation
+func GetMicroserviceNamesByClassAndDesignation(ctx context.Context, classID, designationID int64) ([]string, error) {
+
+	logger.Debugf(ctx, "getting microservice names for class %d, designation %d", classID, designationID)
+
+	command := `SELECT DISTINCT microservice_definitions.name FROM microservice_mappings
+		JOIN microservice_definitions ON microservice_definitions.id = microservice_mappings.microservice_id
+		WHERE microservice_mappings.class_id = ? AND microservice_mappings.designation_id = ? AND microservice_mappings.deletion_id IS NULL`
+
+	var names []string
+	err := db.DB().Select(&names, command, classID, designationID)
+	if err != nil {
+		msg := fmt.Sprintf("microservices not found: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return []string{}, apierrors.Wrap(err, msg)
+	}
+
+	return names, nil
+}
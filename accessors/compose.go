@@ -0,0 +1,98 @@
+package accessors
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+//one entry under services: in a docker-compose file
+type composeService struct {
+	Image       string            `yaml:"image"`
+	Ports       []string          `yaml:"ports,omitempty"`
+	Volumes     []string          `yaml:"volumes,omitempty"`
+	Restart     string            `yaml:"restart,omitempty"`
+	Environment map[string]string `yaml:"environment,omitempty"`
+	Devices     []string          `yaml:"devices,omitempty"`
+	NetworkMode string            `yaml:"network_mode,omitempty"`
+}
+
+//matches the image line of a hand-written snippet
+var imageLine = regexp.MustCompile(`(?m)^(\s*image:\s*)(["']?)([^\s"']+)(["']?)(\s*)$`)
+
+//the snippet a mapping contributes to the docker-compose file
+//hand-written YAML wins - otherwise it's generated from the definition's spec and the mapping's overrides
+//pinnedTag is the designation's tag for the microservice - it beats the definition's tag but not the mapping's
+func MicroserviceYAML(mapping DBMicroservice, microservice Microservice, pinnedTag string) (string, error) {
+
+	if len(strings.TrimSpace(mapping.YAML)) > 0 {
+		if len(pinnedTag) == 0 {
+			return mapping.YAML, nil
+		}
+
+		return imageLine.ReplaceAllStringFunc(mapping.YAML, func(line string) string {
+			parts := imageLine.FindStringSubmatch(line)
+			return parts[1] + parts[2] + WithTag(parts[3], pinnedTag) + parts[4] + parts[5]
+		}), nil
+	}
+
+	base := microservice.Spec
+	if len(pinnedTag) > 0 {
+		base.Tag = pinnedTag
+	}
+
+	spec := MergeSpecs(base, mapping.Overrides)
+	if len(spec.Image) == 0 {
+		return "", errors.New(fmt.Sprintf("%s has no YAML and no image in its spec", microservice.Name))
+	}
+
+	service := composeService{
+		Image:       spec.Image,
+		Ports:       spec.Ports,
+		Volumes:     spec.Volumes,
+		Restart:     spec.Restart,
+		Environment: spec.Environment,
+		Devices:     spec.Devices,
+		NetworkMode: spec.NetworkMode,
+	}
+
+	if len(spec.Tag) > 0 {
+		service.Image = WithTag(spec.Image, spec.Tag)
+	}
+
+	out, err := yaml.Marshal(map[string]composeService{microservice.Name: service})
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("unable to generate YAML for %s: %s", microservice.Name, err.Error()))
+	}
+
+	//indented to sit under services: like the hand-written snippets
+	lines := strings.Split(strings.TrimRight(string(out), "\n"), "\n")
+	for i := range lines {
+		lines[i] = "  " + lines[i]
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
+
+//replaces whatever tag or digest an image reference has
+//a tag that looks like a digest (sha256:...) is pinned with @ instead of :
+func WithTag(image, tag string) string {
+
+	if i := strings.Index(image, "@"); i >= 0 {
+		image = image[:i]
+	}
+
+	//a colon before the last slash is a registry port, not a tag
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+
+	if strings.HasPrefix(tag, "sha256:") {
+		return image + "@" + tag
+	}
+
+	return image + ":" + tag
+}
@@ -1,145 +1,199 @@
 package accessors
 
 import (
-	"errors"
+	"context"
 	"fmt"
-	"log"
 
+	"github.com/byuoitav/pi-designation-microservice/apierrors"
 	db "github.com/byuoitav/pi-designation-microservice/database"
-	"github.com/fatih/color"
 )
 
-func AddDefinition(table string, def *Definition) error {
+//everything in a class or designation definition
+const DEFINITION_COLUMNS = "id, name, description, version"
 
-	log.Printf("[accessors] adding definition to %s...", table)
+func AddDefinition(ctx context.Context, table string, def *Definition) error {
+
+	logger.Debugf(ctx, "adding definition to %s...", table)
 
 	if len(def.Name) == 0 {
 		msg := "invalid definition name"
-		log.Printf("%s", color.HiRedString("[accessors] %s", msg))
-		return errors.New(msg)
+		logger.Errorf(ctx, "%s", msg)
+		return apierrors.Invalid("name", msg)
 	}
 
-	log.Printf("[accessors] adding new definition %s to table %s", def.Name, table)
+	logger.Debugf(ctx, "adding new definition %s to table %s", def.Name, table)
 
 	insert := fmt.Sprintf("INSERT INTO %s (name, description) VALUES (?, ?)", table)
 	result, err := db.DB().Exec(insert, def.Name, def.Description)
 	if err != nil {
 		msg := fmt.Sprintf("definition not added: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[accessors] %s", msg))
-		return errors.New(msg)
+		logger.Errorf(ctx, "%s", msg)
+		return apierrors.Wrap(err, msg)
 	}
 
 	def.ID, err = result.LastInsertId()
 	if err != nil {
 		msg := fmt.Sprintf("id not found: %s", err.Error())
-		log.Printf("[accessors] %s", color.HiRedString("%s", msg))
-		return errors.New(msg)
+		logger.Errorf(ctx, "%s", msg)
+		return apierrors.Wrap(err, msg)
 	}
 
+	//new rows start at version 1
+	def.Version = 1
+
 	return nil
 }
 
-func EditDefinition(table string, def *Definition) error {
+//def.Version is the version being edited - zero edits whatever's there
+//on success it's the version the edit created
+func EditDefinition(ctx context.Context, table string, def *Definition) error {
 
-	log.Printf("[accessors] updating definition in %s...", table)
+	logger.Debugf(ctx, "updating definition in %s...", table)
 
 	//validate input
 	if len(def.Name) == 0 {
 		msg := "invalid definition name"
-		log.Printf("%s", color.HiRedString("[handlers] %s", msg))
-		return errors.New(msg)
+		logger.Errorf(ctx, "%s", msg)
+		return apierrors.Invalid("name", msg)
 	}
 
 	if len(def.Description) == 0 {
 		msg := "invalid description"
-		log.Printf("%s", color.HiRedString("[handlers] %s", msg))
-		return errors.New(msg)
+		logger.Errorf(ctx, "%s", msg)
+		return apierrors.Invalid("description", msg)
 	}
 
 	//format SQL
-	command := fmt.Sprintf("UPDATE %s SET name = ?, description = ? WHERE id = ?", table)
+	command := fmt.Sprintf("UPDATE %s SET name = ?, description = ?, %s WHERE id = ? AND deletion_id IS NULL AND %s", table, VERSION_BUMP, VERSION_CLAUSE)
 
 	//DO IT!!
-	result, err := db.DB().Exec(command, def.Name, def.Description, def.ID)
+	result, err := db.DB().Exec(command, def.Name, def.Description, def.ID, def.Version, def.Version)
 	if err != nil {
 		msg := fmt.Sprintf("unable to update designation: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[accessors] %s", msg))
-		return errors.New(msg)
+		logger.Errorf(ctx, "%s", msg)
+		return apierrors.Wrap(err, msg)
 	}
 
 	//make sure it acutally worked
-	numRows, err := result.RowsAffected()
-	if err != nil {
-		msg := fmt.Sprintf("number of rows not found: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[accessors] %s", msg))
-		return errors.New(msg)
-	}
-
-	if numRows < 1 {
-		msg := "invalid edit"
-		log.Printf("%s", color.HiRedString("[accessors] %s", msg))
-		return errors.New(msg)
-	}
-
-	return nil
+	def.Version, err = checkEdit(ctx, result, table, def.ID, def.Version)
+	return err
 }
 
-func GetDefinitionById(table string, id int64, def *Definition) error {
+func GetDefinitionById(ctx context.Context, table string, id int64, def *Definition) error {
 
-	log.Printf("[accessors] fetching definition from %s with id %d", table, id)
+	logger.Debugf(ctx, "fetching definition from %s with id %d", table, id)
 
 	//format SQL
-	command := fmt.Sprintf("SELECT * FROM %s WHERE id = ?", table)
+	command := fmt.Sprintf("SELECT %s FROM %s WHERE id = ? AND deletion_id IS NULL", DEFINITION_COLUMNS, table)
 
 	//check SQL
-	log.Printf("SQL: %s", command)
+	logger.Debugf(ctx, "SQL: %s", command)
 
 	//fill struct
 	err := db.DB().Get(def, command, id)
 	if err != nil {
 		msg := fmt.Sprintf("definition not found: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[accessors] %s", msg))
-		return errors.New(msg)
+		logger.Errorf(ctx, "%s", msg)
+		return apierrors.Wrap(err, msg)
 	}
 
 	return nil
 }
 
-func GetAllDefinitions(table string, defs *[]Definition) error {
+//returns the cursor of the next page, or an empty string on the last one
+func GetAllDefinitions(ctx context.Context, table string, query ListQuery, defs *[]Definition) (string, error) {
 
-	log.Printf("[accessors] getting all definitions from table: %s", table)
+	logger.Debugf(ctx, "getting all definitions from table: %s", table)
 
-	cmd := fmt.Sprintf("SELECT * FROM %s", table)
+	listing := definitionListing(table)
+	cmd, args, err := listing.build(qualify("t", DEFINITION_COLUMNS), query)
+	if err != nil {
+		return "", err
+	}
+
+	var rows []struct {
+		Definition
+		SortKey string `db:"sort_key"`
+	}
 
-	err := db.DB().Select(defs, cmd)
+	err = db.DB().Select(&rows, cmd, args...)
 	if err != nil {
 		msg := fmt.Sprintf("definitions not found: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[accessors] %s", msg))
-		return errors.New(msg)
+		logger.Errorf(ctx, "%s", msg)
+		return "", apierrors.Wrap(err, msg)
 	}
 
-	return nil
+	var next string
+	if query.more(len(rows)) {
+		rows = rows[:query.Limit]
+		last := rows[len(rows)-1]
+		next = query.next(last.SortKey, last.ID)
+	}
+
+	for _, row := range rows {
+		*defs = append(*defs, row.Definition)
+	}
+
+	return next, nil
 }
 
-func DeleteDefinition(table string, id *int64) error {
+//refuses to delete a definition that anything still refers to unless force is set - then everything that refers to it goes too
+//moves the definition and its mappings to the trash - see RestoreDeletion
+func DeleteDefinition(ctx context.Context, table string, id *int64, force bool) (Deletion, error) {
+
+	logger.Debugf(ctx, "deleting definition entry id %d from table %s", *id, table)
+
+	tx, err := db.DB().Beginx()
+	if err != nil {
+		msg := fmt.Sprintf("unable to start transaction: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return Deletion{}, apierrors.Wrap(err, msg)
+	}
+	defer tx.Rollback()
+
+	impact, err := getImpact(ctx, tx, table, *id, true)
+	if err != nil {
+		return Deletion{}, err
+	}
 
-	log.Printf("[accessors] deleting definition entry id %d from table %s", id, table)
+	if impact.Total > 0 && !force {
+		msg := fmt.Sprintf("%s still has dependents (%d in total) - see details, or delete with force=true to remove them too", impact.Name, impact.Total)
+		logger.Warnf(ctx, "%s", msg)
+		return Deletion{}, apierrors.InUse(msg, impact)
+	}
 
-	command := fmt.Sprintf("DELETE FROM %s WHERE id = ?", table)
+	if impact.Total > 0 {
+		logger.Warnf(ctx, "force deleting %s from %s along with %d dependent rows", impact.Name, table, impact.Total)
+	}
 
-	result, err := db.DB().Exec(command, id)
+	deletionID, err := trash(ctx, tx, table, *id, impact.Name)
 	if err != nil {
-		return err
+		return Deletion{}, err
+	}
+
+	for _, mapping := range cascades[table] {
+
+		command := fmt.Sprintf("UPDATE %s SET deletion_id = ?, alive = NULL WHERE %s = ? AND deletion_id IS NULL", mapping.table, mapping.column)
+
+		_, err = tx.Exec(command, deletionID, *id)
+		if err != nil {
+			msg := fmt.Sprintf("unable to delete mappings in %s: %s", mapping.table, err.Error())
+			logger.Errorf(ctx, "%s", msg)
+			return Deletion{}, apierrors.Wrap(err, msg)
+		}
 	}
 
-	rowsAffected, err := result.RowsAffected()
+	deletion, err := getDeletion(ctx, tx, deletionID, false)
 	if err != nil {
-		return err
+		return deletion, err
 	}
 
-	if rowsAffected < 1 {
-		return errors.New("invalid delete")
+	err = tx.Commit()
+	if err != nil {
+		msg := fmt.Sprintf("unable to commit delete: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return deletion, apierrors.Wrap(err, msg)
 	}
 
-	return nil
+	return deletion, nil
 }
@@ -0,0 +1,178 @@
+package accessors
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/byuoitav/pi-designation-microservice/apierrors"
+	db "github.com/byuoitav/pi-designation-microservice/database"
+)
+
+//row in configuration_fetches table - one per configuration served
+type Fetch struct {
+	ID            int64     `json:"id" db:"id"`
+	Client        string    `json:"client" db:"client"`   //hostname the pi reported, or its address if it didn't
+	Address       string    `json:"address" db:"address"` //where the request came from
+	ClassID       int64     `json:"class" db:"class_id"`
+	DesignationID int64     `json:"designation" db:"designation_id"`
+	Configuration string    `json:"configuration" db:"configuration"` //variables or docker-compose
+	ETag          string    `json:"etag" db:"etag"`
+	Stale         bool      `json:"stale" db:"stale"` //served from the last-known-good copy
+	FetchedAt     time.Time `json:"fetched-at" db:"fetched_at"`
+}
+
+//fetches waiting to be written - when a whole fleet reboots at once the rest are dropped rather than piling up on the database
+const FETCH_QUEUE_SIZE = 1000
+
+//most fetches written by a single INSERT
+const FETCH_BATCH_SIZE = 100
+
+//how long fetches are kept before they're purged
+const DEFAULT_FETCH_RETENTION_DAYS = 30
+
+/** lock things down here **/
+var fetchRetentionOnce sync.Once
+
+/** all the good stuff lives here **/
+var fetchQueue = make(chan Fetch, FETCH_QUEUE_SIZE)
+var fetchRetentionDays int
+
+//override with DESIGNATION_FETCH_RETENTION_DAYS
+func FetchRetentionDays() int {
+	fetchRetentionOnce.Do(func() {
+		fetchRetentionDays = DEFAULT_FETCH_RETENTION_DAYS
+
+		days := os.Getenv("DESIGNATION_FETCH_RETENTION_DAYS")
+		if len(days) == 0 {
+			return
+		}
+
+		parsed, err := strconv.Atoi(days)
+		if err != nil || parsed < 1 {
+			logger.Warnf(context.Background(), "invalid DESIGNATION_FETCH_RETENTION_DAYS %s - keeping fetches for %d days", days, DEFAULT_FETCH_RETENTION_DAYS)
+			return
+		}
+
+		fetchRetentionDays = parsed
+	})
+
+	return fetchRetentionDays
+}
+
+//hands a fetch to WriteFetches without waiting on the database - false if the queue was full and it was dropped
+func QueueFetch(fetch Fetch) bool {
+
+	select {
+	case fetchQueue <- fetch:
+		return true
+	default:
+		return false
+	}
+}
+
+//writes queued fetches in batches - never returns
+func WriteFetches() {
+
+	ctx := context.Background()
+
+	for fetch := range fetchQueue {
+
+		batch := []Fetch{fetch}
+
+	drain:
+		for len(batch) < FETCH_BATCH_SIZE {
+			select {
+			case next := <-fetchQueue:
+				batch = append(batch, next)
+			default:
+				break drain
+			}
+		}
+
+		recordFetches(ctx, batch)
+	}
+}
+
+func recordFetches(ctx context.Context, batch []Fetch) error {
+
+	var rows []string
+	var args []interface{}
+	for _, fetch := range batch {
+		rows = append(rows, "(?, ?, ?, ?, ?, ?, ?)")
+		args = append(args, fetch.Client, fetch.Address, fetch.ClassID, fetch.DesignationID, fetch.Configuration, fetch.ETag, fetch.Stale)
+	}
+
+	command := `INSERT INTO configuration_fetches (client, address, class_id, designation_id, configuration, etag, stale)
+		VALUES ` + strings.Join(rows, ", ")
+
+	_, err := db.DB().Exec(command, args...)
+	if err != nil {
+		msg := fmt.Sprintf("%d fetches not recorded: %s", len(batch), err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return apierrors.Wrap(err, msg)
+	}
+
+	return nil
+}
+
+//removes fetches older than FetchRetentionDays and returns how many there were
+//every client's latest fetch is kept however old it is, so a pi that's gone quiet still shows up in GetLastSeen
+func PurgeExpiredFetches(ctx context.Context) (int64, error) {
+
+	//the extra select makes MySQL read the latest fetches before it deletes from the same table
+	command := `DELETE FROM configuration_fetches WHERE fetched_at < NOW() - INTERVAL ? DAY
+		AND id NOT IN (SELECT id FROM (SELECT MAX(id) AS id FROM configuration_fetches GROUP BY client) latest)`
+
+	result, err := db.DB().Exec(command, FetchRetentionDays())
+	if err != nil {
+		msg := fmt.Sprintf("unable to purge fetches: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return 0, apierrors.Wrap(err, msg)
+	}
+
+	return result.RowsAffected()
+}
+
+//the most recent fetch from every client - zero values match everything
+//unseenHours > 0 only returns clients that haven't fetched anything in that many hours
+func GetLastSeen(ctx context.Context, classID, designationID, unseenHours int64) ([]Fetch, error) {
+
+	logger.Debugf(ctx, "getting last fetch per client for class %d, designation %d, unseen for %d hours", classID, designationID, unseenHours)
+
+	command := `SELECT configuration_fetches.* FROM configuration_fetches
+		JOIN (SELECT client, MAX(id) AS id FROM configuration_fetches GROUP BY client) latest ON latest.id = configuration_fetches.id
+		WHERE (? = 0 OR class_id = ?) AND (? = 0 OR designation_id = ?)
+		AND (? = 0 OR fetched_at < NOW() - INTERVAL ? HOUR)
+		ORDER BY fetched_at`
+
+	fetches := []Fetch{}
+	err := db.DB().Select(&fetches, command, classID, classID, designationID, designationID, unseenHours, unseenHours)
+	if err != nil {
+		msg := fmt.Sprintf("fetches not found: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return []Fetch{}, apierrors.Wrap(err, msg)
+	}
+
+	return fetches, nil
+}
+
+//every fetch by a single client, newest first
+func GetFetchesByClient(ctx context.Context, client string, limit int64) ([]Fetch, error) {
+
+	logger.Debugf(ctx, "getting fetches by %s", client)
+
+	fetches := []Fetch{}
+	err := db.DB().Select(&fetches, "SELECT * FROM configuration_fetches WHERE client = ? ORDER BY id DESC LIMIT ?", client, limit)
+	if err != nil {
+		msg := fmt.Sprintf("fetches not found: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return []Fetch{}, apierrors.Wrap(err, msg)
+	}
+
+	return fetches, nil
+}
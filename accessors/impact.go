@@ -0,0 +1,158 @@
+package accessors
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/byuoitav/pi-designation-microservice/apierrors"
+	db "github.com/byuoitav/pi-designation-microservice/database"
+	"github.com/byuoitav/pi-designation-microservice/logging"
+	"github.com/jmoiron/sqlx"
+)
+
+//everything a definition is deleted along with - its mappings go to the trash with it, and the rest is removed once it's purged
+type Impact struct {
+	Table      string      `json:"table"`
+	ID         int64       `json:"id"`
+	Name       string      `json:"name"`
+	Dependents []Dependent `json:"dependents"` //only tables with something in them
+	Total      int         `json:"total"`      //of the rows that block the delete
+}
+
+//the rows of one table that refer to the definition
+type Dependent struct {
+	Table    string          `json:"table"`
+	Rows     []DependentItem `json:"rows"`
+	Blocking bool            `json:"blocking"` //whether these rows keep the definition from being deleted without force
+}
+
+type DependentItem struct {
+	ID      int64  `json:"id" db:"id"`
+	Summary string `json:"summary" db:"summary"`
+}
+
+//a table that refers to definitions - the query takes the definition's ID and returns id and summary
+type dependency struct {
+	table   string
+	command string
+}
+
+//the mapping queries take a whole condition, since they list mappings in the trash too
+var variableMappingDependents = fmt.Sprintf(`SELECT m.id, CONCAT(c.name, '/', d.name, ': ', x.name, ' = ', IF(x.secret, '%s', m.value)) AS summary
+	FROM variable_mappings m
+	JOIN class_definitions c ON c.id = m.class_id
+	JOIN designation_definitions d ON d.id = m.designation_id
+	JOIN variable_definitions x ON x.id = m.variable_id
+	WHERE %%s ORDER BY m.id`, logging.REDACTED)
+
+const microserviceMappingDependents = `SELECT m.id, CONCAT(c.name, '/', d.name, ': ', x.name) AS summary
+	FROM microservice_mappings m
+	JOIN class_definitions c ON c.id = m.class_id
+	JOIN designation_definitions d ON d.id = m.designation_id
+	JOIN microservice_definitions x ON x.id = m.microservice_id
+	WHERE %s ORDER BY m.id`
+
+const requiredVariableDependents = `SELECT r.id, CONCAT(v.name, ' required in ', c.name) AS summary
+	FROM required_variables r
+	JOIN variable_definitions v ON v.id = r.variable_id
+	JOIN class_definitions c ON c.id = r.class_id
+	WHERE r.%s = ? ORDER BY r.id`
+
+const imageTagDependents = `SELECT t.id, CONCAT(x.name, ' pinned to ', t.tag, ' in ', d.name) AS summary
+	FROM microservice_tags t
+	JOIN microservice_definitions x ON x.id = t.microservice_id
+	JOIN designation_definitions d ON d.id = t.designation_id
+	WHERE t.%s = ? ORDER BY t.id`
+
+const checkinDependents = `SELECT id, CONCAT(hostname, IF(room = '', '', CONCAT(' in ', room))) AS summary
+	FROM device_checkins WHERE %s = ? ORDER BY hostname`
+
+const roomDependents = `SELECT id, name AS summary FROM rooms WHERE %s = ? ORDER BY name`
+
+//mappings of a definition that aren't in the trash
+func liveMappings(column string) string {
+	return "m." + column + " = ? AND m.deletion_id IS NULL"
+}
+
+//dependents that are listed but never stop a delete - a check-in is only what a pi last reported
+var nonBlocking = map[string]bool{
+	"device_checkins": true,
+}
+
+//what refers to each definition table
+var dependencies = map[string][]dependency{
+	"class_definitions": {
+		{"variable_mappings", fmt.Sprintf(variableMappingDependents, liveMappings("class_id"))},
+		{"microservice_mappings", fmt.Sprintf(microserviceMappingDependents, liveMappings("class_id"))},
+		{"required_variables", fmt.Sprintf(requiredVariableDependents, "class_id")},
+		{"device_checkins", fmt.Sprintf(checkinDependents, "class_id")},
+	},
+	"designation_definitions": {
+		{"variable_mappings", fmt.Sprintf(variableMappingDependents, liveMappings("designation_id"))},
+		{"microservice_mappings", fmt.Sprintf(microserviceMappingDependents, liveMappings("designation_id"))},
+		{"microservice_tags", fmt.Sprintf(imageTagDependents, "designation_id")},
+		{"device_checkins", fmt.Sprintf(checkinDependents, "designation_id")},
+		{"rooms", fmt.Sprintf(roomDependents, "designation_id")},
+	},
+	"variable_definitions": {
+		{"variable_mappings", fmt.Sprintf(variableMappingDependents, liveMappings("variable_id"))},
+		{"required_variables", fmt.Sprintf(requiredVariableDependents, "variable_id")},
+	},
+	"microservice_definitions": {
+		{"microservice_mappings", fmt.Sprintf(microserviceMappingDependents, liveMappings("microservice_id"))},
+		{"microservice_tags", fmt.Sprintf(imageTagDependents, "microservice_id")},
+	},
+}
+
+//previews what deleting a definition would remove
+func GetImpact(ctx context.Context, table string, id int64) (Impact, error) {
+
+	logger.Debugf(ctx, "finding dependents of %d in %s", id, table)
+
+	return getImpact(ctx, db.DB(), table, id, false)
+}
+
+//lock holds the definition until the end of the transaction, so nothing new can refer to it in the meantime
+func getImpact(ctx context.Context, queryer sqlx.Queryer, table string, id int64, lock bool) (Impact, error) {
+
+	impact := Impact{Table: table, ID: id, Dependents: []Dependent{}}
+
+	command := fmt.Sprintf("SELECT name FROM %s WHERE id = ? AND deletion_id IS NULL", table)
+	if lock {
+		command += " FOR UPDATE"
+	}
+
+	err := sqlx.Get(queryer, &impact.Name, command, id)
+	if err == sql.ErrNoRows {
+		return impact, apierrors.NotFound(fmt.Sprintf("%d not found in %s", id, table))
+	}
+
+	if err != nil {
+		msg := fmt.Sprintf("definition not found: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return impact, apierrors.Wrap(err, msg)
+	}
+
+	for _, dependency := range dependencies[table] {
+
+		var rows []DependentItem
+		err = sqlx.Select(queryer, &rows, dependency.command, id)
+		if err != nil {
+			msg := fmt.Sprintf("unable to find dependents in %s: %s", dependency.table, err.Error())
+			logger.Errorf(ctx, "%s", msg)
+			return impact, apierrors.Wrap(err, msg)
+		}
+
+		if len(rows) == 0 {
+			continue
+		}
+
+		impact.Dependents = append(impact.Dependents, Dependent{Table: dependency.table, Rows: rows, Blocking: !nonBlocking[dependency.table]})
+		if !nonBlocking[dependency.table] {
+			impact.Total += len(rows)
+		}
+	}
+
+	return impact, nil
+}
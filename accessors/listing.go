@@ -0,0 +1,227 @@
+package accessors
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/byuoitav/pi-designation-microservice/apierrors"
+)
+
+//the most rows a single page can hold
+const MAX_LIMIT = 1000
+
+//filters a list can be narrowed by - each takes an ID or a name
+var LIST_FILTERS = []string{"class", "designation", "variable", "microservice"}
+
+//narrows, orders and pages a list of definitions or mappings
+type ListQuery struct {
+	Limit   int               //zero means everything
+	Cursor  string            //from the previous page - empty means start at the top
+	Search  string            //substring of a name or description
+	Sort    string            //see the sorts of each list - prefix with '-' to reverse
+	Filters map[string]string //see LIST_FILTERS
+}
+
+//what a cursor remembers about the last row of a page
+type cursor struct {
+	Sort string `json:"s"`
+	Key  string `json:"k"`
+	ID   int64  `json:"i"`
+}
+
+//how a ListQuery applies to one table - the listed table is always aliased as t
+type listing struct {
+	from    string            //table and any joins the filters or sorts need
+	where   []string          //always applied
+	search  []string          //columns matched by Search
+	filters map[string]filter //filter name -> columns it matches
+	sorts   map[string]string //sort name -> column it orders by
+}
+
+type filter struct {
+	id   string
+	name string
+}
+
+func definitionListing(table string) listing {
+
+	return listing{
+		from:   table + " t",
+		where:  []string{"t.deletion_id IS NULL"},
+		search: []string{"t.name", "t.description"},
+		sorts: map[string]string{
+			"id":   "t.id",
+			"name": "t.name",
+		},
+	}
+}
+
+//definitionTable is the table of whatever the mapping maps, definitionColumn the column that points at it
+func mappingListing(table, definition, definitionTable, definitionColumn string) listing {
+
+	return listing{
+		from: fmt.Sprintf("%s t JOIN class_definitions c ON c.id = t.class_id JOIN designation_definitions d ON d.id = t.designation_id JOIN %s x ON x.id = t.%s",
+			table, definitionTable, definitionColumn),
+		where:  []string{"t.deletion_id IS NULL"},
+		search: []string{"x.name", "x.description"},
+		filters: map[string]filter{
+			"class":       {"c.id", "c.name"},
+			"designation": {"d.id", "d.name"},
+			definition:    {"x.id", "x.name"},
+		},
+		sorts: map[string]string{
+			"id":          "t.id",
+			"class":       "c.name",
+			"designation": "d.name",
+			definition:    "x.name",
+		},
+	}
+}
+
+//builds the query for one page of columns - every row also carries a sort_key for the next cursor
+//asks for one row more than the limit so we know whether there's another page
+func (l *listing) build(columns string, query ListQuery) (string, []interface{}, error) {
+
+	where := append([]string{}, l.where...)
+	var args []interface{}
+
+	if query.Limit < 0 || query.Limit > MAX_LIMIT {
+		msg := fmt.Sprintf("limit must be between 1 and %d", MAX_LIMIT)
+		return "", nil, apierrors.BadRequest("limit", msg)
+	}
+
+	sort := query.Sort
+	if len(sort) == 0 {
+		sort = "id"
+	}
+
+	descending := strings.HasPrefix(sort, "-")
+	column, ok := l.sorts[strings.TrimPrefix(sort, "-")]
+	if !ok {
+		msg := fmt.Sprintf("can't sort by %s", sort)
+		return "", nil, apierrors.BadRequest("sort", msg)
+	}
+
+	for name, value := range query.Filters {
+
+		if len(value) == 0 {
+			continue
+		}
+
+		columns, ok := l.filters[name]
+		if !ok {
+			msg := fmt.Sprintf("can't filter this list by %s", name)
+			return "", nil, apierrors.BadRequest(name, msg)
+		}
+
+		//numbers are IDs, anything else is a name
+		if id, err := strconv.ParseInt(value, 10, 64); err == nil {
+			where = append(where, columns.id+" = ?")
+			args = append(args, id)
+		} else {
+			where = append(where, columns.name+" = ?")
+			args = append(args, value)
+		}
+	}
+
+	if len(query.Search) > 0 {
+
+		var matches []string
+		pattern := "%" + escapeLike(query.Search) + "%"
+		for _, column := range l.search {
+			matches = append(matches, column+" LIKE ?")
+			args = append(args, pattern)
+		}
+
+		where = append(where, "("+strings.Join(matches, " OR ")+")")
+	}
+
+	comparison, direction := ">", "ASC"
+	if descending {
+		comparison, direction = "<", "DESC"
+	}
+
+	if len(query.Cursor) > 0 {
+
+		last, err := decodeCursor(query.Cursor)
+		if err != nil || last.Sort != sort {
+			return "", nil, apierrors.BadRequest("cursor", "invalid cursor")
+		}
+
+		if column == "t.id" {
+			where = append(where, "t.id "+comparison+" ?")
+			args = append(args, last.ID)
+		} else {
+			where = append(where, fmt.Sprintf("(%s %s ? OR (%s = ? AND t.id %s ?))", column, comparison, column, comparison))
+			args = append(args, last.Key, last.Key, last.ID)
+		}
+	}
+
+	command := fmt.Sprintf("SELECT %s, %s AS sort_key FROM %s", columns, column, l.from)
+	if len(where) > 0 {
+		command += " WHERE " + strings.Join(where, " AND ")
+	}
+
+	command += fmt.Sprintf(" ORDER BY %s %s", column, direction)
+	if column != "t.id" {
+		command += fmt.Sprintf(", t.id %s", direction)
+	}
+
+	if query.Limit > 0 {
+		command += " LIMIT ?"
+		args = append(args, query.Limit+1)
+	}
+
+	return command, args, nil
+}
+
+//whether a page of count rows ran past the limit - if so the caller drops the extra row and hands out a cursor
+func (query *ListQuery) more(count int) bool {
+
+	return query.Limit > 0 && count > query.Limit
+}
+
+//points just past the last row of this page
+func (query *ListQuery) next(key string, id int64) string {
+
+	sort := query.Sort
+	if len(sort) == 0 {
+		sort = "id"
+	}
+
+	bytes, _ := json.Marshal(cursor{Sort: sort, Key: key, ID: id})
+	return base64.RawURLEncoding.EncodeToString(bytes)
+}
+
+func decodeCursor(encoded string) (cursor, error) {
+
+	var last cursor
+
+	bytes, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return last, err
+	}
+
+	err = json.Unmarshal(bytes, &last)
+	return last, err
+}
+
+//LIKE treats % and _ as wildcards - a search for them should find them
+func escapeLike(value string) string {
+
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(value)
+}
+
+//prefixes each of a comma-separated list of columns with a table or alias
+func qualify(table, columns string) string {
+
+	var output []string
+	for _, column := range strings.Split(columns, ",") {
+		output = append(output, table+"."+strings.TrimSpace(column))
+	}
+
+	return strings.Join(output, ", ")
+}
@@ -1,12 +1,12 @@
 package accessors
 
 import (
-	"errors"
+	"context"
+	"database/sql"
 	"fmt"
-	"log"
 
+	"github.com/byuoitav/pi-designation-microservice/apierrors"
 	db "github.com/byuoitav/pi-designation-microservice/database"
-	"github.com/fatih/color"
 )
 
 //we're assuming the user knows the IDs for everything
@@ -14,12 +14,12 @@ import (
 //colName - name of column in table to add entries to
 //defId - name of column in table to add external ID to
 //returns a slice of newly created IDs
-func AddMappings(mappingTable, definitionColumnName, valueColumnName string, entries *Batch) ([]int64, error) {
+func AddMappings(ctx context.Context, mappingTable, definitionColumnName, valueColumnName string, entries *Batch) ([]int64, error) {
 
 	if len(entries.Value) == 0 {
 		msg := "invalid mapping value"
-		log.Printf("%s", color.HiRedString("[accessors] %s", msg))
-		return []int64{}, errors.New(msg)
+		logger.Errorf(ctx, "%s", msg)
+		return []int64{}, apierrors.Invalid("value", msg)
 	}
 
 	var output []int64
@@ -28,11 +28,11 @@ func AddMappings(mappingTable, definitionColumnName, valueColumnName string, ent
 
 		for _, designation := range class.Designations {
 
-			id, err := AddMapping(mappingTable, definitionColumnName, valueColumnName, entries.Value, entries.ID, class.ID, designation)
+			id, err := AddMapping(ctx, mappingTable, definitionColumnName, valueColumnName, entries.Value, entries.ID, class.ID, designation)
 			if err != nil {
 				msg := fmt.Sprintf("failed to add single mapping: %s", err.Error())
-				log.Printf("%s", color.HiRedString("[accessors] %s", msg))
-				return []int64{}, errors.New(msg)
+				logger.Errorf(ctx, "%s", msg)
+				return []int64{}, apierrors.Wrap(err, msg)
 			}
 
 			output = append(output, id)
@@ -51,59 +51,90 @@ func AddMappings(mappingTable, definitionColumnName, valueColumnName string, ent
 //@param designationID - designation ID of mapping
 //@param classID - ID of class (e.g. av-control)
 //the only string value that should come from the user is 'value'
-func AddMapping(mappingTable, definitionColumnName, valueColumnName, value string, entryID, classID, designationID int64) (int64, error) {
+func AddMapping(ctx context.Context, mappingTable, definitionColumnName, valueColumnName, value string, entryID, classID, designationID int64) (int64, error) {
 
-	log.Printf("[accessors] adding mapping...")
+	logger.Debugf(ctx, "adding mapping...")
+
+	err := checkReferences(ctx, definitionColumnName, entryID, classID, designationID)
+	if err != nil {
+		return 0, err
+	}
 
 	//format SQL
 	command := fmt.Sprintf("INSERT INTO %s (%s, designation_id, class_id, %s) VALUES (?, ?, ?, ?)", mappingTable, definitionColumnName, valueColumnName)
-	log.Printf("[accessors] SQL: %s", command)
+	logger.Debugf(ctx, "SQL: %s", command)
 
 	result, err := db.DB().Exec(command, entryID, designationID, classID, value)
 	if err != nil {
 		msg := fmt.Sprintf("insert action failed: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[accessors] %s", msg))
-		return 0, errors.New(msg)
+		logger.Errorf(ctx, "%s", msg)
+		return 0, apierrors.Wrap(err, msg)
 	}
 
 	id, err := result.LastInsertId()
 	if err != nil {
 		msg := fmt.Sprintf("last inserted ID not found: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[accessors] %s", msg))
-		return 0, errors.New(msg)
+		logger.Errorf(ctx, "%s", msg)
+		return 0, apierrors.Wrap(err, msg)
 	}
 
 	return id, nil
 }
 
-func EditMapping(mappingTable, definitionColumnName, valueColumnName, value string, definitionID, classID, designationID, mappingID int64) error {
+//@param version - the version of the mapping being edited - zero edits whatever's there
+//returns the version the edit made
+func EditMapping(ctx context.Context, mappingTable, definitionColumnName, valueColumnName, value string, definitionID, classID, designationID, mappingID, version int64) (int64, error) {
 
-	log.Printf("[accessors] editing mapping...")
+	logger.Debugf(ctx, "editing mapping...")
+
+	err := checkReferences(ctx, definitionColumnName, definitionID, classID, designationID)
+	if err != nil {
+		return 0, err
+	}
 
 	//format SQL
-	command := fmt.Sprintf("UPDATE %s SET %s = ?, class_id = ?, designation_id = ?, %s = ? WHERE id = ?", mappingTable, definitionColumnName, valueColumnName)
-	log.Printf("[accessors] SQL: %s", command)
+	command := fmt.Sprintf("UPDATE %s SET %s = ?, class_id = ?, designation_id = ?, %s = ?, %s WHERE id = ? AND deletion_id IS NULL AND %s",
+		mappingTable, definitionColumnName, valueColumnName, VERSION_BUMP, VERSION_CLAUSE)
+	logger.Debugf(ctx, "SQL: %s", command)
 
-	_, err := db.DB().Exec(command, definitionID, classID, designationID, value, mappingID)
+	result, err := db.DB().Exec(command, definitionID, classID, designationID, value, mappingID, version, version)
 	if err != nil {
 		msg := fmt.Sprintf("edit failed: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[accessors] %s", msg))
-		return errors.New(msg)
+		logger.Errorf(ctx, "%s", msg)
+		return 0, apierrors.Wrap(err, msg)
 	}
 
-	return nil
+	return checkEdit(ctx, result, mappingTable, mappingID, version)
 }
 
-func GetAllMicroserviceMappings() ([]MicroserviceMapping, error) {
+//returns the cursor of the next page, or an empty string on the last one
+func GetAllMicroserviceMappings(ctx context.Context, query ListQuery) ([]MicroserviceMapping, string, error) {
 
-	log.Printf("[accessors] getting all microservice mappings...")
+	logger.Debugf(ctx, "getting all microservice mappings...")
 
-	var mappings []DBMicroservice
-	err := db.DB().Select(&mappings, "SELECT * FROM microservice_mappings")
+	listing := mappingListing("microservice_mappings", "microservice", "microservice_definitions", "microservice_id")
+	cmd, args, err := listing.build(qualify("t", MICROSERVICE_MAPPING_COLUMNS), query)
+	if err != nil {
+		return []MicroserviceMapping{}, "", err
+	}
+
+	var mappings []struct {
+		DBMicroservice
+		SortKey string `db:"sort_key"`
+	}
+
+	err = db.DB().Select(&mappings, cmd, args...)
 	if err != nil {
 		msg := fmt.Sprintf("mappings not found: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[accessors] %s", msg))
-		return []MicroserviceMapping{}, errors.New(msg)
+		logger.Errorf(ctx, "%s", msg)
+		return []MicroserviceMapping{}, "", apierrors.Wrap(err, msg)
+	}
+
+	var next string
+	if query.more(len(mappings)) {
+		mappings = mappings[:query.Limit]
+		last := mappings[len(mappings)-1]
+		next = query.next(last.SortKey, last.ID)
 	}
 
 	var output []MicroserviceMapping
@@ -111,33 +142,33 @@ func GetAllMicroserviceMappings() ([]MicroserviceMapping, error) {
 	for _, mapping := range mappings {
 
 		var microservice MicroserviceMapping
-		err = FillMicroserviceMapping(&mapping, &microservice)
+		err = FillMicroserviceMapping(ctx, &mapping.DBMicroservice, &microservice)
 		if err != nil {
 			msg := fmt.Sprintf("microservice not found: %s", err.Error())
-			log.Printf("%s", color.HiRedString("[accessors] %s", msg))
-			return []MicroserviceMapping{}, errors.New(msg)
+			logger.Errorf(ctx, "%s", msg)
+			return []MicroserviceMapping{}, "", apierrors.Wrap(err, msg)
 		}
 
 		output = append(output, microservice)
 	}
 
-	return output, nil
+	return output, next, nil
 
 }
 
-func GetMicroserviceMappingsById(IDs []int64) ([]MicroserviceMapping, error) {
+func GetMicroserviceMappingsById(ctx context.Context, IDs []int64) ([]MicroserviceMapping, error) {
 
-	log.Printf("[accessors] getting microservice entries...")
+	logger.Debugf(ctx, "getting microservice entries...")
 
 	var output []MicroserviceMapping
 	for _, id := range IDs {
 
 		var microservice MicroserviceMapping
-		err := GetMicroserviceMappingById(id, &microservice)
+		err := GetMicroserviceMappingById(ctx, id, &microservice)
 		if err != nil {
 			msg := fmt.Sprintf("entry not found: %s", err.Error())
-			log.Printf("%s", color.HiRedString("[accessors] %s", msg))
-			return []MicroserviceMapping{}, errors.New(msg)
+			logger.Errorf(ctx, "%s", msg)
+			return []MicroserviceMapping{}, apierrors.Wrap(err, msg)
 		}
 
 		output = append(output, microservice)
@@ -146,27 +177,27 @@ func GetMicroserviceMappingsById(IDs []int64) ([]MicroserviceMapping, error) {
 	return output, nil
 }
 
-func GetMicroserviceMappingById(entryID int64, microservice *MicroserviceMapping) error {
+func GetMicroserviceMappingById(ctx context.Context, entryID int64, microservice *MicroserviceMapping) error {
 
-	log.Printf("[accessors] getting microservice entry...")
+	logger.Debugf(ctx, "getting microservice entry...")
 
 	//get the IDs
 	var mapping DBMicroservice
-	err := db.DB().Get(&mapping, "SELECT * FROM microservice_mappings WHERE id = ?", entryID)
+	err := db.DB().Get(&mapping, "SELECT "+MICROSERVICE_MAPPING_COLUMNS+" FROM microservice_mappings WHERE id = ? AND deletion_id IS NULL", entryID)
 	if err != nil {
 		msg := fmt.Sprintf("failed to execute query: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[accessors] %s", msg))
-		return errors.New(msg)
+		logger.Errorf(ctx, "%s", msg)
+		return apierrors.Wrap(err, msg)
 	}
 
 	//TODO:make sure it's not the empty set
 	//does Get() take care of that?
 
-	err = FillMicroserviceMapping(&mapping, microservice)
+	err = FillMicroserviceMapping(ctx, &mapping, microservice)
 	if err != nil {
 		msg := fmt.Sprintf("failed to execute query: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[accessors] %s", msg))
-		return errors.New(msg)
+		logger.Errorf(ctx, "%s", msg)
+		return apierrors.Wrap(err, msg)
 	}
 
 	return nil
@@ -174,25 +205,26 @@ func GetMicroserviceMappingById(entryID int64, microservice *MicroserviceMapping
 }
 
 //takes entry in the microservice_mappings table and fleshes it out
-func FillMicroserviceMapping(mapping *DBMicroservice, output *MicroserviceMapping) error {
+func FillMicroserviceMapping(ctx context.Context, mapping *DBMicroservice, output *MicroserviceMapping) error {
 
-	class, desig, err := GetClassAndDesignation(mapping.ClassID, mapping.DesigID)
+	class, desig, err := GetClassAndDesignation(ctx, mapping.ClassID, mapping.DesigID)
 	if err != nil {
 		msg := fmt.Sprintf("entry not found: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[accessors] %s", msg))
-		return errors.New(msg)
+		logger.Errorf(ctx, "%s", msg)
+		return apierrors.Wrap(err, msg)
 	}
 
 	var microservice Microservice
-	err = db.DB().Get(&microservice, "SELECT * from microservice_definitions WHERE id = ?", mapping.MicroID)
+	err = db.DB().Get(&microservice, "SELECT "+MICROSERVICE_COLUMNS+" FROM microservice_definitions WHERE id = ?", mapping.MicroID)
 	if err != nil {
 		msg := fmt.Sprintf("entry not found: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[accessors] %s", msg))
-		return errors.New(msg)
+		logger.Errorf(ctx, "%s", msg)
+		return apierrors.Wrap(err, msg)
 	}
 
 	placeHolder := Mapping{
 		ID:          mapping.ID,
+		Version:     mapping.Version,
 		Class:       class,
 		Designation: desig,
 	}
@@ -200,48 +232,78 @@ func FillMicroserviceMapping(mapping *DBMicroservice, output *MicroserviceMappin
 	output.Mapping = placeHolder
 	output.Microservice = microservice
 	output.YAML = mapping.YAML
+	output.Overrides = mapping.Overrides
 
 	return nil
 }
 
-func GetClassAndDesignation(classID, designationID int64) (class Class, designation Designation, err error) {
+func GetClassAndDesignation(ctx context.Context, classID, designationID int64) (class Class, designation Designation, err error) {
 
-	err = db.DB().Get(&class, "SELECT * from class_definitions WHERE id = ?", classID)
+	err = db.DB().Get(&class, "SELECT "+DEFINITION_COLUMNS+" FROM class_definitions WHERE id = ? AND deletion_id IS NULL", classID)
 	if err != nil {
-		err = errors.New(fmt.Sprintf("class not found: %s", err.Error()))
+		err = apierrors.Wrap(err, fmt.Sprintf("class not found: %s", err.Error()))
 		return
 	}
 
-	err = db.DB().Get(&designation, "SELECT * from designation_definitions WHERE id = ?", designationID)
+	err = db.DB().Get(&designation, "SELECT "+DEFINITION_COLUMNS+" FROM designation_definitions WHERE id = ? AND deletion_id IS NULL", designationID)
 	if err != nil {
-		err = errors.New(fmt.Sprintf("designation not found: %s", err.Error()))
+		err = apierrors.Wrap(err, fmt.Sprintf("designation not found: %s", err.Error()))
 		return
 	}
 
 	return
 }
 
-func DeleteMapping(table string, id int64) error {
+//moves the mapping to the trash - see RestoreDeletion
+func DeleteMapping(ctx context.Context, table string, id int64) (Deletion, error) {
 
-	log.Printf("[accessors] deleting entry from table %s with id %d", table, id)
+	logger.Debugf(ctx, "deleting entry from table %s with id %d", table, id)
 
-	command := fmt.Sprintf("DELETE FROM %s WHERE id = ?", table)
+	tx, err := db.DB().Beginx()
+	if err != nil {
+		msg := fmt.Sprintf("unable to start transaction: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return Deletion{}, apierrors.Wrap(err, msg)
+	}
+	defer tx.Rollback()
+
+	var mapping DependentItem
+	err = tx.Get(&mapping, fmt.Sprintf(mappingSummaries[table], "m.id = ? AND m.deletion_id IS NULL"), id)
+	if err == sql.ErrNoRows {
+		return Deletion{}, apierrors.NotFound("invalid delete")
+	}
 
-	_, err := db.DB().Exec(command, id)
 	if err != nil {
 		msg := fmt.Sprintf("unable to delete mapping: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[accessors] %s", msg))
-		return errors.New(msg)
+		logger.Errorf(ctx, "%s", msg)
+		return Deletion{}, apierrors.Wrap(err, msg)
 	}
 
-	return nil
+	deletionID, err := trash(ctx, tx, table, id, mapping.Summary)
+	if err != nil {
+		return Deletion{}, err
+	}
+
+	deletion, err := getDeletion(ctx, tx, deletionID, false)
+	if err != nil {
+		return deletion, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		msg := fmt.Sprintf("unable to commit delete: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return deletion, apierrors.Wrap(err, msg)
+	}
+
+	return deletion, nil
 }
 
-func GetDockerComposeByDesignationAndClass(microservices *[]DBMicroservice, classId, desigId int64) error {
+func GetDockerComposeByDesignationAndClass(ctx context.Context, microservices *[]DBMicroservice, classId, desigId int64) error {
 
-	log.Printf("[accessors] querying database for microservice mappings with class ID %d and designation ID %d", classId, desigId)
+	logger.Debugf(ctx, "querying database for microservice mappings with class ID %d and designation ID %d", classId, desigId)
 
-	err := db.DB().Select(microservices, "SELECT * FROM microservice_mappings WHERE designation_id = ? AND class_id = ?", desigId, classId)
+	err := db.DB().Select(microservices, "SELECT "+MICROSERVICE_MAPPING_COLUMNS+" FROM microservice_mappings WHERE designation_id = ? AND class_id = ? AND deletion_id IS NULL", desigId, classId)
 	if err != nil {
 		return err
 	}
@@ -249,3 +311,21 @@ func GetDockerComposeByDesignationAndClass(microservices *[]DBMicroservice, clas
 	return nil
 
 }
+
+//finds the class and designation a mapping currently belongs to
+func GetMappingScope(ctx context.Context, table string, id int64) (DBMapping, error) {
+
+	logger.Debugf(ctx, "getting scope of entry %d in table %s", id, table)
+
+	var scope DBMapping
+	command := fmt.Sprintf("SELECT id, class_id, designation_id FROM %s WHERE id = ? AND deletion_id IS NULL", table)
+
+	err := db.DB().Get(&scope, command, id)
+	if err != nil {
+		msg := fmt.Sprintf("mapping not found: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return DBMapping{}, apierrors.Wrap(err, msg)
+	}
+
+	return scope, nil
+}
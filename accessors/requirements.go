@@ -0,0 +1,86 @@
+package accessors
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/byuoitav/pi-designation-microservice/apierrors"
+	db "github.com/byuoitav/pi-designation-microservice/database"
+)
+
+//replaces the set of classes a variable is required in
+func SetRequiredClasses(ctx context.Context, variableID int64, classIDs []int64) error {
+
+	logger.Debugf(ctx, "requiring variable %d in classes %v", variableID, classIDs)
+
+	tx, err := db.DB().Beginx()
+	if err != nil {
+		msg := fmt.Sprintf("unable to start transaction: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return apierrors.Wrap(err, msg)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM required_variables WHERE variable_id = ?", variableID)
+	if err != nil {
+		msg := fmt.Sprintf("unable to clear required classes: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return apierrors.Wrap(err, msg)
+	}
+
+	for _, classID := range classIDs {
+
+		_, err = tx.Exec("INSERT INTO required_variables (variable_id, class_id) VALUES (?, ?)", variableID, classID)
+		if err != nil {
+			msg := fmt.Sprintf("unable to require variable in class %d: %s", classID, err.Error())
+			logger.Errorf(ctx, "%s", msg)
+			return apierrors.Wrap(err, msg)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		msg := fmt.Sprintf("unable to commit required classes: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return apierrors.Wrap(err, msg)
+	}
+
+	return nil
+}
+
+func GetRequiredClasses(ctx context.Context, variableID int64) ([]int64, error) {
+
+	logger.Debugf(ctx, "getting classes that require variable %d", variableID)
+
+	classIDs := []int64{}
+	command := `SELECT r.class_id FROM required_variables r
+		JOIN class_definitions c ON c.id = r.class_id
+		WHERE r.variable_id = ? AND c.deletion_id IS NULL ORDER BY r.class_id`
+
+	err := db.DB().Select(&classIDs, command, variableID)
+	if err != nil {
+		msg := fmt.Sprintf("required classes not found: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return []int64{}, apierrors.Wrap(err, msg)
+	}
+
+	return classIDs, nil
+}
+
+//every variable a class requires
+func GetRequiredVariables(ctx context.Context, classID int64) ([]Variable, error) {
+
+	logger.Debugf(ctx, "getting variables required by class %d", classID)
+
+	command := "SELECT " + VARIABLE_COLUMNS + " FROM variable_definitions WHERE deletion_id IS NULL AND id IN (SELECT variable_id FROM required_variables WHERE class_id = ?) ORDER BY name"
+
+	variables := []Variable{}
+	err := db.DB().Select(&variables, command, classID)
+	if err != nil {
+		msg := fmt.Sprintf("required variables not found: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return []Variable{}, apierrors.Wrap(err, msg)
+	}
+
+	return variables, nil
+}
@@ -0,0 +1,362 @@
+package accessors
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/byuoitav/pi-designation-microservice/apierrors"
+	db "github.com/byuoitav/pi-designation-microservice/database"
+	"github.com/byuoitav/pi-designation-microservice/logging"
+)
+
+//the most things one search returns
+const MAX_SEARCH_RESULTS = 200
+
+//how much text to show on either side of a match
+const SEARCH_CONTEXT = 40
+
+//secret values shorter than this are only redacted from YAML and specs where they stand alone - hiding every "1" or "on" inside a word would make everything unreadable
+const MIN_SECRET_LENGTH = 4
+
+//kinds of things a search can find
+const (
+	CLASS_RESULT                = "class"
+	DESIGNATION_RESULT          = "designation"
+	VARIABLE_RESULT             = "variable"
+	MICROSERVICE_RESULT         = "microservice"
+	VARIABLE_MAPPING_RESULT     = "variable-mapping"
+	MICROSERVICE_MAPPING_RESULT = "microservice-mapping"
+)
+
+//one definition or mapping and where in it the search text appears
+type SearchResult struct {
+	Kind        string        `json:"kind"`
+	ID          int64         `json:"id"`
+	Name        string        `json:"name"`                  //the definition, or what the mapping maps
+	Class       string        `json:"class,omitempty"`       //only for mappings
+	Designation string        `json:"designation,omitempty"` //only for mappings
+	Matches     []SearchMatch `json:"matches"`
+}
+
+//a match with the text around it - before + match + after is the snippet
+type SearchMatch struct {
+	Field  string `json:"field"`
+	Line   int    `json:"line,omitempty"` //only for multi-line fields like yaml
+	Before string `json:"before"`
+	Match  string `json:"match"`
+	After  string `json:"after"`
+}
+
+type SearchResults struct {
+	Query     string         `json:"query"`
+	Results   []SearchResult `json:"results"`
+	Truncated bool           `json:"truncated"` //more matched than MAX_SEARCH_RESULTS
+}
+
+//a row from any of the tables we search - unused columns stay empty
+type searchRow struct {
+	ID          int64  `db:"id"`
+	Name        string `db:"name"`
+	Description string `db:"description"`
+	Class       string `db:"class"`
+	Designation string `db:"designation"`
+	Value       string `db:"value"`
+	YAML        string `db:"yaml"`
+	Spec        string `db:"spec"`
+}
+
+//a column of a searchRow, in the order matches are listed
+type searchField struct {
+	name  string
+	value func(*searchRow) string
+}
+
+//each query takes the LIKE pattern once per ? and returns searchRow columns
+var searches = []struct {
+	kind    string
+	command string
+	fields  []searchField
+}{
+	{
+		kind:    CLASS_RESULT,
+		command: "SELECT id, name, description FROM class_definitions WHERE deletion_id IS NULL AND (name LIKE ? OR description LIKE ?)",
+		fields:  definitionFields,
+	},
+	{
+		kind:    DESIGNATION_RESULT,
+		command: "SELECT id, name, description FROM designation_definitions WHERE deletion_id IS NULL AND (name LIKE ? OR description LIKE ?)",
+		fields:  definitionFields,
+	},
+	{
+		kind: VARIABLE_RESULT,
+		command: `SELECT id, name, description, IF(secret, '', COALESCE(default_value, '')) AS value FROM variable_definitions
+			WHERE deletion_id IS NULL AND (name LIKE ? OR description LIKE ? OR (secret = 0 AND default_value LIKE ?))`,
+		fields: []searchField{
+			{"name", func(row *searchRow) string { return row.Name }},
+			{"description", func(row *searchRow) string { return row.Description }},
+			{"default", func(row *searchRow) string { return row.Value }},
+		},
+	},
+	{
+		kind:    MICROSERVICE_RESULT,
+		command: "SELECT id, name, description, spec FROM microservice_definitions WHERE deletion_id IS NULL AND (name LIKE ? OR description LIKE ? OR spec LIKE ?)",
+		fields: []searchField{
+			{"name", func(row *searchRow) string { return row.Name }},
+			{"description", func(row *searchRow) string { return row.Description }},
+			{"spec", func(row *searchRow) string { return row.Spec }},
+		},
+	},
+	{
+		kind: VARIABLE_MAPPING_RESULT,
+		command: `SELECT m.id, v.name, c.name AS class, d.name AS designation, m.value FROM variable_mappings m
+			JOIN variable_definitions v ON v.id = m.variable_id
+			JOIN class_definitions c ON c.id = m.class_id
+			JOIN designation_definitions d ON d.id = m.designation_id
+			WHERE m.deletion_id IS NULL AND v.secret = 0 AND m.value LIKE ?`,
+		fields: []searchField{
+			{"value", func(row *searchRow) string { return row.Value }},
+		},
+	},
+	{
+		kind: MICROSERVICE_MAPPING_RESULT,
+		command: `SELECT m.id, x.name, c.name AS class, d.name AS designation, m.yaml, m.overrides AS spec FROM microservice_mappings m
+			JOIN microservice_definitions x ON x.id = m.microservice_id
+			JOIN class_definitions c ON c.id = m.class_id
+			JOIN designation_definitions d ON d.id = m.designation_id
+			WHERE m.deletion_id IS NULL AND (CONVERT(m.yaml USING utf8) LIKE ? OR m.overrides LIKE ?)`,
+		fields: []searchField{
+			{"yaml", func(row *searchRow) string { return row.YAML }},
+			{"overrides", func(row *searchRow) string { return row.Spec }},
+		},
+	},
+}
+
+var definitionFields = []searchField{
+	{"name", func(row *searchRow) string { return row.Name }},
+	{"description", func(row *searchRow) string { return row.Description }},
+}
+
+//finds text in definitions, mapped values and microservice YAML - case doesn't matter
+//values of secret variables never show up, even where they're pasted into YAML or specs
+func Search(ctx context.Context, text string) (SearchResults, error) {
+
+	logger.Debugf(ctx, "searching for %s", text)
+
+	output := SearchResults{Query: text, Results: []SearchResult{}}
+
+	if len(strings.TrimSpace(text)) == 0 {
+		return output, apierrors.BadRequest("q", "nothing to search for")
+	}
+
+	secrets, err := getSecretValues()
+	if err != nil {
+		msg := fmt.Sprintf("unable to get secret values: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return output, apierrors.Wrap(err, msg)
+	}
+
+	pattern := regexp.MustCompile("(?i)" + regexp.QuoteMeta(text))
+	like := "%" + escapeLike(text) + "%"
+
+	for _, search := range searches {
+
+		args := make([]interface{}, strings.Count(search.command, "?"))
+		for i := range args {
+			args[i] = like
+		}
+
+		var rows []searchRow
+		err := db.DB().Select(&rows, fmt.Sprintf("%s LIMIT %d", search.command, MAX_SEARCH_RESULTS+1), args...)
+		if err != nil {
+			msg := fmt.Sprintf("unable to search %s definitions and mappings: %s", search.kind, err.Error())
+			logger.Errorf(ctx, "%s", msg)
+			return output, apierrors.Wrap(err, msg)
+		}
+
+		for i := range rows {
+
+			result := SearchResult{
+				Kind:        search.kind,
+				ID:          rows[i].ID,
+				Name:        rows[i].Name,
+				Class:       rows[i].Class,
+				Designation: rows[i].Designation,
+			}
+
+			for _, field := range search.fields {
+				value := secrets.Replace(field.value(&rows[i]))
+				result.Matches = append(result.Matches, findMatches(field.name, value, pattern)...)
+			}
+
+			//the only match was inside a secret
+			if len(result.Matches) == 0 {
+				continue
+			}
+
+			if len(output.Results) == MAX_SEARCH_RESULTS {
+				output.Truncated = true
+				return output, nil
+			}
+
+			output.Results = append(output.Results, result)
+		}
+	}
+
+	return output, nil
+}
+
+//every value of a secret variable, mapped or default
+type secretValues struct {
+	long  *strings.Replacer //replaced wherever they appear
+	short []string          //replaced where they aren't part of a longer word
+}
+
+func getSecretValues() (secretValues, error) {
+
+	var values []string
+	err := db.DB().Select(&values, `SELECT m.value FROM variable_mappings m JOIN variable_definitions v ON v.id = m.variable_id WHERE v.secret = 1 AND m.value <> ''
+		UNION SELECT default_value FROM variable_definitions WHERE secret = 1 AND default_value <> ''`)
+	if err != nil {
+		return secretValues{}, err
+	}
+
+	//longest first, so a secret that contains another is hidden whole
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+
+	var secrets secretValues
+	var pairs []string
+	for _, value := range values {
+		if utf8.RuneCountInString(value) < MIN_SECRET_LENGTH {
+			secrets.short = append(secrets.short, value)
+			continue
+		}
+
+		pairs = append(pairs, value, logging.REDACTED)
+	}
+
+	secrets.long = strings.NewReplacer(pairs...)
+	return secrets, nil
+}
+
+//replaces every secret in text with logging.REDACTED
+func (secrets secretValues) Replace(text string) string {
+
+	text = secrets.long.Replace(text)
+
+	for _, secret := range secrets.short {
+		text = replaceWord(text, secret, logging.REDACTED)
+	}
+
+	return text
+}
+
+//replaces every secret in each of spec's values
+func (secrets secretValues) replaceSpec(spec *MicroserviceSpec) {
+
+	if spec == nil {
+		return
+	}
+
+	spec.Image = secrets.Replace(spec.Image)
+	spec.Tag = secrets.Replace(spec.Tag)
+	spec.Restart = secrets.Replace(spec.Restart)
+	spec.NetworkMode = secrets.Replace(spec.NetworkMode)
+
+	for _, list := range [][]string{spec.Ports, spec.Volumes, spec.Devices} {
+		for i := range list {
+			list[i] = secrets.Replace(list[i])
+		}
+	}
+
+	for name, value := range spec.Environment {
+		spec.Environment[name] = secrets.Replace(value)
+	}
+}
+
+//replaces old wherever it isn't touching a letter, digit or underscore
+func replaceWord(text, old, new string) string {
+
+	var output strings.Builder
+
+	start := 0
+	for {
+		i := strings.Index(text[start:], old)
+		if i < 0 {
+			break
+		}
+
+		i += start
+		end := i + len(old)
+		before, _ := utf8.DecodeLastRuneInString(text[:i])
+		after, _ := utf8.DecodeRuneInString(text[end:])
+
+		output.WriteString(text[start:i])
+		if isWordRune(before) || isWordRune(after) {
+			output.WriteString(old)
+		} else {
+			output.WriteString(new)
+		}
+
+		start = end
+	}
+
+	output.WriteString(text[start:])
+	return output.String()
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+//every match in value, cut down to SEARCH_CONTEXT characters either side - multi-line values are matched line by line
+func findMatches(field, value string, pattern *regexp.Regexp) []SearchMatch {
+
+	var output []SearchMatch
+
+	lines := strings.Split(value, "\n")
+	for number, line := range lines {
+
+		for _, location := range pattern.FindAllStringIndex(line, -1) {
+
+			match := SearchMatch{
+				Field:  field,
+				Before: strings.TrimLeft(lastRunes(line[:location[0]], SEARCH_CONTEXT), " \t"),
+				Match:  line[location[0]:location[1]],
+				After:  firstRunes(line[location[1]:], SEARCH_CONTEXT),
+			}
+
+			if len(lines) > 1 {
+				match.Line = number + 1
+			}
+
+			output = append(output, match)
+		}
+	}
+
+	return output
+}
+
+func lastRunes(value string, count int) string {
+
+	runes := []rune(value)
+	if len(runes) <= count {
+		return value
+	}
+
+	return "..." + string(runes[len(runes)-count:])
+}
+
+func firstRunes(value string, count int) string {
+
+	runes := []rune(value)
+	if len(runes) <= count {
+		return value
+	}
+
+	return string(runes[:count]) + "..."
+}
@@ -0,0 +1,276 @@
+package accessors
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/byuoitav/pi-designation-microservice/apierrors"
+	db "github.com/byuoitav/pi-designation-microservice/database"
+)
+
+//how to run a microservice - becomes one service in the docker-compose file
+//stored as JSON in microservice_definitions.spec, and in microservice_mappings.overrides for per-class/designation changes
+type MicroserviceSpec struct {
+	Image       string            `json:"image,omitempty" yaml:"image,omitempty"`
+	Tag         string            `json:"tag,omitempty" yaml:"tag,omitempty"`
+	Ports       []string          `json:"ports,omitempty" yaml:"ports,omitempty"`
+	Volumes     []string          `json:"volumes,omitempty" yaml:"volumes,omitempty"`
+	Restart     string            `json:"restart,omitempty" yaml:"restart,omitempty"`
+	Environment map[string]string `json:"environment,omitempty" yaml:"environment,omitempty"`
+	Devices     []string          `json:"devices,omitempty" yaml:"devices,omitempty"`
+	NetworkMode string            `json:"network_mode,omitempty" yaml:"network_mode,omitempty"`
+}
+
+//everything in a microservice definition
+const MICROSERVICE_COLUMNS = "id, name, description, spec, version"
+
+//everything in a microservice mapping
+const MICROSERVICE_MAPPING_COLUMNS = "id, class_id, designation_id, microservice_id, yaml, overrides, version"
+
+func (spec *MicroserviceSpec) Scan(src interface{}) error {
+
+	*spec = MicroserviceSpec{}
+
+	var data []byte
+	switch value := src.(type) {
+	case nil:
+		return nil
+	case []byte:
+		data = value
+	case string:
+		data = []byte(value)
+	default:
+		return errors.New(fmt.Sprintf("unsupported spec type %T", src))
+	}
+
+	if len(data) == 0 {
+		return nil
+	}
+
+	return json.Unmarshal(data, spec)
+}
+
+func (spec MicroserviceSpec) Value() (driver.Value, error) {
+
+	if spec.IsEmpty() {
+		return "", nil
+	}
+
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	return string(data), nil
+}
+
+func (spec MicroserviceSpec) IsEmpty() bool {
+	return len(spec.Image) == 0 && len(spec.Tag) == 0 && len(spec.Ports) == 0 && len(spec.Volumes) == 0 &&
+		len(spec.Restart) == 0 && len(spec.Environment) == 0 && len(spec.Devices) == 0 && len(spec.NetworkMode) == 0
+}
+
+//applies a mapping's overrides to a definition's spec
+//lists are replaced as a whole, environment variables are merged one at a time
+func MergeSpecs(base, overrides MicroserviceSpec) MicroserviceSpec {
+
+	merged := base
+
+	if len(overrides.Image) > 0 {
+		merged.Image = overrides.Image
+	}
+	if len(overrides.Tag) > 0 {
+		merged.Tag = overrides.Tag
+	}
+	if overrides.Ports != nil {
+		merged.Ports = overrides.Ports
+	}
+	if overrides.Volumes != nil {
+		merged.Volumes = overrides.Volumes
+	}
+	if len(overrides.Restart) > 0 {
+		merged.Restart = overrides.Restart
+	}
+	if overrides.Devices != nil {
+		merged.Devices = overrides.Devices
+	}
+	if len(overrides.NetworkMode) > 0 {
+		merged.NetworkMode = overrides.NetworkMode
+	}
+
+	if len(overrides.Environment) > 0 {
+		merged.Environment = make(map[string]string)
+		for key, value := range base.Environment {
+			merged.Environment[key] = value
+		}
+		for key, value := range overrides.Environment {
+			merged.Environment[key] = value
+		}
+	}
+
+	return merged
+}
+
+func AddMicroserviceDefinition(ctx context.Context, microservice *Microservice) error {
+
+	logger.Debugf(ctx, "adding microservice definition...")
+
+	if len(microservice.Name) == 0 {
+		msg := "invalid definition name"
+		logger.Errorf(ctx, "%s", msg)
+		return apierrors.Invalid("name", msg)
+	}
+
+	result, err := db.DB().Exec("INSERT INTO microservice_definitions (name, description, spec) VALUES (?, ?, ?)",
+		microservice.Name, microservice.Description, microservice.Spec)
+	if err != nil {
+		msg := fmt.Sprintf("definition not added: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return apierrors.Wrap(err, msg)
+	}
+
+	microservice.ID, err = result.LastInsertId()
+	if err != nil {
+		msg := fmt.Sprintf("id not found: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return apierrors.Wrap(err, msg)
+	}
+
+	//new rows start at version 1
+	microservice.Version = 1
+
+	return nil
+}
+
+//microservice.Version works like it does for EditDefinition
+func EditMicroserviceDefinition(ctx context.Context, microservice *Microservice) error {
+
+	logger.Debugf(ctx, "updating microservice definition %d...", microservice.ID)
+
+	if len(microservice.Name) == 0 {
+		msg := "invalid definition name"
+		logger.Errorf(ctx, "%s", msg)
+		return apierrors.Invalid("name", msg)
+	}
+
+	if len(microservice.Description) == 0 {
+		msg := "invalid description"
+		logger.Errorf(ctx, "%s", msg)
+		return apierrors.Invalid("description", msg)
+	}
+
+	result, err := db.DB().Exec("UPDATE microservice_definitions SET name = ?, description = ?, spec = ?, "+VERSION_BUMP+" WHERE id = ? AND deletion_id IS NULL AND "+VERSION_CLAUSE,
+		microservice.Name, microservice.Description, microservice.Spec, microservice.ID, microservice.Version, microservice.Version)
+	if err != nil {
+		msg := fmt.Sprintf("unable to update microservice: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return apierrors.Wrap(err, msg)
+	}
+
+	microservice.Version, err = checkEdit(ctx, result, "microservice_definitions", microservice.ID, microservice.Version)
+	return err
+}
+
+func GetMicroserviceDefinitionById(ctx context.Context, id int64, microservice *Microservice) error {
+
+	logger.Debugf(ctx, "fetching microservice definition with id %d", id)
+
+	err := db.DB().Get(microservice, "SELECT "+MICROSERVICE_COLUMNS+" FROM microservice_definitions WHERE id = ? AND deletion_id IS NULL", id)
+	if err != nil {
+		msg := fmt.Sprintf("definition not found: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return apierrors.Wrap(err, msg)
+	}
+
+	return nil
+}
+
+//returns the cursor of the next page, or an empty string on the last one
+func GetAllMicroserviceDefinitions(ctx context.Context, query ListQuery) ([]Microservice, string, error) {
+
+	logger.Debugf(ctx, "getting all microservice definitions...")
+
+	listing := definitionListing("microservice_definitions")
+	cmd, args, err := listing.build(MICROSERVICE_COLUMNS, query)
+	if err != nil {
+		return []Microservice{}, "", err
+	}
+
+	var rows []struct {
+		Microservice
+		SortKey string `db:"sort_key"`
+	}
+
+	err = db.DB().Select(&rows, cmd, args...)
+	if err != nil {
+		msg := fmt.Sprintf("definitions not found: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return []Microservice{}, "", apierrors.Wrap(err, msg)
+	}
+
+	var next string
+	if query.more(len(rows)) {
+		rows = rows[:query.Limit]
+		last := rows[len(rows)-1]
+		next = query.next(last.SortKey, last.ID)
+	}
+
+	var microservices []Microservice
+	for _, row := range rows {
+		microservices = append(microservices, row.Microservice)
+	}
+
+	return microservices, next, nil
+}
+
+//a mapping with no YAML of its own - the compose service is generated from the definition's spec plus these overrides
+func AddMicroserviceSpecMapping(ctx context.Context, overrides MicroserviceSpec, microserviceID, classID, designationID int64) (int64, error) {
+
+	logger.Debugf(ctx, "adding microservice spec mapping...")
+
+	err := checkReferences(ctx, "microservice_id", microserviceID, classID, designationID)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := db.DB().Exec("INSERT INTO microservice_mappings (microservice_id, designation_id, class_id, yaml, overrides) VALUES (?, ?, ?, '', ?)",
+		microserviceID, designationID, classID, overrides)
+	if err != nil {
+		msg := fmt.Sprintf("insert action failed: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return 0, apierrors.Wrap(err, msg)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		msg := fmt.Sprintf("last inserted ID not found: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return 0, apierrors.Wrap(err, msg)
+	}
+
+	return id, nil
+}
+
+//turns any mapping into a spec mapping, dropping its YAML
+//version works like it does for EditMapping
+func EditMicroserviceSpecMapping(ctx context.Context, overrides MicroserviceSpec, microserviceID, classID, designationID, mappingID, version int64) (int64, error) {
+
+	logger.Debugf(ctx, "editing microservice spec mapping...")
+
+	err := checkReferences(ctx, "microservice_id", microserviceID, classID, designationID)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := db.DB().Exec("UPDATE microservice_mappings SET microservice_id = ?, class_id = ?, designation_id = ?, yaml = '', overrides = ?, "+VERSION_BUMP+" WHERE id = ? AND deletion_id IS NULL AND "+VERSION_CLAUSE,
+		microserviceID, classID, designationID, overrides, mappingID, version, version)
+	if err != nil {
+		msg := fmt.Sprintf("edit failed: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return 0, apierrors.Wrap(err, msg)
+	}
+
+	return checkEdit(ctx, result, "microservice_mappings", mappingID, version)
+}
@@ -0,0 +1,46 @@
+package accessors
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/byuoitav/pi-designation-microservice/apierrors"
+	db "github.com/byuoitav/pi-designation-microservice/database"
+)
+
+//makes sure the database answers within timeout
+func PingDatabase(ctx context.Context, timeout time.Duration) error {
+
+	timed, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err := db.DB().PingContext(timed)
+	if err != nil {
+		msg := fmt.Sprintf("database unreachable: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return apierrors.Wrap(err, msg)
+	}
+
+	return nil
+}
+
+//the highest migration applied - see migrations/
+func GetSchemaVersion(ctx context.Context) (int64, error) {
+
+	var version sql.NullInt64
+	err := db.DB().Get(&version, "SELECT MAX(version) FROM schema_migrations")
+	if err != nil {
+		msg := fmt.Sprintf("schema version not found: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return 0, apierrors.Wrap(err, msg)
+	}
+
+	return version.Int64, nil
+}
+
+//connection pool stats
+func GetDatabaseStats() sql.DBStats {
+	return db.DB().Stats()
+}
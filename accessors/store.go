@@ -0,0 +1,71 @@
+package accessors
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/byuoitav/pi-designation-microservice/apierrors"
+	db "github.com/byuoitav/pi-designation-microservice/database"
+)
+
+//the definition tables that hold configuration someone made
+var configurationTables = []string{"class_definitions", "designation_definitions", "variable_definitions", "microservice_definitions"}
+
+//makes the database a mirror of the directory store at root, or refuses if it already holds configuration made through the API
+//a directory load replaces everything, so it must never be pointed at a database people have been editing
+func ClaimForDirectory(ctx context.Context, root string) error {
+
+	tx, err := db.DB().Beginx()
+	if err != nil {
+		msg := fmt.Sprintf("unable to start transaction: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return apierrors.Wrap(err, msg)
+	}
+	defer tx.Rollback()
+
+	var claimed string
+	err = tx.Get(&claimed, "SELECT root FROM directory_store WHERE id = 1 FOR UPDATE")
+	if err == nil {
+		return nil
+	}
+
+	if err != sql.ErrNoRows {
+		msg := fmt.Sprintf("unable to check who owns the database: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return apierrors.Wrap(err, msg)
+	}
+
+	for _, table := range configurationTables {
+
+		var count int
+		err = tx.Get(&count, fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE deletion_id IS NULL", table))
+		if err != nil {
+			msg := fmt.Sprintf("unable to count %s: %s", table, err.Error())
+			logger.Errorf(ctx, "%s", msg)
+			return apierrors.Wrap(err, msg)
+		}
+
+		if count > 0 {
+			msg := fmt.Sprintf("the database already holds configuration made through the API (%d in %s) - a directory store needs a database of its own", count, table)
+			return apierrors.Conflict("", msg)
+		}
+	}
+
+	_, err = tx.Exec("INSERT INTO directory_store (id, root) VALUES (1, ?)", root)
+	if err != nil {
+		msg := fmt.Sprintf("unable to claim the database: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return apierrors.Wrap(err, msg)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		msg := fmt.Sprintf("unable to claim the database: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return apierrors.Wrap(err, msg)
+	}
+
+	logger.Infof(ctx, "the database now mirrors %s", root)
+	return nil
+}
@@ -0,0 +1,112 @@
+package accessors
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"github.com/byuoitav/pi-designation-microservice/apierrors"
+	db "github.com/byuoitav/pi-designation-microservice/database"
+)
+
+//row in microservice_tags table - the image tag a microservice runs in a designation
+type ImageTag struct {
+	ID             int64  `json:"id" db:"id"`
+	MicroserviceID int64  `json:"microservice" db:"microservice_id"`
+	DesignationID  int64  `json:"designation" db:"designation_id"`
+	Tag            string `json:"tag" db:"tag"` //a tag like development, or a digest like sha256:...
+}
+
+//docker's rules for a tag, or a content digest
+var imageTagPattern = regexp.MustCompile(`^([a-zA-Z0-9_][a-zA-Z0-9_.-]{0,127}|sha256:[a-f0-9]{64})$`)
+
+//zero values match everything
+func GetImageTags(ctx context.Context, microserviceID, designationID int64) ([]ImageTag, error) {
+
+	logger.Debugf(ctx, "getting image tags for microservice %d, designation %d", microserviceID, designationID)
+
+	command := `SELECT microservice_tags.* FROM microservice_tags
+		JOIN microservice_definitions ON microservice_definitions.id = microservice_id AND microservice_definitions.deletion_id IS NULL
+		JOIN designation_definitions ON designation_definitions.id = designation_id AND designation_definitions.deletion_id IS NULL
+		WHERE (? = 0 OR microservice_id = ?) AND (? = 0 OR designation_id = ?) ORDER BY microservice_id, designation_id`
+
+	tags := []ImageTag{}
+	err := db.DB().Select(&tags, command, microserviceID, microserviceID, designationID, designationID)
+	if err != nil {
+		msg := fmt.Sprintf("image tags not found: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return []ImageTag{}, apierrors.Wrap(err, msg)
+	}
+
+	return tags, nil
+}
+
+//pinned tags in a designation, keyed by microservice ID
+func GetImageTagsByDesignation(ctx context.Context, designationID int64) (map[int64]string, error) {
+
+	tags, err := GetImageTags(ctx, 0, designationID)
+	if err != nil {
+		return map[int64]string{}, err
+	}
+
+	output := make(map[int64]string)
+	for _, tag := range tags {
+		output[tag.MicroserviceID] = tag.Tag
+	}
+
+	return output, nil
+}
+
+//pins the tag a microservice runs in each of the designations
+func SetImageTag(ctx context.Context, microserviceID int64, designationIDs []int64, tag string) error {
+
+	logger.Debugf(ctx, "setting image tag of microservice %d to %s in designations %v", microserviceID, tag, designationIDs)
+
+	if !imageTagPattern.MatchString(tag) {
+		msg := fmt.Sprintf("invalid tag '%s'", tag)
+		logger.Errorf(ctx, "%s", msg)
+		return apierrors.Invalid("tag", msg)
+	}
+
+	tx, err := db.DB().Beginx()
+	if err != nil {
+		msg := fmt.Sprintf("unable to start transaction: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return apierrors.Wrap(err, msg)
+	}
+	defer tx.Rollback()
+
+	for _, designationID := range designationIDs {
+
+		_, err = tx.Exec(`INSERT INTO microservice_tags (microservice_id, designation_id, tag) VALUES (?, ?, ?)
+			ON DUPLICATE KEY UPDATE tag = VALUES(tag)`, microserviceID, designationID, tag)
+		if err != nil {
+			msg := fmt.Sprintf("unable to set tag in designation %d: %s", designationID, err.Error())
+			logger.Errorf(ctx, "%s", msg)
+			return apierrors.Wrap(err, msg)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		msg := fmt.Sprintf("unable to commit tags: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return apierrors.Wrap(err, msg)
+	}
+
+	return nil
+}
+
+func DeleteImageTag(ctx context.Context, microserviceID, designationID int64) error {
+
+	logger.Debugf(ctx, "unpinning image tag of microservice %d in designation %d", microserviceID, designationID)
+
+	_, err := db.DB().Exec("DELETE FROM microservice_tags WHERE microservice_id = ? AND designation_id = ?", microserviceID, designationID)
+	if err != nil {
+		msg := fmt.Sprintf("unable to delete tag: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return apierrors.Wrap(err, msg)
+	}
+
+	return nil
+}
@@ -0,0 +1,124 @@
+package accessors
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/byuoitav/pi-designation-microservice/apierrors"
+	"github.com/jmoiron/sqlx"
+)
+
+//what a microservice's YAML can use as a text/template, e.g. {{.Variables.ROOM_SYSTEM}} or {{.Device}}
+type TemplateContext struct {
+	Class       string
+	Designation string
+	Variables   map[string]string
+	Room        string
+	Device      string
+}
+
+func IsTemplate(yaml string) bool {
+	return strings.Contains(yaml, "{{")
+}
+
+//same values as the variables file
+func (templateContext *TemplateContext) SetVariable(name, value string) {
+	templateContext.Variables[name] = strings.Trim(value, "\"")
+}
+
+//executes a YAML snippet as a template - a variable that isn't mapped fails the render rather than coming out empty
+//the check when a mapping is written renders the same way, so nothing gets in that serving would refuse
+func RenderTemplate(name, yaml string, templateContext TemplateContext) (string, error) {
+
+	if !IsTemplate(yaml) {
+		return yaml, nil
+	}
+
+	parsed, err := template.New(name).Option("missingkey=error").Parse(yaml)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("invalid template for %s: %s", name, err.Error()))
+	}
+
+	var output bytes.Buffer
+	err = parsed.Execute(&output, templateContext)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("unable to render template for %s: %s", name, err.Error()))
+	}
+
+	return output.String(), nil
+}
+
+//test-renders a hand-written snippet for a class/designation, so a broken template never makes it into the database
+func CheckTemplate(microservice Microservice, yaml string, templateContext TemplateContext) error {
+
+	_, err := RenderTemplate(microservice.Name, yaml, templateContext)
+	if err != nil {
+		return apierrors.Invalid("yaml", err.Error())
+	}
+
+	return nil
+}
+
+//makes sure a spec mapping's overrides still make a service we can render
+func CheckOverrides(microservice Microservice, overrides MicroserviceSpec) error {
+
+	_, err := MicroserviceYAML(DBMicroservice{Overrides: overrides}, microservice, "")
+	if err != nil {
+		return apierrors.Invalid("overrides", err.Error())
+	}
+
+	return nil
+}
+
+//whichever of the two checks a mapping needs - YAML wins over overrides, like it does when it's rendered
+func CheckMicroserviceMapping(microservice Microservice, yaml string, overrides MicroserviceSpec, templateContext TemplateContext) error {
+
+	if len(strings.TrimSpace(yaml)) > 0 {
+		return CheckTemplate(microservice, yaml, templateContext)
+	}
+
+	return CheckOverrides(microservice, overrides)
+}
+
+//what a class/designation's templates see as queryer has it, so a transaction can check templates against what it's about to commit
+//Room and Device are left empty - they're only known for a particular pi
+func loadTemplateContext(queryer sqlx.Queryer, classID, desigID int64) (TemplateContext, error) {
+
+	templateContext := TemplateContext{Variables: make(map[string]string)}
+
+	err := sqlx.Get(queryer, &templateContext.Class, "SELECT name FROM class_definitions WHERE id = ?", classID)
+	if err != nil {
+		return templateContext, errors.New(fmt.Sprintf("class %d not found: %s", classID, err.Error()))
+	}
+
+	err = sqlx.Get(queryer, &templateContext.Designation, "SELECT name FROM designation_definitions WHERE id = ?", desigID)
+	if err != nil {
+		return templateContext, errors.New(fmt.Sprintf("designation %d not found: %s", desigID, err.Error()))
+	}
+
+	//mapped values, then defaults for everything that isn't mapped - like GetVariablesByClassAndDesignation
+	command := `SELECT v.name, m.value FROM variable_mappings m
+		JOIN variable_definitions v ON v.id = m.variable_id
+		WHERE m.class_id = ? AND m.designation_id = ? AND m.deletion_id IS NULL
+		UNION ALL
+		SELECT name, default_value FROM variable_definitions WHERE default_value IS NOT NULL AND deletion_id IS NULL
+		AND id NOT IN (SELECT variable_id FROM variable_mappings WHERE class_id = ? AND designation_id = ? AND deletion_id IS NULL)`
+
+	var variables []struct {
+		Name  string `db:"name"`
+		Value string `db:"value"`
+	}
+	err = sqlx.Select(queryer, &variables, command, classID, desigID, classID, desigID)
+	if err != nil {
+		return templateContext, errors.New(fmt.Sprintf("variables not found: %s", err.Error()))
+	}
+
+	for _, variable := range variables {
+		templateContext.SetVariable(variable.Name, variable.Value)
+	}
+
+	return templateContext, nil
+}
@@ -0,0 +1,394 @@
+package accessors
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/byuoitav/pi-designation-microservice/apierrors"
+	db "github.com/byuoitav/pi-designation-microservice/database"
+	"github.com/jmoiron/sqlx"
+)
+
+//how long deletions stay in the trash before they're purged
+const DEFAULT_TRASH_DAYS = 30
+
+//one delete of a definition or mapping - everything it hid points back at it
+type Deletion struct {
+	ID        int64     `json:"id" db:"id"`
+	Table     string    `json:"table" db:"table_name"`
+	RowID     int64     `json:"row-id" db:"row_id"` //the definition or mapping that was deleted
+	Name      string    `json:"name" db:"name"`
+	Rows      int       `json:"rows" db:"row_count"` //the row itself and everything deleted along with it
+	DeletedAt time.Time `json:"deleted-at" db:"deleted_at"`
+	PurgeAt   time.Time `json:"purge-at" db:"-"`
+}
+
+//a deletion and every row it hid
+type DeletionContents struct {
+	Deletion
+	Contents []Dependent `json:"contents"`
+}
+
+//a column of a mapping table that points at a definition
+type reference struct {
+	table  string
+	column string
+}
+
+//the mappings that go into the trash along with each kind of definition
+var cascades = map[string][]reference{
+	"class_definitions":        {{"variable_mappings", "class_id"}, {"microservice_mappings", "class_id"}},
+	"designation_definitions":  {{"variable_mappings", "designation_id"}, {"microservice_mappings", "designation_id"}},
+	"variable_definitions":     {{"variable_mappings", "variable_id"}},
+	"microservice_definitions": {{"microservice_mappings", "microservice_id"}},
+}
+
+//the definition table each mapping column points at
+var referencedTables = map[string]string{
+	"class_id":        "class_definitions",
+	"designation_id":  "designation_definitions",
+	"variable_id":     "variable_definitions",
+	"microservice_id": "microservice_definitions",
+}
+
+//what to call a mapping - the query takes a condition
+var mappingSummaries = map[string]string{
+	"variable_mappings":     variableMappingDependents,
+	"microservice_mappings": microserviceMappingDependents,
+}
+
+//every table that can have rows in the trash, with a query for the rows of one deletion
+//definitions come first so their mappings have something to come back to
+var trashed = []dependency{
+	{"class_definitions", "SELECT id, name AS summary FROM class_definitions WHERE deletion_id = ? ORDER BY id"},
+	{"designation_definitions", "SELECT id, name AS summary FROM designation_definitions WHERE deletion_id = ? ORDER BY id"},
+	{"variable_definitions", "SELECT id, name AS summary FROM variable_definitions WHERE deletion_id = ? ORDER BY id"},
+	{"microservice_definitions", "SELECT id, name AS summary FROM microservice_definitions WHERE deletion_id = ? ORDER BY id"},
+	{"variable_mappings", fmt.Sprintf(variableMappingDependents, "m.deletion_id = ?")},
+	{"microservice_mappings", fmt.Sprintf(microserviceMappingDependents, "m.deletion_id = ?")},
+}
+
+//mappings of a deletion whose class, designation or definition is in the trash under a different deletion
+const orphaned = "m.deletion_id = ? AND (c.deletion_id <> m.deletion_id OR d.deletion_id <> m.deletion_id OR x.deletion_id <> m.deletion_id)"
+
+var orphans = []dependency{
+	{"variable_mappings", fmt.Sprintf(variableMappingDependents, orphaned)},
+	{"microservice_mappings", fmt.Sprintf(microserviceMappingDependents, orphaned)},
+}
+
+var trashOnce sync.Once
+var trashDays int
+
+//override with DESIGNATION_TRASH_DAYS
+func TrashDays() int {
+	trashOnce.Do(func() {
+		trashDays = DEFAULT_TRASH_DAYS
+
+		days := os.Getenv("DESIGNATION_TRASH_DAYS")
+		if len(days) == 0 {
+			return
+		}
+
+		parsed, err := strconv.Atoi(days)
+		if err != nil || parsed < 1 {
+			logger.Warnf(context.Background(), "invalid DESIGNATION_TRASH_DAYS %s - keeping deletions for %d days", days, DEFAULT_TRASH_DAYS)
+			return
+		}
+
+		trashDays = parsed
+	})
+
+	return trashDays
+}
+
+//selects deletions as d, counting the rows each one hid
+func selectDeletions() string {
+
+	var counts []string
+	for _, table := range trashed {
+		counts = append(counts, fmt.Sprintf("(SELECT COUNT(*) FROM %s WHERE deletion_id = d.id)", table.table))
+	}
+
+	return fmt.Sprintf("SELECT d.id, d.table_name, d.row_id, d.name, d.deleted_at, %s AS row_count FROM deletions d", strings.Join(counts, " + "))
+}
+
+//moves a definition or mapping into the trash under a new deletion
+func trash(ctx context.Context, tx *sqlx.Tx, table string, id int64, name string) (int64, error) {
+
+	result, err := tx.Exec("INSERT INTO deletions (table_name, row_id, name) VALUES (?, ?, ?)", table, id, name)
+	if err != nil {
+		msg := fmt.Sprintf("unable to record deletion: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return 0, apierrors.Wrap(err, msg)
+	}
+
+	deletionID, err := result.LastInsertId()
+	if err != nil {
+		msg := fmt.Sprintf("last inserted ID not found: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return 0, apierrors.Wrap(err, msg)
+	}
+
+	command := fmt.Sprintf("UPDATE %s SET deletion_id = ?, alive = NULL WHERE id = ? AND deletion_id IS NULL", table)
+
+	result, err = tx.Exec(command, deletionID, id)
+	if err != nil {
+		msg := fmt.Sprintf("unable to delete %d from %s: %s", id, table, err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return 0, apierrors.Wrap(err, msg)
+	}
+
+	numRows, err := result.RowsAffected()
+	if err != nil {
+		msg := fmt.Sprintf("number of rows not found: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return 0, apierrors.Wrap(err, msg)
+	}
+
+	if numRows < 1 {
+		return 0, apierrors.NotFound("invalid delete")
+	}
+
+	return deletionID, nil
+}
+
+func getDeletion(ctx context.Context, queryer sqlx.Queryer, id int64, lock bool) (Deletion, error) {
+
+	var deletion Deletion
+
+	command := selectDeletions() + " WHERE d.id = ?"
+	if lock {
+		command += " FOR UPDATE"
+	}
+
+	err := sqlx.Get(queryer, &deletion, command, id)
+	if err == sql.ErrNoRows {
+		return deletion, apierrors.NotFound(fmt.Sprintf("deletion %d not found", id))
+	}
+
+	if err != nil {
+		msg := fmt.Sprintf("deletion not found: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return deletion, apierrors.Wrap(err, msg)
+	}
+
+	deletion.PurgeAt = deletion.DeletedAt.AddDate(0, 0, TrashDays())
+	return deletion, nil
+}
+
+//newest first
+func ListDeletions(ctx context.Context) ([]Deletion, error) {
+
+	logger.Debugf(ctx, "listing the trash")
+
+	deletions := []Deletion{}
+
+	err := db.DB().Select(&deletions, selectDeletions()+" ORDER BY d.deleted_at DESC, d.id DESC")
+	if err != nil {
+		msg := fmt.Sprintf("unable to list deletions: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return deletions, apierrors.Wrap(err, msg)
+	}
+
+	for i := range deletions {
+		deletions[i].PurgeAt = deletions[i].DeletedAt.AddDate(0, 0, TrashDays())
+	}
+
+	return deletions, nil
+}
+
+func GetDeletion(ctx context.Context, id int64) (DeletionContents, error) {
+
+	logger.Debugf(ctx, "getting contents of deletion %d", id)
+
+	deletion, err := getDeletion(ctx, db.DB(), id, false)
+	if err != nil {
+		return DeletionContents{}, err
+	}
+
+	output := DeletionContents{Deletion: deletion, Contents: []Dependent{}}
+
+	for _, table := range trashed {
+
+		var rows []DependentItem
+		err = db.DB().Select(&rows, table.command, id)
+		if err != nil {
+			msg := fmt.Sprintf("unable to get deleted rows of %s: %s", table.table, err.Error())
+			logger.Errorf(ctx, "%s", msg)
+			return output, apierrors.Wrap(err, msg)
+		}
+
+		if len(rows) > 0 {
+			output.Contents = append(output.Contents, Dependent{Table: table.table, Rows: rows})
+		}
+	}
+
+	return output, nil
+}
+
+//puts back everything a deletion hid
+//refused if a mapping would come back to a class, designation or definition that's still in the trash, or if a name has since been taken
+func RestoreDeletion(ctx context.Context, id int64) (Deletion, error) {
+
+	logger.Debugf(ctx, "restoring deletion %d", id)
+
+	tx, err := db.DB().Beginx()
+	if err != nil {
+		msg := fmt.Sprintf("unable to start transaction: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return Deletion{}, apierrors.Wrap(err, msg)
+	}
+	defer tx.Rollback()
+
+	deletion, err := getDeletion(ctx, tx, id, true)
+	if err != nil {
+		return deletion, err
+	}
+
+	//whatever it hid was purged along with some other deletion
+	if deletion.Rows == 0 {
+
+		_, err = tx.Exec("DELETE FROM deletions WHERE id = ?", id)
+		if err == nil {
+			err = tx.Commit()
+		}
+
+		if err != nil {
+			msg := fmt.Sprintf("unable to remove empty deletion: %s", err.Error())
+			logger.Errorf(ctx, "%s", msg)
+			return deletion, apierrors.Wrap(err, msg)
+		}
+
+		return deletion, apierrors.NotFound(fmt.Sprintf("nothing is left of deletion %d to restore", id))
+	}
+
+	var blocked []Dependent
+	for _, table := range orphans {
+
+		var rows []DependentItem
+		err = sqlx.Select(tx, &rows, table.command, id)
+		if err != nil {
+			msg := fmt.Sprintf("unable to check mappings of %s: %s", table.table, err.Error())
+			logger.Errorf(ctx, "%s", msg)
+			return deletion, apierrors.Wrap(err, msg)
+		}
+
+		if len(rows) > 0 {
+			blocked = append(blocked, Dependent{Table: table.table, Rows: rows})
+		}
+	}
+
+	if len(blocked) > 0 {
+		msg := fmt.Sprintf("%s refers to things that were deleted separately - restore those first", deletion.Name)
+		logger.Warnf(ctx, "%s", msg)
+
+		e := apierrors.Conflict("id", msg)
+		e.Details = blocked
+		return deletion, e
+	}
+
+	for _, table := range trashed {
+
+		_, err = tx.Exec(fmt.Sprintf("UPDATE %s SET deletion_id = NULL, alive = 1 WHERE deletion_id = ?", table.table), id)
+		if err != nil {
+			msg := fmt.Sprintf("unable to restore rows of %s: %s", table.table, err.Error())
+			logger.Errorf(ctx, "%s", msg)
+			return deletion, apierrors.Wrap(err, msg)
+		}
+	}
+
+	_, err = tx.Exec("DELETE FROM deletions WHERE id = ?", id)
+	if err != nil {
+		msg := fmt.Sprintf("unable to remove deletion: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return deletion, apierrors.Wrap(err, msg)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		msg := fmt.Sprintf("unable to commit restore: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return deletion, apierrors.Wrap(err, msg)
+	}
+
+	return deletion, nil
+}
+
+//removes everything a deletion hid for good - the foreign keys take care of the rows
+func PurgeDeletion(ctx context.Context, id int64) error {
+
+	logger.Debugf(ctx, "purging deletion %d", id)
+
+	result, err := db.DB().Exec("DELETE FROM deletions WHERE id = ?", id)
+	if err != nil {
+		msg := fmt.Sprintf("unable to purge deletion: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return apierrors.Wrap(err, msg)
+	}
+
+	numRows, err := result.RowsAffected()
+	if err != nil {
+		msg := fmt.Sprintf("number of rows not found: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return apierrors.Wrap(err, msg)
+	}
+
+	if numRows < 1 {
+		return apierrors.NotFound(fmt.Sprintf("deletion %d not found", id))
+	}
+
+	return nil
+}
+
+//purges every deletion older than TrashDays - returns how many there were
+func PurgeExpiredDeletions(ctx context.Context) (int64, error) {
+
+	result, err := db.DB().Exec("DELETE FROM deletions WHERE deleted_at < NOW() - INTERVAL ? DAY", TrashDays())
+	if err != nil {
+		msg := fmt.Sprintf("unable to purge the trash: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return 0, apierrors.Wrap(err, msg)
+	}
+
+	return result.RowsAffected()
+}
+
+//mappings can't point at anything in the trash - the foreign keys would still let them
+func checkReferences(ctx context.Context, definitionColumn string, definitionID, classID, designationID int64) error {
+
+	references := []struct {
+		column string
+		id     int64
+	}{
+		{"class_id", classID},
+		{"designation_id", designationID},
+		{definitionColumn, definitionID},
+	}
+
+	for _, reference := range references {
+
+		var deleted int
+		command := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE id = ? AND deletion_id IS NOT NULL", referencedTables[reference.column])
+
+		err := db.DB().Get(&deleted, command, reference.id)
+		if err != nil {
+			msg := fmt.Sprintf("unable to check %s: %s", reference.column, err.Error())
+			logger.Errorf(ctx, "%s", msg)
+			return apierrors.Wrap(err, msg)
+		}
+
+		if deleted > 0 {
+			msg := fmt.Sprintf("%s %d is in the trash", reference.column, reference.id)
+			logger.Warnf(ctx, "%s", msg)
+			return apierrors.InvalidReference(reference.column, msg)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,131 @@
+package accessors
+
+import (
+	"fmt"
+	"github.com/byuoitav/pi-designation-microservice/apierrors"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	STRING_TYPE   = "string"
+	INT_TYPE      = "int"
+	BOOL_TYPE     = "bool"
+	URL_TYPE      = "url"
+	HOSTNAME_TYPE = "hostname"
+	PORT_TYPE     = "port"
+	ENUM_TYPE     = "enum"
+	REGEX_TYPE    = "regex"
+)
+
+var VariableTypes = []string{STRING_TYPE, INT_TYPE, BOOL_TYPE, URL_TYPE, HOSTNAME_TYPE, PORT_TYPE, ENUM_TYPE, REGEX_TYPE}
+
+//matches variable_mappings.value
+const MAX_VALUE_LENGTH = 80
+
+//RFC 1123 labels joined by dots
+var hostnamePattern = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)(\.[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$`)
+
+//makes sure a definition's type is one we know and its validation makes sense for that type
+func ValidateVariableDefinition(variable *Variable) error {
+
+	if len(variable.Type) == 0 {
+		variable.Type = STRING_TYPE
+	}
+
+	switch variable.Type {
+	case ENUM_TYPE:
+		if len(enumValues(variable.Validation)) == 0 {
+			return apierrors.Invalid("validation", "enum variables need a comma-separated list of values")
+		}
+	case REGEX_TYPE:
+		if len(variable.Validation) == 0 {
+			return apierrors.Invalid("validation", "regex variables need a pattern")
+		}
+
+		_, err := regexp.Compile(variable.Validation)
+		if err != nil {
+			return apierrors.Invalid("validation", fmt.Sprintf("invalid pattern: %s", err.Error()))
+		}
+	case STRING_TYPE, INT_TYPE, BOOL_TYPE, URL_TYPE, HOSTNAME_TYPE, PORT_TYPE:
+		if len(variable.Validation) > 0 {
+			return apierrors.Invalid("validation", fmt.Sprintf("%s variables don't take a validation", variable.Type))
+		}
+	default:
+		return apierrors.Invalid("type", fmt.Sprintf("invalid type '%s', expected one of %s", variable.Type, strings.Join(VariableTypes, ", ")))
+	}
+
+	if variable.Default != nil {
+		err := ValidateVariableValue(variable, *variable.Default)
+		if err != nil {
+			return apierrors.Invalid("default", fmt.Sprintf("invalid default: %s", err.Error()))
+		}
+	}
+
+	return nil
+}
+
+//checks a value against the type its variable declares
+func ValidateVariableValue(variable *Variable, value string) error {
+
+	if len(value) > MAX_VALUE_LENGTH {
+		return apierrors.Invalid("value", fmt.Sprintf("value for %s is longer than %d characters", variable.Name, MAX_VALUE_LENGTH))
+	}
+
+	valid := true
+
+	switch variable.Type {
+	case INT_TYPE:
+		_, err := strconv.Atoi(value)
+		valid = err == nil
+	case BOOL_TYPE:
+		valid = value == "true" || value == "false"
+	case URL_TYPE:
+		parsed, err := url.Parse(value)
+		valid = err == nil && len(parsed.Scheme) > 0 && len(parsed.Host) > 0
+	case HOSTNAME_TYPE:
+		valid = len(value) <= 253 && hostnamePattern.MatchString(value)
+	case PORT_TYPE:
+		port, err := strconv.Atoi(value)
+		valid = err == nil && port > 0 && port <= 65535
+	case ENUM_TYPE:
+		valid = false
+		for _, allowed := range enumValues(variable.Validation) {
+			if value == allowed {
+				valid = true
+				break
+			}
+		}
+	case REGEX_TYPE:
+		//anchored so the whole value has to match, not just part of it
+		pattern, err := regexp.Compile("^(?:" + variable.Validation + ")$")
+		valid = err == nil && pattern.MatchString(value)
+	}
+
+	if !valid {
+		expected := variable.Type
+		if len(variable.Validation) > 0 {
+			expected = fmt.Sprintf("%s (%s)", variable.Type, variable.Validation)
+		}
+
+		return apierrors.Invalid("value", fmt.Sprintf("invalid value '%s' for %s: expected %s", value, variable.Name, expected))
+	}
+
+	return nil
+}
+
+func enumValues(validation string) []string {
+
+	var values []string
+	for _, value := range strings.Split(validation, ",") {
+
+		value = strings.TrimSpace(value)
+		if len(value) > 0 {
+			values = append(values, value)
+		}
+	}
+
+	return values
+}
@@ -1,27 +1,32 @@
 package accessors
 
 import (
-	"errors"
+	"context"
 	"fmt"
-	"log"
 
+	"github.com/byuoitav/pi-designation-microservice/apierrors"
 	db "github.com/byuoitav/pi-designation-microservice/database"
-	"github.com/fatih/color"
 )
 
-func GetVariableMappingsById(IDs []int64) ([]VariableMapping, error) {
+//everything in a variable definition
+const VARIABLE_COLUMNS = "id, name, description, type, validation, default_value, secret, version"
 
-	log.Printf("[accessors] getting microservice entries...")
+//everything in a variable mapping
+const VARIABLE_MAPPING_COLUMNS = "id, class_id, designation_id, variable_id, value, version"
+
+func GetVariableMappingsById(ctx context.Context, IDs []int64) ([]VariableMapping, error) {
+
+	logger.Debugf(ctx, "getting microservice entries...")
 
 	var output []VariableMapping
 	for _, id := range IDs {
 
 		var mapping VariableMapping
-		err := GetVariableMappingById(id, &mapping)
+		err := GetVariableMappingById(ctx, id, &mapping)
 		if err != nil {
 			msg := fmt.Sprintf("entry not found: %s", err.Error())
-			log.Printf("%s", color.HiRedString("[accessors] %s", msg))
-			return []VariableMapping{}, errors.New(msg)
+			logger.Errorf(ctx, "%s", msg)
+			return []VariableMapping{}, apierrors.Wrap(err, msg)
 		}
 
 		output = append(output, mapping)
@@ -30,16 +35,34 @@ func GetVariableMappingsById(IDs []int64) ([]VariableMapping, error) {
 	return output, nil
 }
 
-func GetAllVariableMappings() ([]VariableMapping, error) {
+//returns the cursor of the next page, or an empty string on the last one
+func GetAllVariableMappings(ctx context.Context, query ListQuery) ([]VariableMapping, string, error) {
 
-	log.Printf("[accessors] getting all variable mappings...")
+	logger.Debugf(ctx, "getting all variable mappings...")
 
-	var mappings []DBVariable
-	err := db.DB().Select(&mappings, "SELECT * FROM variable_mappings")
+	listing := mappingListing("variable_mappings", "variable", "variable_definitions", "variable_id")
+	cmd, args, err := listing.build(qualify("t", VARIABLE_MAPPING_COLUMNS), query)
+	if err != nil {
+		return []VariableMapping{}, "", err
+	}
+
+	var mappings []struct {
+		DBVariable
+		SortKey string `db:"sort_key"`
+	}
+
+	err = db.DB().Select(&mappings, cmd, args...)
 	if err != nil {
 		msg := fmt.Sprintf("mappings not found: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[accessors] %s", msg))
-		return []VariableMapping{}, errors.New(msg)
+		logger.Errorf(ctx, "%s", msg)
+		return []VariableMapping{}, "", apierrors.Wrap(err, msg)
+	}
+
+	var next string
+	if query.more(len(mappings)) {
+		mappings = mappings[:query.Limit]
+		last := mappings[len(mappings)-1]
+		next = query.next(last.SortKey, last.ID)
 	}
 
 	var output []VariableMapping
@@ -47,74 +70,75 @@ func GetAllVariableMappings() ([]VariableMapping, error) {
 	for _, mapping := range mappings {
 
 		var variable VariableMapping
-		err = FillVariableMapping(&mapping, &variable)
+		err = FillVariableMapping(ctx, &mapping.DBVariable, &variable)
 		if err != nil {
 			msg := fmt.Sprintf("variable not found: %s", err.Error())
-			log.Printf("%s", color.HiRedString("[accessors] %s", msg))
-			return []VariableMapping{}, errors.New(msg)
+			logger.Errorf(ctx, "%s", msg)
+			return []VariableMapping{}, "", apierrors.Wrap(err, msg)
 		}
 
 		output = append(output, variable)
 	}
 
-	return output, nil
+	return output, next, nil
 }
 
-func GetVariableMappingById(entryID int64, variable *VariableMapping) error {
+func GetVariableMappingById(ctx context.Context, entryID int64, variable *VariableMapping) error {
 
-	log.Printf("[accessors] getting variable entry with ID %d...", entryID)
+	logger.Debugf(ctx, "getting variable entry with ID %d...", entryID)
 
 	//get the IDs
 	var mapping DBVariable
-	err := db.DB().Get(&mapping, "SELECT * FROM variable_mappings WHERE id = ?", entryID)
+	err := db.DB().Get(&mapping, "SELECT "+VARIABLE_MAPPING_COLUMNS+" FROM variable_mappings WHERE id = ? AND deletion_id IS NULL", entryID)
 	if err != nil {
 		msg := fmt.Sprintf("failed to execute query: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[accessors] %s", msg))
-		return errors.New(msg)
+		logger.Errorf(ctx, "%s", msg)
+		return apierrors.Wrap(err, msg)
 	}
 
-	err = FillVariableMapping(&mapping, variable)
+	err = FillVariableMapping(ctx, &mapping, variable)
 	if err != nil {
 		msg := fmt.Sprintf("failed to execute query: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[accessors] %s", msg))
-		return errors.New(msg)
+		logger.Errorf(ctx, "%s", msg)
+		return apierrors.Wrap(err, msg)
 	}
 
 	return nil
 }
 
-func FillVariableMapping(entry *DBVariable, mapping *VariableMapping) error {
+func FillVariableMapping(ctx context.Context, entry *DBVariable, mapping *VariableMapping) error {
 
-	class, desig, err := GetClassAndDesignation(entry.ClassID, entry.DesigID)
+	class, desig, err := GetClassAndDesignation(ctx, entry.ClassID, entry.DesigID)
 	if err != nil {
 		msg := fmt.Sprintf("entry not found: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[accessors] %s", msg))
-		return errors.New(msg)
+		logger.Errorf(ctx, "%s", msg)
+		return apierrors.Wrap(err, msg)
 	}
 
 	var variable Variable
-	err = db.DB().Get(&variable, "SELECT * from variable_definitions WHERE id = ?", entry.VarID)
+	err = db.DB().Get(&variable, "SELECT "+VARIABLE_COLUMNS+" FROM variable_definitions WHERE id = ?", entry.VarID)
 	if err != nil {
 		msg := fmt.Sprintf("entry not found: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[accessors] %s", msg))
-		return errors.New(msg)
+		logger.Errorf(ctx, "%s", msg)
+		return apierrors.Wrap(err, msg)
 	}
 
 	mapping.Variable = variable
 	mapping.Value = entry.Value
 	mapping.ID = entry.ID
+	mapping.Version = entry.Version
 	mapping.Class = class
 	mapping.Designation = desig
 
 	return nil
 }
 
-func GetVariablesByClassAndDesignation(classId, desigId int64) ([]VariableMapping, error) {
+func GetVariablesByClassAndDesignation(ctx context.Context, classId, desigId int64) ([]VariableMapping, error) {
 
-	log.Printf("[accessors] querying database for variable mappings with class ID %d and designation ID %d", classId, desigId)
+	logger.Debugf(ctx, "querying database for variable mappings with class ID %d and designation ID %d", classId, desigId)
 
 	var preMappings []DBVariable
-	err := db.DB().Select(&preMappings, "SELECT * FROM variable_mappings WHERE designation_id = ? AND class_id = ?", desigId, classId)
+	err := db.DB().Select(&preMappings, "SELECT "+VARIABLE_MAPPING_COLUMNS+" FROM variable_mappings WHERE designation_id = ? AND class_id = ? AND deletion_id IS NULL", desigId, classId)
 	if err != nil {
 		return []VariableMapping{}, err
 	}
@@ -123,7 +147,7 @@ func GetVariablesByClassAndDesignation(classId, desigId int64) ([]VariableMappin
 	for _, mapping := range preMappings {
 
 		var variable VariableMapping
-		err = FillVariableMapping(&mapping, &variable)
+		err = FillVariableMapping(ctx, &mapping, &variable)
 		if err != nil {
 			return []VariableMapping{}, err
 		}
@@ -131,5 +155,263 @@ func GetVariablesByClassAndDesignation(classId, desigId int64) ([]VariableMappin
 		output = append(output, variable)
 	}
 
+	defaults, err := GetDefaultVariables(ctx, classId, desigId)
+	if err != nil {
+		return []VariableMapping{}, err
+	}
+
+	return append(output, defaults...), nil
+}
+
+//variables with a default that aren't mapped in this class/designation
+func GetDefaultVariables(ctx context.Context, classId, desigId int64) ([]VariableMapping, error) {
+
+	command := "SELECT " + VARIABLE_COLUMNS + ` FROM variable_definitions WHERE default_value IS NOT NULL AND deletion_id IS NULL
+		AND id NOT IN (SELECT variable_id FROM variable_mappings WHERE designation_id = ? AND class_id = ? AND deletion_id IS NULL) ORDER BY name`
+
+	var variables []Variable
+	err := db.DB().Select(&variables, command, desigId, classId)
+	if err != nil {
+		return []VariableMapping{}, err
+	}
+
+	if len(variables) == 0 {
+		return []VariableMapping{}, nil
+	}
+
+	class, desig, err := GetClassAndDesignation(ctx, classId, desigId)
+	if err != nil {
+		return []VariableMapping{}, err
+	}
+
+	var output []VariableMapping
+	for _, variable := range variables {
+
+		mapping := VariableMapping{
+			Variable: variable,
+			Value:    *variable.Default,
+			Default:  true,
+		}
+		mapping.Class = class
+		mapping.Designation = desig
+
+		output = append(output, mapping)
+	}
+
 	return output, nil
 }
+
+func AddVariableDefinition(ctx context.Context, variable *Variable) error {
+
+	logger.Debugf(ctx, "adding variable definition...")
+
+	if len(variable.Name) == 0 {
+		msg := "invalid definition name"
+		logger.Errorf(ctx, "%s", msg)
+		return apierrors.Invalid("name", msg)
+	}
+
+	err := ValidateVariableDefinition(variable)
+	if err != nil {
+		logger.Errorf(ctx, "%s", err.Error())
+		return err
+	}
+
+	result, err := db.DB().Exec("INSERT INTO variable_definitions (name, description, type, validation, default_value, secret) VALUES (?, ?, ?, ?, ?, ?)",
+		variable.Name, variable.Description, variable.Type, variable.Validation, variable.Default, variable.Secret)
+	if err != nil {
+		msg := fmt.Sprintf("definition not added: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return apierrors.Wrap(err, msg)
+	}
+
+	variable.ID, err = result.LastInsertId()
+	if err != nil {
+		msg := fmt.Sprintf("id not found: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return apierrors.Wrap(err, msg)
+	}
+
+	//new rows start at version 1
+	variable.Version = 1
+
+	return nil
+}
+
+//refuses to change a variable's type if values already mapped to it wouldn't fit the new one
+//variable.Version works like it does for EditDefinition
+func EditVariableDefinition(ctx context.Context, variable *Variable) error {
+
+	logger.Debugf(ctx, "updating variable definition %d...", variable.ID)
+
+	if len(variable.Name) == 0 {
+		msg := "invalid definition name"
+		logger.Errorf(ctx, "%s", msg)
+		return apierrors.Invalid("name", msg)
+	}
+
+	if len(variable.Description) == 0 {
+		msg := "invalid description"
+		logger.Errorf(ctx, "%s", msg)
+		return apierrors.Invalid("description", msg)
+	}
+
+	err := ValidateVariableDefinition(variable)
+	if err != nil {
+		logger.Errorf(ctx, "%s", err.Error())
+		return err
+	}
+
+	var values []string
+	err = db.DB().Select(&values, "SELECT value FROM variable_mappings WHERE variable_id = ? AND deletion_id IS NULL", variable.ID)
+	if err != nil {
+		msg := fmt.Sprintf("unable to check existing values: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return apierrors.Wrap(err, msg)
+	}
+
+	for _, value := range values {
+
+		err = ValidateVariableValue(variable, value)
+		if err != nil {
+			msg := fmt.Sprintf("existing mapping doesn't fit new type: %s", err.Error())
+			logger.Errorf(ctx, "%s", msg)
+			return apierrors.Wrap(err, msg)
+		}
+	}
+
+	result, err := db.DB().Exec("UPDATE variable_definitions SET name = ?, description = ?, type = ?, validation = ?, default_value = ?, secret = ?, "+VERSION_BUMP+" WHERE id = ? AND deletion_id IS NULL AND "+VERSION_CLAUSE,
+		variable.Name, variable.Description, variable.Type, variable.Validation, variable.Default, variable.Secret, variable.ID, variable.Version, variable.Version)
+	if err != nil {
+		msg := fmt.Sprintf("unable to update variable: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return apierrors.Wrap(err, msg)
+	}
+
+	variable.Version, err = checkEdit(ctx, result, "variable_definitions", variable.ID, variable.Version)
+	return err
+}
+
+func GetVariableDefinitionById(ctx context.Context, id int64, variable *Variable) error {
+
+	logger.Debugf(ctx, "fetching variable definition with id %d", id)
+
+	err := db.DB().Get(variable, "SELECT "+VARIABLE_COLUMNS+" FROM variable_definitions WHERE id = ? AND deletion_id IS NULL", id)
+	if err != nil {
+		msg := fmt.Sprintf("definition not found: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return apierrors.Wrap(err, msg)
+	}
+
+	return nil
+}
+
+//returns the cursor of the next page, or an empty string on the last one
+func GetAllVariableDefinitions(ctx context.Context, query ListQuery) ([]Variable, string, error) {
+
+	logger.Debugf(ctx, "getting all variable definitions...")
+
+	listing := definitionListing("variable_definitions")
+	cmd, args, err := listing.build(VARIABLE_COLUMNS, query)
+	if err != nil {
+		return []Variable{}, "", err
+	}
+
+	var rows []struct {
+		Variable
+		SortKey string `db:"sort_key"`
+	}
+
+	err = db.DB().Select(&rows, cmd, args...)
+	if err != nil {
+		msg := fmt.Sprintf("definitions not found: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return []Variable{}, "", apierrors.Wrap(err, msg)
+	}
+
+	var next string
+	if query.more(len(rows)) {
+		rows = rows[:query.Limit]
+		last := rows[len(rows)-1]
+		next = query.next(last.SortKey, last.ID)
+	}
+
+	var variables []Variable
+	for _, row := range rows {
+		variables = append(variables, row.Variable)
+	}
+
+	return variables, next, nil
+}
+
+//checks a value against the type of the variable it's being mapped to
+func ValidateVariableMapping(ctx context.Context, variableID int64, value string) error {
+
+	var variable Variable
+	err := GetVariableDefinitionById(ctx, variableID, &variable)
+	if err != nil {
+		return err
+	}
+
+	return ValidateVariableValue(&variable, value)
+}
+
+//more than one mapping for the same variable in the same class/designation
+type VariableConflict struct {
+	Mappings []VariableMapping `json:"mappings"`
+}
+
+//IDs of the mappings that already give this variable a value in this class/designation
+func GetVariableMappingIdsInScope(ctx context.Context, variableID, classID, desigID int64) ([]int64, error) {
+
+	var ids []int64
+	err := db.DB().Select(&ids, "SELECT id FROM variable_mappings WHERE variable_id = ? AND class_id = ? AND designation_id = ? AND deletion_id IS NULL", variableID, classID, desigID)
+	if err != nil {
+		msg := fmt.Sprintf("unable to check existing mappings: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return []int64{}, apierrors.Wrap(err, msg)
+	}
+
+	return ids, nil
+}
+
+//finds every variable with more than one value in a class/designation
+func GetVariableConflicts(ctx context.Context) ([]VariableConflict, error) {
+
+	logger.Debugf(ctx, "looking for conflicting variable mappings...")
+
+	command := "SELECT " + qualify("variable_mappings", VARIABLE_MAPPING_COLUMNS) + ` FROM variable_mappings
+		JOIN (SELECT class_id, designation_id, variable_id FROM variable_mappings WHERE deletion_id IS NULL
+			GROUP BY class_id, designation_id, variable_id HAVING COUNT(*) > 1) duplicates
+		USING (class_id, designation_id, variable_id)
+		WHERE variable_mappings.deletion_id IS NULL
+		ORDER BY class_id, designation_id, variable_id, id`
+
+	var rows []DBVariable
+	err := db.DB().Select(&rows, command)
+	if err != nil {
+		msg := fmt.Sprintf("conflicts not found: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return []VariableConflict{}, apierrors.Wrap(err, msg)
+	}
+
+	conflicts := []VariableConflict{}
+	for i, row := range rows {
+
+		var mapping VariableMapping
+		err = FillVariableMapping(ctx, &row, &mapping)
+		if err != nil {
+			return []VariableConflict{}, err
+		}
+
+		//rows come back grouped, so a new group starts whenever the scope or variable changes
+		if i == 0 || row.ClassID != rows[i-1].ClassID || row.DesigID != rows[i-1].DesigID || row.VarID != rows[i-1].VarID {
+			conflicts = append(conflicts, VariableConflict{})
+		}
+
+		last := &conflicts[len(conflicts)-1]
+		last.Mappings = append(last.Mappings, mapping)
+	}
+
+	return conflicts, nil
+}
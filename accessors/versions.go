@@ -0,0 +1,63 @@
+package accessors
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/byuoitav/pi-designation-microservice/apierrors"
+	db "github.com/byuoitav/pi-designation-microservice/database"
+)
+
+//every edit ends its WHERE clause with this, taking the expected version twice - zero matches any version
+const VERSION_CLAUSE = "(? = 0 OR version = ?)"
+
+//what an edit sets alongside its own columns
+//the new version comes back as the statement's insert ID, so it's the version this edit made even if another lands right after it
+const VERSION_BUMP = "version = LAST_INSERT_ID(version + 1)"
+
+//works out why an edit of id at version matched nothing - either the row is gone or someone else edited it first
+func editFailure(ctx context.Context, table string, id, version int64) error {
+
+	var current int64
+	err := db.DB().Get(&current, fmt.Sprintf("SELECT version FROM %s WHERE id = ? AND deletion_id IS NULL", table), id)
+	if err == sql.ErrNoRows {
+		msg := "invalid edit"
+		logger.Errorf(ctx, "%s", msg)
+		return apierrors.NotFound(msg)
+	}
+
+	if err != nil {
+		msg := fmt.Sprintf("version not found: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return apierrors.Wrap(err, msg)
+	}
+
+	msg := fmt.Sprintf("%d in %s was edited since version %d - it's at version %d now", id, table, version, current)
+	logger.Warnf(ctx, "%s", msg)
+	return apierrors.Stale(msg)
+}
+
+//fails an edit that matched no rows, otherwise returns the version it made
+func checkEdit(ctx context.Context, result sql.Result, table string, id, version int64) (int64, error) {
+
+	numRows, err := result.RowsAffected()
+	if err != nil {
+		msg := fmt.Sprintf("number of rows not found: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return 0, apierrors.Wrap(err, msg)
+	}
+
+	if numRows < 1 {
+		return 0, editFailure(ctx, table, id, version)
+	}
+
+	edited, err := result.LastInsertId()
+	if err != nil {
+		msg := fmt.Sprintf("new version not found: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return 0, apierrors.Wrap(err, msg)
+	}
+
+	return edited, nil
+}
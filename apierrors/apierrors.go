@@ -0,0 +1,215 @@
+package apierrors
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net"
+	"net/http"
+	"regexp"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+const (
+	BAD_REQUEST       = "bad_request"
+	NOT_FOUND         = "not_found"
+	CONFLICT          = "conflict"
+	DUPLICATE         = "duplicate"         //a unique key already has this value
+	IN_USE            = "in_use"            //something still refers to the row being deleted
+	INVALID           = "invalid"           //well-formed, but not a value we accept
+	INVALID_REFERENCE = "invalid_reference" //refers to a row that doesn't exist or is in the trash
+	UNAVAILABLE       = "unavailable"       //the database is down or overloaded
+	STALE             = "stale"             //If-Match names a version that's since been edited
+	VERSION_REQUIRED  = "version_required"  //edits have to say which version they're editing
+	READ_ONLY         = "read_only"         //configuration comes from a directory, not the API
+	INTERNAL          = "internal"
+)
+
+//MySQL error numbers we tell apart
+const (
+	ER_DUP_ENTRY          = 1062
+	ER_ROW_IS_REFERENCED  = 1451
+	ER_NO_REFERENCED_ROW  = 1452
+	ER_BAD_NULL_ERROR     = 1048
+	ER_DATA_TOO_LONG      = 1406
+	ER_CON_COUNT_ERROR    = 1040
+	ER_TOO_MANY_USER_CONN = 1203
+	ER_LOCK_WAIT_TIMEOUT  = 1205
+	ER_LOCK_DEADLOCK      = 1213
+)
+
+//the body of every error response
+type Error struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Field   string      `json:"field,omitempty"`   //the part of the request that caused it, when we know
+	Details interface{} `json:"details,omitempty"` //anything else the caller needs to sort it out
+	status  int
+}
+
+var statusCodes = map[int]string{
+	http.StatusBadRequest:           BAD_REQUEST,
+	http.StatusNotFound:             NOT_FOUND,
+	http.StatusMethodNotAllowed:     READ_ONLY,
+	http.StatusConflict:             CONFLICT,
+	http.StatusUnprocessableEntity:  INVALID,
+	http.StatusPreconditionFailed:   STALE,
+	http.StatusPreconditionRequired: VERSION_REQUIRED,
+	http.StatusServiceUnavailable:   UNAVAILABLE,
+	http.StatusInternalServerError:  INTERNAL,
+}
+
+//'name' or 'table.name' at the end of a duplicate entry message
+var duplicateKey = regexp.MustCompile(`for key '(?:[^']*\.)?([^'.]+)'`)
+
+//the column in a foreign key constraint message
+var foreignKey = regexp.MustCompile("FOREIGN KEY \\(`([^`]+)`\\)")
+
+//the column in not null and too long messages
+var column = regexp.MustCompile(`[Cc]olumn '([^']+)'`)
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Status() int {
+	return e.status
+}
+
+func New(status int, field, message string) *Error {
+
+	code, ok := statusCodes[status]
+	if !ok {
+		code = INTERNAL
+	}
+
+	return &Error{Code: code, Message: message, Field: field, status: status}
+}
+
+func BadRequest(field, message string) *Error {
+	return New(http.StatusBadRequest, field, message)
+}
+
+func NotFound(message string) *Error {
+	return New(http.StatusNotFound, "", message)
+}
+
+func Conflict(field, message string) *Error {
+	return New(http.StatusConflict, field, message)
+}
+
+func Invalid(field, message string) *Error {
+	return New(http.StatusUnprocessableEntity, field, message)
+}
+
+//refers to a row that doesn't exist, or is in the trash
+func InvalidReference(field, message string) *Error {
+
+	e := Invalid(field, message)
+	e.Code = INVALID_REFERENCE
+	return e
+}
+
+//something still refers to what's being deleted - details says what
+func InUse(message string, details interface{}) *Error {
+
+	e := Conflict("id", message)
+	e.Code = IN_USE
+	e.Details = details
+	return e
+}
+
+func Stale(message string) *Error {
+	return New(http.StatusPreconditionFailed, "If-Match", message)
+}
+
+func VersionRequired(message string) *Error {
+	return New(http.StatusPreconditionRequired, "If-Match", message)
+}
+
+func ReadOnly(message string) *Error {
+	return New(http.StatusMethodNotAllowed, "", message)
+}
+
+//works out what kind of failure err is - nil if we can't tell
+func Classify(err error) *Error {
+
+	if err == nil {
+		return nil
+	}
+
+	var typed *Error
+	if errors.As(err, &typed) {
+		return typed
+	}
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return NotFound(err.Error())
+	}
+
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return classifyMySQL(mysqlErr)
+	}
+
+	var netErr net.Error
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) || errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) {
+		return New(http.StatusServiceUnavailable, "", err.Error())
+	}
+
+	return nil
+}
+
+func classifyMySQL(err *mysql.MySQLError) *Error {
+
+	switch err.Number {
+	case ER_DUP_ENTRY:
+		e := Conflict(submatch(duplicateKey, err.Message), err.Message)
+		e.Code = DUPLICATE
+		return e
+	case ER_ROW_IS_REFERENCED:
+		return InUse(err.Message, nil)
+	case ER_NO_REFERENCED_ROW:
+		return InvalidReference(submatch(foreignKey, err.Message), err.Message)
+	case ER_BAD_NULL_ERROR, ER_DATA_TOO_LONG:
+		return Invalid(submatch(column, err.Message), err.Message)
+	case ER_CON_COUNT_ERROR, ER_TOO_MANY_USER_CONN, ER_LOCK_WAIT_TIMEOUT, ER_LOCK_DEADLOCK:
+		return New(http.StatusServiceUnavailable, "", err.Message)
+	}
+
+	return nil
+}
+
+func submatch(pattern *regexp.Regexp, message string) string {
+
+	match := pattern.FindStringSubmatch(message)
+	if match == nil {
+		return ""
+	}
+
+	return match[1]
+}
+
+//replaces err's message but keeps what kind of failure it was
+//errors we can't classify come back as plain errors
+func Wrap(err error, message string) error {
+
+	if Classify(err) == nil {
+		return errors.New(message)
+	}
+
+	return From(err, http.StatusInternalServerError, message)
+}
+
+//what to send for err - its own classification when it has one, otherwise status
+func From(err error, status int, message string) *Error {
+
+	classified := Classify(err)
+	if classified == nil {
+		return New(status, "", message)
+	}
+
+	return &Error{Code: classified.Code, Message: message, Field: classified.Field, Details: classified.Details, status: classified.status}
+}
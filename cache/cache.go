@@ -0,0 +1,213 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/byuoitav/pi-designation-microservice/logging"
+)
+
+var logger = logging.New("cache")
+
+//a rendered configuration - the bytes served to the pi and the tags the render depended on
+type entry struct {
+	data []byte
+	tags []string
+}
+
+//a render in progress - everybody asking for the same key waits on the same one
+type call struct {
+	wg    sync.WaitGroup
+	data  []byte
+	tags  []string
+	err   error
+	stale bool //set when an invalidation arrives mid-render so the result isn't stored
+}
+
+//hit/miss counts for monitoring
+type Stats struct {
+	Hits          uint64 `json:"hits"`
+	Misses        uint64 `json:"misses"`
+	Shared        uint64 `json:"shared"` //requests that waited on another request's render
+	Invalidations uint64 `json:"invalidations"`
+	Entries       int    `json:"entries"`
+}
+
+//renders a configuration and reports which tags it depends on
+type Loader func() (data []byte, tags []string, err error)
+
+/** lock things down here **/
+var mutex sync.Mutex
+
+/** all the good stuff lives here **/
+var entries = make(map[string]*entry)
+var calls = make(map[string]*call)
+
+var hits, misses, shared, invalidations uint64
+
+//builds the cache key for a rendered configuration
+func Key(kind string, classID, designationID int64) string {
+	return fmt.Sprintf("%s/%d/%d", kind, classID, designationID)
+}
+
+//tags identify the rows a rendered configuration was built from
+func ClassTag(id int64) string {
+	return fmt.Sprintf("class:%d", id)
+}
+
+func DesignationTag(id int64) string {
+	return fmt.Sprintf("designation:%d", id)
+}
+
+func VariableTag(id int64) string {
+	return fmt.Sprintf("variable:%d", id)
+}
+
+func MicroserviceTag(id int64) string {
+	return fmt.Sprintf("microservice:%d", id)
+}
+
+//every variables configuration can pick up a new default
+func VariableDefaultsTag() string {
+	return "variable_defaults"
+}
+
+//the image tag pinned for a microservice in a designation
+func ImageTagTag(microserviceID, designationID int64) string {
+	return fmt.Sprintf("image_tag:%d/%d", microserviceID, designationID)
+}
+
+//which classes require which variables
+func RequiredVariablesTag() string {
+	return "required_variables"
+}
+
+func VariableMappingsTag(classID, designationID int64) string {
+	return fmt.Sprintf("variable_mappings:%d/%d", classID, designationID)
+}
+
+func MicroserviceMappingsTag(classID, designationID int64) string {
+	return fmt.Sprintf("microservice_mappings:%d/%d", classID, designationID)
+}
+
+//returns the cached configuration for key, calling load at most once no matter how many requests are waiting
+func Get(key string, load Loader) ([]byte, error) {
+
+	mutex.Lock()
+
+	if cached, ok := entries[key]; ok {
+		mutex.Unlock()
+		atomic.AddUint64(&hits, 1)
+		return cached.data, nil
+	}
+
+	if pending, ok := calls[key]; ok {
+		mutex.Unlock()
+		atomic.AddUint64(&shared, 1)
+		pending.wg.Wait()
+		return pending.data, pending.err
+	}
+
+	atomic.AddUint64(&misses, 1)
+
+	pending := &call{}
+	pending.wg.Add(1)
+	calls[key] = pending
+	mutex.Unlock()
+
+	pending.data, pending.tags, pending.err = load()
+
+	mutex.Lock()
+	//an invalidation may already have let a newer render take our place
+	if calls[key] == pending {
+		delete(calls, key)
+	}
+	if pending.err == nil && !pending.stale {
+		entries[key] = &entry{data: pending.data, tags: pending.tags}
+	}
+	mutex.Unlock()
+
+	pending.wg.Done()
+
+	return pending.data, pending.err
+}
+
+//drops every cached configuration that depends on any of the given tags
+func Invalidate(tags ...string) {
+
+	if len(tags) == 0 {
+		return
+	}
+
+	logger.Warnf(context.Background(), "invalidating %v", tags)
+
+	lookup := make(map[string]bool)
+	for _, tag := range tags {
+		lookup[tag] = true
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for key, cached := range entries {
+		if dependsOn(cached.tags, lookup) {
+			delete(entries, key)
+			atomic.AddUint64(&invalidations, 1)
+		}
+	}
+
+	abandonCalls()
+}
+
+//drops everything
+func Flush() {
+
+	logger.Warnf(context.Background(), "flushing all rendered configurations")
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	atomic.AddUint64(&invalidations, uint64(len(entries)))
+	entries = make(map[string]*entry)
+
+	abandonCalls()
+}
+
+//we don't know what an unfinished render will depend on, so none of them get stored, and anyone
+//who asks from now on starts a fresh render instead of joining one that may have read the old rows
+//callers have to hold the mutex
+func abandonCalls() {
+
+	for key, pending := range calls {
+		pending.stale = true
+		delete(calls, key)
+	}
+}
+
+func GetStats() Stats {
+
+	mutex.Lock()
+	size := len(entries)
+	mutex.Unlock()
+
+	return Stats{
+		Hits:          atomic.LoadUint64(&hits),
+		Misses:        atomic.LoadUint64(&misses),
+		Shared:        atomic.LoadUint64(&shared),
+		Invalidations: atomic.LoadUint64(&invalidations),
+		Entries:       size,
+	}
+}
+
+func dependsOn(tags []string, lookup map[string]bool) bool {
+
+	for _, tag := range tags {
+		if lookup[tag] {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,129 @@
+package cache
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestGetHit(t *testing.T) {
+
+	reset()
+
+	var loads int32
+	load := func() ([]byte, []string, error) {
+		atomic.AddInt32(&loads, 1)
+		return []byte("rendered"), []string{ClassTag(1)}, nil
+	}
+
+	for i := 0; i < 3; i++ {
+		data, err := Get("hit", load)
+		if err != nil || string(data) != "rendered" {
+			t.Fatalf("got %q, %v", data, err)
+		}
+	}
+
+	if loads != 1 {
+		t.Fatalf("loaded %d times, expected once", loads)
+	}
+}
+
+func TestGetShared(t *testing.T) {
+
+	reset()
+
+	var loads int32
+	release := make(chan bool)
+	load := func() ([]byte, []string, error) {
+		atomic.AddInt32(&loads, 1)
+		<-release
+		return []byte("rendered"), nil, nil
+	}
+
+	go Get("shared", load)
+	waitForCall("shared")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data, err := Get("shared", load)
+			if err != nil || string(data) != "rendered" {
+				t.Errorf("got %q, %v", data, err)
+			}
+		}()
+	}
+
+	close(release)
+	wg.Wait()
+
+	if loads != 1 {
+		t.Fatalf("loaded %d times, expected once", loads)
+	}
+}
+
+func TestInvalidateDuringRender(t *testing.T) {
+
+	reset()
+
+	release := make(chan bool)
+	old := func() ([]byte, []string, error) {
+		<-release
+		return []byte("old"), []string{ClassTag(2)}, nil
+	}
+
+	done := make(chan []byte)
+	go func() {
+		data, _ := Get("invalidated", old)
+		done <- data
+	}()
+	waitForCall("invalidated")
+
+	//a write lands while the render is still reading
+	Invalidate(ClassTag(2))
+
+	//someone asking after the write gets a fresh render, not the one already in flight
+	data, err := Get("invalidated", func() ([]byte, []string, error) {
+		return []byte("new"), []string{ClassTag(2)}, nil
+	})
+	if err != nil || string(data) != "new" {
+		t.Fatalf("got %q, %v after invalidating, expected a fresh render", data, err)
+	}
+
+	close(release)
+	if data := <-done; string(data) != "old" {
+		t.Fatalf("the render in flight got %q", data)
+	}
+
+	//and the stale render doesn't replace the fresh one
+	data, _ = Get("invalidated", func() ([]byte, []string, error) {
+		t.Fatal("expected a cache hit")
+		return nil, nil, nil
+	})
+	if string(data) != "new" {
+		t.Fatalf("cached %q, expected the fresh render", data)
+	}
+}
+
+func reset() {
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	entries = make(map[string]*entry)
+	calls = make(map[string]*call)
+}
+
+func waitForCall(key string) {
+
+	for {
+		mutex.Lock()
+		_, ok := calls[key]
+		mutex.Unlock()
+
+		if ok {
+			return
+		}
+	}
+}
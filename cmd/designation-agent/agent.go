@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+const BACKUP_SUFFIX = ".bak"
+
+type Config struct {
+	Address         string
+	Authorization   string
+	ClassID         int64
+	DesignationID   int64
+	EnvironmentFile string
+	ComposeFile     string
+	ReloadCommand   string
+	Timeout         time.Duration
+	Strict          bool
+
+	CheckIn           bool
+	Hostname          string
+	Room              string
+	ContainersCommand string
+}
+
+//a file we manage on the pi and the endpoint it comes from
+type target struct {
+	path     string
+	endpoint string
+	incoming []byte
+	backedUp bool //whether the file was there this cycle, so there's something to restore
+}
+
+//fetches both configurations, writes whatever changed and reloads - rolling back if the reload fails
+func Sync(config *Config) error {
+
+	targets := []*target{
+		{path: config.EnvironmentFile, endpoint: "variables"},
+		{path: config.ComposeFile, endpoint: "docker-compose"},
+	}
+
+	//fetch everything first so we never apply half a configuration
+	for _, t := range targets {
+
+		data, err := fetch(config, t.endpoint)
+		if err != nil {
+			return err
+		}
+
+		t.incoming = data
+	}
+
+	var changed []*target
+	for _, t := range targets {
+
+		current, err := ioutil.ReadFile(t.path)
+		if err != nil && !os.IsNotExist(err) {
+			return errors.New(fmt.Sprintf("unable to read %s: %s", t.path, err.Error()))
+		}
+
+		if !bytes.Equal(current, t.incoming) {
+			changed = append(changed, t)
+		}
+	}
+
+	if len(changed) == 0 {
+		log.Printf("[agent] configuration unchanged")
+		return nil
+	}
+
+	for i, t := range changed {
+
+		log.Printf("%s", color.HiCyanString("[agent] updating %s", t.path))
+
+		backedUp, err := backup(t.path)
+		if err == nil {
+			t.backedUp = backedUp
+			err = writeAtomically(t.path, t.incoming)
+		}
+		if err != nil {
+			//put back whatever's already been written, so the pi isn't left with half a configuration
+			restoreErr := rollback(changed[:i+1])
+			if restoreErr != nil {
+				return errors.New(fmt.Sprintf("%s; rollback failed: %s", err.Error(), restoreErr.Error()))
+			}
+			return err
+		}
+	}
+
+	err := reload(config)
+	if err == nil {
+		log.Printf("%s", color.HiGreenString("[agent] configuration applied"))
+		return nil
+	}
+
+	log.Printf("%s", color.HiRedString("[agent] reload failed, rolling back: %s", err.Error()))
+
+	restoreErr := rollback(changed)
+	if restoreErr != nil {
+		return errors.New(fmt.Sprintf("reload failed: %s; rollback failed: %s", err.Error(), restoreErr.Error()))
+	}
+
+	rollbackErr := reload(config)
+	if rollbackErr != nil {
+		return errors.New(fmt.Sprintf("reload failed: %s; reload after rollback failed: %s", err.Error(), rollbackErr.Error()))
+	}
+
+	return errors.New(fmt.Sprintf("reload failed, previous configuration restored: %s", err.Error()))
+}
+
+func fetch(config *Config, endpoint string) ([]byte, error) {
+
+	query := url.Values{}
+	if config.Strict {
+		query.Set("strict", "true")
+	}
+
+	//templated docker-compose files can differ from pi to pi
+	if endpoint == "docker-compose" {
+		if len(config.Room) > 0 {
+			query.Set("room", config.Room)
+		}
+		if len(config.Hostname) > 0 {
+			query.Set("device", config.Hostname)
+		}
+	}
+
+	address := fmt.Sprintf("%s/configurations/designations/%d/%d/%s", config.Address, config.ClassID, config.DesignationID, endpoint)
+	if len(query) > 0 {
+		address += "?" + query.Encode()
+	}
+
+	log.Printf("[agent] fetching %s", address)
+
+	response, err := send(config, http.MethodGet, address, nil)
+	if err != nil {
+		return []byte{}, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return []byte{}, errors.New(fmt.Sprintf("unable to read %s: %s", endpoint, err.Error()))
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return []byte{}, errors.New(fmt.Sprintf("%s returned %d: %s", endpoint, response.StatusCode, body))
+	}
+
+	if response.Header.Get("X-Configuration-Stale") == "true" {
+		log.Printf("%s", color.HiYellowString("[agent] service served a stale %s configuration", endpoint))
+	}
+
+	return body, nil
+}
+
+//copies the current file aside so a bad configuration can be rolled back - false if there was no file to copy
+func backup(path string) (bool, error) {
+
+	current, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.New(fmt.Sprintf("unable to read %s: %s", path, err.Error()))
+	}
+
+	return true, writeAtomically(path+BACKUP_SUFFIX, current)
+}
+
+//restores every target, even when one of them fails - the errors are all returned together
+func rollback(targets []*target) error {
+
+	var failures []string
+	for _, t := range targets {
+
+		err := restore(t)
+		if err != nil {
+			log.Printf("%s", color.HiRedString("[agent] %s", err.Error()))
+			failures = append(failures, err.Error())
+		}
+	}
+
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, "; "))
+	}
+
+	return nil
+}
+
+func restore(t *target) error {
+
+	log.Printf("%s", color.HiYellowString("[agent] restoring %s", t.path))
+
+	//there was nothing there before this cycle - a .bak from an earlier one isn't what we replaced
+	if !t.backedUp {
+		err := os.Remove(t.path)
+		if err != nil && !os.IsNotExist(err) {
+			return errors.New(fmt.Sprintf("unable to remove %s: %s", t.path, err.Error()))
+		}
+		return nil
+	}
+
+	previous, err := ioutil.ReadFile(t.path + BACKUP_SUFFIX)
+	if err != nil {
+		return errors.New(fmt.Sprintf("unable to read backup of %s: %s", t.path, err.Error()))
+	}
+
+	return writeAtomically(t.path, previous)
+}
+
+//writes to a temp file in the same directory and renames it over the target
+func writeAtomically(path string, data []byte) error {
+
+	directory := filepath.Dir(path)
+
+	err := os.MkdirAll(directory, 0755)
+	if err != nil {
+		return errors.New(fmt.Sprintf("unable to create %s: %s", directory, err.Error()))
+	}
+
+	temp, err := ioutil.TempFile(directory, "."+filepath.Base(path)+".")
+	if err != nil {
+		return errors.New(fmt.Sprintf("unable to create temp file: %s", err.Error()))
+	}
+	defer os.Remove(temp.Name())
+
+	_, err = temp.Write(data)
+	if err == nil {
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.New(fmt.Sprintf("unable to write %s: %s", path, err.Error()))
+	}
+
+	err = os.Chmod(temp.Name(), 0644)
+	if err != nil {
+		return errors.New(fmt.Sprintf("unable to set permissions on %s: %s", path, err.Error()))
+	}
+
+	err = os.Rename(temp.Name(), path)
+	if err != nil {
+		return errors.New(fmt.Sprintf("unable to replace %s: %s", path, err.Error()))
+	}
+
+	return nil
+}
+
+func reload(config *Config) error {
+
+	log.Printf("[agent] running: %s", config.ReloadCommand)
+
+	command := exec.Command("sh", "-c", config.ReloadCommand)
+	command.Dir = filepath.Dir(config.ComposeFile)
+
+	output, err := command.CombinedOutput()
+	if len(bytes.TrimSpace(output)) > 0 {
+		log.Printf("[agent] %s", bytes.TrimSpace(output))
+	}
+	if err != nil {
+		return errors.New(fmt.Sprintf("%s: %s", config.ReloadCommand, err.Error()))
+	}
+
+	return nil
+}
+
+func send(config *Config, method, url string, body io.Reader) (*http.Response, error) {
+
+	request, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid request: %s", err.Error()))
+	}
+
+	if len(config.Authorization) > 0 {
+		request.Header.Set("Authorization", config.Authorization)
+	}
+
+	if len(config.Hostname) > 0 {
+		request.Header.Set("X-Device-Hostname", config.Hostname)
+	}
+
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	client := http.Client{Timeout: config.Timeout}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("unable to reach service: %s", err.Error()))
+	}
+
+	return response, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/byuoitav/pi-designation-microservice/fingerprint"
+)
+
+//matches accessors.Checkin
+type checkin struct {
+	Hostname      string   `json:"hostname"`
+	ClassID       int64    `json:"class"`
+	DesignationID int64    `json:"designation"`
+	Room          string   `json:"room"`
+	ConfigHash    string   `json:"config-hash"`
+	Containers    []string `json:"containers"`
+}
+
+//tells the service what configuration is on disk and which containers are running
+func CheckIn(config *Config) error {
+
+	variables, err := ioutil.ReadFile(config.EnvironmentFile)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.New(fmt.Sprintf("unable to read %s: %s", config.EnvironmentFile, err.Error()))
+	}
+
+	dockerCompose, err := ioutil.ReadFile(config.ComposeFile)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.New(fmt.Sprintf("unable to read %s: %s", config.ComposeFile, err.Error()))
+	}
+
+	containers, err := listContainers(config)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(checkin{
+		Hostname:      config.Hostname,
+		ClassID:       config.ClassID,
+		DesignationID: config.DesignationID,
+		Room:          config.Room,
+		ConfigHash:    fingerprint.Configuration(variables, dockerCompose),
+		Containers:    containers,
+	})
+	if err != nil {
+		return errors.New(fmt.Sprintf("unable to encode check-in: %s", err.Error()))
+	}
+
+	log.Printf("[agent] checking in as %s", config.Hostname)
+
+	response, err := send(config, http.MethodPost, config.Address+"/devices/checkins", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(response.Body)
+		return errors.New(fmt.Sprintf("check-in returned %d: %s", response.StatusCode, message))
+	}
+
+	return nil
+}
+
+func listContainers(config *Config) ([]string, error) {
+
+	output, err := exec.Command("sh", "-c", config.ContainersCommand).Output()
+	if err != nil {
+		return []string{}, errors.New(fmt.Sprintf("unable to list containers: %s", err.Error()))
+	}
+
+	containers := []string{}
+	for _, line := range strings.Split(string(output), "\n") {
+
+		line = strings.TrimSpace(line)
+		if len(line) > 0 {
+			containers = append(containers, line)
+		}
+	}
+
+	return containers, nil
+}
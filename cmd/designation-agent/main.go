@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+func main() {
+
+	var config Config
+
+	hostname, _ := os.Hostname()
+
+	flag.StringVar(&config.Address, "address", os.Getenv("DESIGNATION_AGENT_ADDRESS"), "base URL of the designation microservice")
+	flag.StringVar(&config.Authorization, "authorization", os.Getenv("DESIGNATION_AGENT_AUTHORIZATION"), "value sent in the Authorization header")
+	flag.Int64Var(&config.ClassID, "class", 0, "ID of this pi's class")
+	flag.Int64Var(&config.DesignationID, "designation", 0, "ID of this pi's designation")
+	flag.StringVar(&config.EnvironmentFile, "env", "/etc/pi-designation/environment", "where to write the exported variables")
+	flag.StringVar(&config.ComposeFile, "compose", "/etc/pi-designation/docker-compose.yml", "where to write the docker-compose file")
+	flag.StringVar(&config.ReloadCommand, "reload", "docker-compose up -d", "run through sh in the compose file's directory after a change")
+	flag.StringVar(&config.Room, "room", os.Getenv("DESIGNATION_AGENT_ROOM"), "room reported when checking in and fetching docker-compose templates")
+	flag.StringVar(&config.Hostname, "hostname", hostname, "hostname reported when checking in and fetching docker-compose templates")
+	flag.StringVar(&config.ContainersCommand, "containers", "docker ps --format '{{.Names}}'", "lists running containers, one per line, when checking in")
+	flag.BoolVar(&config.CheckIn, "checkin", true, "report applied configuration and running containers to the service")
+	flag.BoolVar(&config.Strict, "strict", false, "refuse configurations the service reports as incomplete")
+	flag.DurationVar(&config.Timeout, "timeout", 30*time.Second, "how long to wait on the service")
+	interval := flag.Duration("interval", 5*time.Minute, "how often to check for new configuration")
+	once := flag.Bool("once", false, "check once and exit")
+	flag.Parse()
+
+	if len(config.Address) == 0 || config.ClassID == 0 || config.DesignationID == 0 {
+		fmt.Fprintln(os.Stderr, "-address, -class and -designation are required")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	config.Address = strings.TrimRight(config.Address, "/")
+
+	log.Printf("%s", color.HiGreenString("[agent] watching class %d, designation %d at %s", config.ClassID, config.DesignationID, config.Address))
+
+	for {
+		syncErr := Sync(&config)
+		if syncErr != nil {
+			log.Printf("%s", color.HiRedString("[agent] %s", syncErr.Error()))
+		}
+
+		//check in even after a failed sync so the service knows we're behind
+		if config.CheckIn {
+			err := CheckIn(&config)
+			if err != nil {
+				log.Printf("%s", color.HiRedString("[agent] check-in failed: %s", err.Error()))
+			}
+		}
+
+		if *once {
+			if syncErr != nil {
+				os.Exit(1)
+			}
+			return
+		}
+
+		time.Sleep(*interval)
+	}
+}
@@ -1,12 +1,11 @@
 package database
 
 import (
-	"log"
+	"context"
 	"os"
 	"sync"
 
-	"github.com/fatih/color"
-	_ "github.com/go-sql-driver/mysql" // Blank import due to its use as a driver
+	"github.com/byuoitav/pi-designation-microservice/logging"
 	"github.com/jmoiron/sqlx"
 )
 
@@ -16,17 +15,25 @@ var once sync.Once
 /** all the good stuff lives here **/
 var db *sqlx.DB
 
+var logger = logging.New("database")
+
 func DB() *sqlx.DB {
 	once.Do(func() {
+		password := os.Getenv("DESIGNATION_DATABASE_PASSWORD")
+		logging.AddSecret(password) //in case a driver error ever echoes the DSN back
+
 		//build source data
-		data := os.Getenv("DESIGNATION_DATABASE_USERNAME") + ":" +
-			os.Getenv("DESIGNATION_DATABASE_PASSWORD") + "@tcp(" +
+		address := "@tcp(" +
 			os.Getenv("DESIGNATION_DATABASE_HOST") + ":" +
 			os.Getenv("DESIGNATION_DATABASE_PORT") + ")" + "/" +
-			os.Getenv("DESIGNATION_DATABASE_NAME")
+			os.Getenv("DESIGNATION_DATABASE_NAME") +
+			"?parseTime=true" + //scan timestamps into time.Time
+			"&clientFoundRows=true" //so an edit that changes nothing still counts the row it matched
+
+		username := os.Getenv("DESIGNATION_DATABASE_USERNAME")
 
-		log.Printf("%s", color.HiCyanString("[database] data: %s", data))
-		db = sqlx.MustOpen("mysql", data)
+		logger.Infof(context.Background(), "data: %s", username+":"+logging.REDACTED+address)
+		db = sqlx.MustOpen(INSTRUMENTED_DRIVER, username+":"+password+address)
 	})
 
 	return db
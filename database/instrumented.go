@@ -0,0 +1,204 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/byuoitav/pi-designation-microservice/metrics"
+	"github.com/go-sql-driver/mysql"
+)
+
+//the MySQL driver, timing every statement for /metrics
+const INSTRUMENTED_DRIVER = "mysql-instrumented"
+
+//the first table a statement touches
+var statementTable = regexp.MustCompile(`(?i)\b(?:from|into|update|join)\s+` + "`?" + `([a-z_]+)`)
+
+func init() {
+	sql.Register(INSTRUMENTED_DRIVER, instrumentedDriver{parent: &mysql.MySQLDriver{}})
+}
+
+func observe(query string, start time.Time, err error) {
+
+	if err == driver.ErrSkip {
+		return //database/sql tries again another way, which gets counted then
+	}
+
+	operation := "other"
+	fields := strings.Fields(query)
+	if len(fields) > 0 {
+		operation = strings.ToLower(fields[0])
+	}
+
+	table := "unknown"
+	if match := statementTable.FindStringSubmatch(query); match != nil {
+		table = strings.ToLower(match[1])
+	}
+
+	metrics.ObserveQuery(operation, table, time.Since(start), err)
+}
+
+type instrumentedDriver struct {
+	parent driver.Driver
+}
+
+func (d instrumentedDriver) Open(name string) (driver.Conn, error) {
+
+	conn, err := d.parent.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &instrumentedConn{Conn: conn}, nil
+}
+
+type instrumentedConn struct {
+	driver.Conn
+}
+
+func (c *instrumentedConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+func (c *instrumentedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+
+	var stmt driver.Stmt
+	var err error
+	if preparer, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = preparer.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &instrumentedStmt{Stmt: stmt, query: query}, nil
+}
+
+func (c *instrumentedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+
+	if beginner, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, opts)
+	}
+
+	return c.Conn.Begin()
+}
+
+func (c *instrumentedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+
+	execer, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	start := time.Now()
+	result, err := execer.ExecContext(ctx, query, args)
+	observe(query, start, err)
+
+	return result, err
+}
+
+func (c *instrumentedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+
+	queryer, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+
+	start := time.Now()
+	rows, err := queryer.QueryContext(ctx, query, args)
+	observe(query, start, err)
+
+	return rows, err
+}
+
+func (c *instrumentedConn) Ping(ctx context.Context) error {
+
+	if pinger, ok := c.Conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+
+	return nil
+}
+
+func (c *instrumentedConn) ResetSession(ctx context.Context) error {
+
+	if resetter, ok := c.Conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+
+	return nil
+}
+
+func (c *instrumentedConn) CheckNamedValue(value *driver.NamedValue) error {
+
+	if checker, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(value)
+	}
+
+	return driver.ErrSkip
+}
+
+type instrumentedStmt struct {
+	driver.Stmt
+	query string
+}
+
+func (s *instrumentedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+
+	start := time.Now()
+
+	var result driver.Result
+	var err error
+	if execer, ok := s.Stmt.(driver.StmtExecContext); ok {
+		result, err = execer.ExecContext(ctx, args)
+	} else {
+		var values []driver.Value
+		values, err = namedValues(args)
+		if err == nil {
+			result, err = s.Stmt.Exec(values)
+		}
+	}
+
+	observe(s.query, start, err)
+	return result, err
+}
+
+func (s *instrumentedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+
+	start := time.Now()
+
+	var rows driver.Rows
+	var err error
+	if queryer, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		rows, err = queryer.QueryContext(ctx, args)
+	} else {
+		var values []driver.Value
+		values, err = namedValues(args)
+		if err == nil {
+			rows, err = s.Stmt.Query(values)
+		}
+	}
+
+	observe(s.query, start, err)
+	return rows, err
+}
+
+func namedValues(args []driver.NamedValue) ([]driver.Value, error) {
+
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		if len(arg.Name) > 0 {
+			return nil, driver.ErrSkip
+		}
+
+		values[i] = arg.Value
+	}
+
+	return values, nil
+}
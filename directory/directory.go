@@ -0,0 +1,232 @@
+package directory
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	ac "github.com/byuoitav/pi-designation-microservice/accessors"
+	"github.com/byuoitav/pi-designation-microservice/apierrors"
+	"github.com/byuoitav/pi-designation-microservice/cache"
+	"github.com/byuoitav/pi-designation-microservice/logging"
+	"github.com/labstack/echo"
+)
+
+//how often the tree is checked for changes - override with DESIGNATION_DIRECTORY_POLL_SECONDS
+const DEFAULT_POLL_INTERVAL = 5 * time.Second
+
+//the one write that isn't configuration - devices still report what they're running
+const CHECKIN_PATH = "/devices/checkins"
+
+var logger = logging.New("directory")
+
+//how the directory looked the last time we checked
+type Status struct {
+	Path      string    `json:"path"`
+	Hash      string    `json:"hash,omitempty"` //of the tree that's being served
+	LoadedAt  time.Time `json:"loaded-at"`      //when that tree was loaded
+	CheckedAt time.Time `json:"checked-at"`
+	Error     string    `json:"error,omitempty"` //why the newest tree wasn't loaded - the one before it is still being served
+}
+
+/** lock things down here **/
+var once sync.Once
+var mutex sync.Mutex
+
+/** all the good stuff lives here **/
+var root string
+var status Status
+
+//the tree configuration is read from - set DESIGNATION_STORE_DIRECTORY to serve from it instead of the API
+func Root() string {
+	once.Do(func() {
+		root = os.Getenv("DESIGNATION_STORE_DIRECTORY")
+		if len(root) > 0 {
+			logger.Infof(context.Background(), "serving configuration from %s - writes are disabled", root)
+		}
+	})
+
+	return root
+}
+
+func Enabled() bool {
+	return len(Root()) > 0
+}
+
+func GetStatus() Status {
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	return status
+}
+
+func pollInterval() time.Duration {
+
+	seconds := os.Getenv("DESIGNATION_DIRECTORY_POLL_SECONDS")
+	if len(seconds) == 0 {
+		return DEFAULT_POLL_INTERVAL
+	}
+
+	interval, err := time.ParseDuration(seconds + "s")
+	if err != nil || interval <= 0 {
+		logger.Warnf(context.Background(), "invalid DESIGNATION_DIRECTORY_POLL_SECONDS %q, using %s", seconds, DEFAULT_POLL_INTERVAL)
+		return DEFAULT_POLL_INTERVAL
+	}
+
+	return interval
+}
+
+//loads the tree now and again every time it changes - never returns
+func Watch() {
+
+	ctx := context.Background()
+
+	mutex.Lock()
+	status.Path = Root()
+	mutex.Unlock()
+
+	reload(ctx)
+	for range time.Tick(pollInterval()) {
+		reload(ctx)
+	}
+}
+
+func reload(ctx context.Context) {
+
+	hash, err := hashTree(Root())
+
+	mutex.Lock()
+	status.CheckedAt = time.Now()
+	unchanged := err == nil && hash == status.Hash
+	mutex.Unlock()
+
+	if unchanged {
+		return
+	}
+
+	if err == nil {
+		err = load(ctx)
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if err != nil {
+		if status.Error != err.Error() {
+			logger.Errorf(ctx, "unable to load %s, still serving the last tree that loaded: %s", Root(), err.Error())
+		}
+
+		status.Error = err.Error()
+		return
+	}
+
+	status.Hash = hash
+	status.LoadedAt = time.Now()
+	status.Error = ""
+}
+
+//mirrors the tree into the database, so everything that reads from it keeps working
+//the database is still needed, and it has to be one of its own - see ac.ClaimForDirectory
+func load(ctx context.Context) error {
+
+	bundle, err := Load(Root())
+	if err != nil {
+		return err
+	}
+
+	err = ac.ClaimForDirectory(ctx, Root())
+	if err != nil {
+		return err
+	}
+	bundle.ExportedAt = time.Now()
+
+	result, err := ac.Import(ctx, &bundle, ac.REPLACE_IMPORT, false)
+	if err != nil {
+		return err
+	}
+
+	cache.Flush()
+
+	for section, count := range result.Changes {
+		if count.Added > 0 || count.Updated > 0 || count.Removed > 0 {
+			logger.Infof(ctx, "loaded %s: %d added, %d updated, %d removed", section, count.Added, count.Updated, count.Removed)
+		}
+	}
+
+	return nil
+}
+
+//every file's path and contents, so any edit, rename or delete changes it
+func hashTree(root string) (string, error) {
+
+	hash := sha256.New()
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if path != root && len(info.Name()) > 0 && info.Name()[0] == '.' {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		relative, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		fmt.Fprintf(hash, "%s\x00%d\x00", relative, info.Size())
+		_, err = io.Copy(hash, file)
+		return err
+	})
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("unable to read %s: %s", root, err.Error()))
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+//refuses every change to configuration while it's coming from the directory
+func ReadOnly(next echo.HandlerFunc) echo.HandlerFunc {
+
+	if !Enabled() {
+		return next
+	}
+
+	return func(context echo.Context) error {
+
+		switch context.Request().Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			return next(context)
+		}
+
+		if context.Request().Method == http.MethodPost && context.Path() == CHECKIN_PATH {
+			return next(context)
+		}
+
+		e := apierrors.ReadOnly(fmt.Sprintf("configuration is read from %s - change it there instead", Root()))
+		return context.JSON(e.Status(), e)
+	}
+}
@@ -0,0 +1,431 @@
+package directory
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	ac "github.com/byuoitav/pi-designation-microservice/accessors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+//where everything lives under the root
+const CLASSES_DIRECTORY = "classes"
+const DESIGNATIONS_DIRECTORY = "designations"
+const VARIABLES_DIRECTORY = "variables"
+const MICROSERVICES_DIRECTORY = "microservices"
+
+//files inside a class or designation directory
+const CLASS_FILE = "class.yaml"
+const VARIABLES_FILE = "variables.yaml"
+
+//variables nobody wrote a file for
+const DEFAULT_VARIABLE_TYPE = "string"
+
+//a mapping file named <microservice>[.<n>].overrides.yml holds overrides for the microservice's spec instead of a snippet
+const OVERRIDES_SUFFIX = ".overrides"
+
+//a number before that tells apart mappings of the same microservice - <microservice>.<n>.yml
+var mappingNumber = regexp.MustCompile(`\.[0-9]+$`)
+
+//classes/<class>/class.yaml and designations/<designation>.yaml
+type definitionFile struct {
+	Description string            `yaml:"description,omitempty"`
+	Tags        map[string]string `yaml:"tags,omitempty"`  //microservice -> image tag, designations only
+	Rooms       map[string]string `yaml:"rooms,omitempty"` //room -> UI configuration, designations only
+}
+
+//variables/<variable>.yaml
+type variableFile struct {
+	Description string   `yaml:"description,omitempty"`
+	Type        string   `yaml:"type,omitempty"`
+	Validation  string   `yaml:"validation,omitempty"`
+	Default     *string  `yaml:"default,omitempty"`
+	Secret      bool     `yaml:"secret,omitempty"`
+	Required    []string `yaml:"required,omitempty"`
+}
+
+//microservices/<microservice>.yaml
+type microserviceFile struct {
+	Description string               `yaml:"description,omitempty"`
+	Spec        *ac.MicroserviceSpec `yaml:"spec,omitempty"`
+}
+
+//reads the tree under root into a bundle - definitions that are only mentioned get created with nothing but a name
+func Load(root string) (ac.Bundle, error) {
+
+	loader := loader{
+		root:          root,
+		classes:       make(map[string]ac.BundleDefinition),
+		designations:  make(map[string]ac.BundleDefinition),
+		variables:     make(map[string]ac.BundleVariable),
+		microservices: make(map[string]ac.BundleMicroservice),
+	}
+
+	info, err := os.Stat(root)
+	if err != nil {
+		return ac.Bundle{}, errors.New(fmt.Sprintf("unable to read %s: %s", root, err.Error()))
+	}
+	if !info.IsDir() {
+		return ac.Bundle{}, errors.New(fmt.Sprintf("%s is not a directory", root))
+	}
+
+	//loading replaces everything, so a checkout that's missing or half done mustn't load as nothing
+	info, err = os.Stat(filepath.Join(root, CLASSES_DIRECTORY))
+	if err != nil || !info.IsDir() {
+		return ac.Bundle{}, errors.New(fmt.Sprintf("%s has no %s directory - refusing to load it over everything", root, CLASSES_DIRECTORY))
+	}
+
+	steps := []func() error{loader.loadVariables, loader.loadMicroservices, loader.loadDesignations, loader.loadClasses}
+	for _, step := range steps {
+		err = step()
+		if err != nil {
+			return ac.Bundle{}, err
+		}
+	}
+
+	if len(loader.classes) == 0 {
+		return ac.Bundle{}, errors.New(fmt.Sprintf("%s has no classes - refusing to load it over everything", root))
+	}
+
+	return loader.bundle(), nil
+}
+
+type loader struct {
+	root          string
+	classes       map[string]ac.BundleDefinition
+	designations  map[string]ac.BundleDefinition
+	variables     map[string]ac.BundleVariable
+	microservices map[string]ac.BundleMicroservice
+
+	variableMappings     []ac.BundleVariableMapping
+	microserviceMappings []ac.BundleMicroserviceMapping
+	imageTags            []ac.BundleImageTag
+	rooms                []ac.BundleRoom
+}
+
+func (l *loader) loadVariables() error {
+
+	return l.eachFile(filepath.Join(l.root, VARIABLES_DIRECTORY), func(name, path string) error {
+
+		var file variableFile
+		err := readYAML(path, &file)
+		if err != nil {
+			return err
+		}
+
+		l.variables[name] = ac.BundleVariable{
+			Name:        name,
+			Description: file.Description,
+			Type:        file.Type,
+			Validation:  file.Validation,
+			Default:     file.Default,
+			Secret:      file.Secret,
+			Required:    file.Required,
+		}
+
+		return nil
+	})
+}
+
+func (l *loader) loadMicroservices() error {
+
+	return l.eachFile(filepath.Join(l.root, MICROSERVICES_DIRECTORY), func(name, path string) error {
+
+		var file microserviceFile
+		err := readYAML(path, &file)
+		if err != nil {
+			return err
+		}
+
+		l.microservices[name] = ac.BundleMicroservice{Name: name, Description: file.Description, Spec: file.Spec}
+		return nil
+	})
+}
+
+func (l *loader) loadDesignations() error {
+
+	return l.eachFile(filepath.Join(l.root, DESIGNATIONS_DIRECTORY), func(name, path string) error {
+
+		var file definitionFile
+		err := readYAML(path, &file)
+		if err != nil {
+			return err
+		}
+
+		l.designations[name] = ac.BundleDefinition{Name: name, Description: file.Description}
+
+		for microservice, tag := range file.Tags {
+			l.microservice(microservice)
+			l.imageTags = append(l.imageTags, ac.BundleImageTag{Microservice: microservice, Designation: name, Tag: tag})
+		}
+
+		for room, ui := range file.Rooms {
+			l.rooms = append(l.rooms, ac.BundleRoom{Designation: name, Name: room, UIConfiguration: ui})
+		}
+
+		return nil
+	})
+}
+
+//classes/<class>/designations/<designation>/variables.yaml and .../microservices/<microservice>.yml
+func (l *loader) loadClasses() error {
+
+	classes, err := subdirectories(filepath.Join(l.root, CLASSES_DIRECTORY))
+	if err != nil {
+		return err
+	}
+
+	for _, class := range classes {
+
+		classPath := filepath.Join(l.root, CLASSES_DIRECTORY, class)
+
+		var file definitionFile
+		err = readOptionalYAML(filepath.Join(classPath, CLASS_FILE), &file)
+		if err != nil {
+			return err
+		}
+		if len(file.Tags) > 0 || len(file.Rooms) > 0 {
+			return errors.New(fmt.Sprintf("%s: tags and rooms belong to designations, not classes", filepath.Join(classPath, CLASS_FILE)))
+		}
+
+		l.classes[class] = ac.BundleDefinition{Name: class, Description: file.Description}
+
+		designations, err := subdirectories(filepath.Join(classPath, DESIGNATIONS_DIRECTORY))
+		if err != nil {
+			return err
+		}
+
+		for _, designation := range designations {
+			err = l.loadMappings(class, designation, filepath.Join(classPath, DESIGNATIONS_DIRECTORY, designation))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (l *loader) loadMappings(class, designation, path string) error {
+
+	l.designation(designation)
+
+	values := make(map[string]string)
+	err := readOptionalYAML(filepath.Join(path, VARIABLES_FILE), &values)
+	if err != nil {
+		return err
+	}
+
+	for variable, value := range values {
+		l.variable(variable)
+		l.variableMappings = append(l.variableMappings, ac.BundleVariableMapping{Class: class, Designation: designation, Variable: variable, Value: value})
+	}
+
+	//the file is the snippet as-is - an empty one renders from the microservice's spec
+	return l.eachFile(filepath.Join(path, MICROSERVICES_DIRECTORY), func(name, path string) error {
+
+		microservice, overrides := MappingName(name)
+		mapping := ac.BundleMicroserviceMapping{
+			Class:        class,
+			Designation:  designation,
+			Microservice: microservice,
+		}
+
+		if overrides {
+			mapping.Overrides = &ac.MicroserviceSpec{}
+			err := readYAML(path, mapping.Overrides)
+			if err != nil {
+				return err
+			}
+		} else {
+			contents, err := ioutil.ReadFile(path)
+			if err != nil {
+				return errors.New(fmt.Sprintf("unable to read %s: %s", path, err.Error()))
+			}
+
+			mapping.YAML = strings.TrimSpace(string(contents))
+		}
+
+		l.microservice(mapping.Microservice)
+		l.microserviceMappings = append(l.microserviceMappings, mapping)
+
+		return nil
+	})
+}
+
+//the microservice a mapping file (without its extension) is for, and whether it holds overrides
+//the suffixes come off the end, so foo.yml and foo.2.yml are two mappings of foo, and my.service.yml is a mapping of my.service
+func MappingName(name string) (string, bool) {
+
+	overrides := strings.HasSuffix(name, OVERRIDES_SUFFIX)
+	name = strings.TrimSuffix(name, OVERRIDES_SUFFIX)
+
+	return mappingNumber.ReplaceAllString(name, ""), overrides
+}
+
+//makes sure something only mentioned in a path or a map still gets defined
+func (l *loader) designation(name string) {
+	if _, ok := l.designations[name]; !ok {
+		l.designations[name] = ac.BundleDefinition{Name: name}
+	}
+}
+
+func (l *loader) variable(name string) {
+	if _, ok := l.variables[name]; !ok {
+		l.variables[name] = ac.BundleVariable{Name: name, Type: DEFAULT_VARIABLE_TYPE}
+	}
+}
+
+func (l *loader) microservice(name string) {
+	if _, ok := l.microservices[name]; !ok {
+		l.microservices[name] = ac.BundleMicroservice{Name: name}
+	}
+}
+
+//sorted by name so the same tree always makes the same bundle
+func (l *loader) bundle() ac.Bundle {
+
+	bundle := ac.Bundle{Format: ac.BUNDLE_FORMAT}
+
+	for _, name := range sortedKeys(l.classes) {
+		bundle.Classes = append(bundle.Classes, l.classes[name])
+	}
+	for _, name := range sortedKeys(l.designations) {
+		bundle.Designations = append(bundle.Designations, l.designations[name])
+	}
+	for _, name := range sortedKeys(l.variables) {
+		bundle.Variables = append(bundle.Variables, l.variables[name])
+	}
+	for _, name := range sortedKeys(l.microservices) {
+		bundle.Microservices = append(bundle.Microservices, l.microservices[name])
+	}
+
+	bundle.VariableMappings = l.variableMappings
+	bundle.MicroserviceMappings = l.microserviceMappings
+	bundle.ImageTags = l.imageTags
+	bundle.Rooms = l.rooms
+
+	sort.Slice(bundle.VariableMappings, func(i, j int) bool {
+		a, b := bundle.VariableMappings[i], bundle.VariableMappings[j]
+		return a.Class+"/"+a.Designation+"/"+a.Variable < b.Class+"/"+b.Designation+"/"+b.Variable
+	})
+	sort.Slice(bundle.ImageTags, func(i, j int) bool {
+		a, b := bundle.ImageTags[i], bundle.ImageTags[j]
+		return a.Designation+"/"+a.Microservice < b.Designation+"/"+b.Microservice
+	})
+	sort.Slice(bundle.Rooms, func(i, j int) bool {
+		a, b := bundle.Rooms[i], bundle.Rooms[j]
+		return a.Designation+"/"+a.Name < b.Designation+"/"+b.Name
+	})
+
+	return bundle
+}
+
+//calls found with the name (the file name without .yml/.yaml) and path of every YAML file in dir - a missing dir has none
+func (l *loader) eachFile(dir string, found func(name, path string) error) error {
+
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.New(fmt.Sprintf("unable to read %s: %s", dir, err.Error()))
+	}
+
+	seen := make(map[string]string)
+
+	for _, file := range files {
+
+		extension := filepath.Ext(file.Name())
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") || (extension != ".yml" && extension != ".yaml") {
+			continue
+		}
+
+		name := strings.TrimSuffix(file.Name(), extension)
+		if other, ok := seen[name]; ok {
+			return errors.New(fmt.Sprintf("%s and %s in %s both define %s", other, file.Name(), dir, name))
+		}
+		seen[name] = file.Name()
+
+		err = found(name, filepath.Join(dir, file.Name()))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func subdirectories(dir string) ([]string, error) {
+
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("unable to read %s: %s", dir, err.Error()))
+	}
+
+	var names []string
+	for _, file := range files {
+		if file.IsDir() && !strings.HasPrefix(file.Name(), ".") {
+			names = append(names, file.Name())
+		}
+	}
+
+	return names, nil
+}
+
+//unknown fields are refused, so a typo doesn't quietly load as nothing
+func readYAML(path string, output interface{}) error {
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return errors.New(fmt.Sprintf("unable to read %s: %s", path, err.Error()))
+	}
+
+	err = yaml.UnmarshalStrict(contents, output)
+	if err != nil {
+		return errors.New(fmt.Sprintf("invalid YAML in %s: %s", path, err.Error()))
+	}
+
+	return nil
+}
+
+func readOptionalYAML(path string, output interface{}) error {
+
+	_, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return readYAML(path, output)
+}
+
+func sortedKeys(m interface{}) []string {
+
+	var keys []string
+	switch m := m.(type) {
+	case map[string]ac.BundleDefinition:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	case map[string]ac.BundleVariable:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	case map[string]ac.BundleMicroservice:
+		for key := range m {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,225 @@
+package directory
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	ac "github.com/byuoitav/pi-designation-microservice/accessors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+//what Write names the files it makes
+const MAPPING_EXTENSION = ".yml"
+const DEFINITION_EXTENSION = ".yaml"
+
+//lays a bundle out under root the way Load reads it, replacing whatever tree was there - anything else under root is left alone
+//a name that can't be a file name is refused before anything is touched
+func Write(root string, bundle ac.Bundle) error {
+
+	err := checkNames(bundle)
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range []string{CLASSES_DIRECTORY, DESIGNATIONS_DIRECTORY, VARIABLES_DIRECTORY, MICROSERVICES_DIRECTORY} {
+		err := os.RemoveAll(filepath.Join(root, dir))
+		if err != nil {
+			return errors.New(fmt.Sprintf("unable to clear %s: %s", filepath.Join(root, dir), err.Error()))
+		}
+	}
+
+	for _, class := range bundle.Classes {
+		err := writeYAML(filepath.Join(root, CLASSES_DIRECTORY, class.Name, CLASS_FILE), definitionFile{Description: class.Description})
+		if err != nil {
+			return err
+		}
+	}
+
+	designations := make(map[string]*definitionFile)
+	for _, designation := range bundle.Designations {
+		designations[designation.Name] = &definitionFile{Description: designation.Description}
+	}
+
+	//tags and rooms live in their designation's file
+	designation := func(name string) *definitionFile {
+		if designations[name] == nil {
+			designations[name] = &definitionFile{}
+		}
+		return designations[name]
+	}
+
+	for _, tag := range bundle.ImageTags {
+		file := designation(tag.Designation)
+		if file.Tags == nil {
+			file.Tags = make(map[string]string)
+		}
+		file.Tags[tag.Microservice] = tag.Tag
+	}
+
+	for _, room := range bundle.Rooms {
+		file := designation(room.Designation)
+		if file.Rooms == nil {
+			file.Rooms = make(map[string]string)
+		}
+		file.Rooms[room.Name] = room.UIConfiguration
+	}
+
+	for name, file := range designations {
+		err := writeYAML(filepath.Join(root, DESIGNATIONS_DIRECTORY, name+DEFINITION_EXTENSION), file)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, variable := range bundle.Variables {
+		err := writeYAML(filepath.Join(root, VARIABLES_DIRECTORY, variable.Name+DEFINITION_EXTENSION), variableFile{
+			Description: variable.Description,
+			Type:        variable.Type,
+			Validation:  variable.Validation,
+			Default:     variable.Default,
+			Secret:      variable.Secret,
+			Required:    variable.Required,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, microservice := range bundle.Microservices {
+		err := writeYAML(filepath.Join(root, MICROSERVICES_DIRECTORY, microservice.Name+DEFINITION_EXTENSION), microserviceFile{Description: microservice.Description, Spec: microservice.Spec})
+		if err != nil {
+			return err
+		}
+	}
+
+	values := make(map[string]map[string]string)
+	for _, mapping := range bundle.VariableMappings {
+		path := mappingPath(root, mapping.Class, mapping.Designation)
+		if values[path] == nil {
+			values[path] = make(map[string]string)
+		}
+		values[path][mapping.Variable] = mapping.Value
+	}
+
+	for path, mappings := range values {
+		err := writeYAML(filepath.Join(path, VARIABLES_FILE), mappings)
+		if err != nil {
+			return err
+		}
+	}
+
+	//a microservice mapped more than once gets foo.yml, foo.2.yml, ...
+	//one whose name would read back as something else always gets its number - v1.2 is v1.2.1.yml
+	count := make(map[string]int)
+	for _, mapping := range bundle.MicroserviceMappings {
+
+		path := filepath.Join(mappingPath(root, mapping.Class, mapping.Designation), MICROSERVICES_DIRECTORY, mapping.Microservice)
+
+		count[path]++
+		if microservice, overrides := MappingName(mapping.Microservice); count[path] > 1 || microservice != mapping.Microservice || overrides {
+			path = fmt.Sprintf("%s.%d", path, count[path])
+		}
+
+		if mapping.Overrides != nil {
+			err := writeYAML(path+OVERRIDES_SUFFIX+MAPPING_EXTENSION, mapping.Overrides)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		contents := mapping.YAML
+		if len(contents) > 0 {
+			contents += "\n"
+		}
+
+		err := writeFile(path+MAPPING_EXTENSION, []byte(contents))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//every name that ends up in a path
+func checkNames(bundle ac.Bundle) error {
+
+	var names [][2]string //kind, name
+	for _, class := range bundle.Classes {
+		names = append(names, [2]string{"class", class.Name})
+	}
+	for _, designation := range bundle.Designations {
+		names = append(names, [2]string{"designation", designation.Name})
+	}
+	for _, variable := range bundle.Variables {
+		names = append(names, [2]string{"variable", variable.Name})
+	}
+	for _, microservice := range bundle.Microservices {
+		names = append(names, [2]string{"microservice", microservice.Name})
+	}
+	for _, tag := range bundle.ImageTags {
+		names = append(names, [2]string{"designation", tag.Designation})
+	}
+	for _, room := range bundle.Rooms {
+		names = append(names, [2]string{"designation", room.Designation})
+	}
+	for _, mapping := range bundle.VariableMappings {
+		names = append(names, [2]string{"class", mapping.Class}, [2]string{"designation", mapping.Designation})
+	}
+	for _, mapping := range bundle.MicroserviceMappings {
+		names = append(names, [2]string{"class", mapping.Class}, [2]string{"designation", mapping.Designation}, [2]string{"microservice", mapping.Microservice})
+	}
+
+	for _, name := range names {
+		err := checkName(name[0], name[1])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//a name has to stay one file in its own directory - no separators, nothing hidden (Load skips those), and no . or ..
+func checkName(kind, name string) error {
+
+	if len(name) == 0 || strings.HasPrefix(name, ".") || strings.ContainsAny(name, "/\\\x00") {
+		return errors.New(fmt.Sprintf("%s %q can't be written as a file name", kind, name))
+	}
+
+	return nil
+}
+
+func mappingPath(root, class, designation string) string {
+	return filepath.Join(root, CLASSES_DIRECTORY, class, DESIGNATIONS_DIRECTORY, designation)
+}
+
+func writeYAML(path string, input interface{}) error {
+
+	contents, err := yaml.Marshal(input)
+	if err != nil {
+		return errors.New(fmt.Sprintf("unable to write YAML for %s: %s", path, err.Error()))
+	}
+
+	return writeFile(path, contents)
+}
+
+func writeFile(path string, contents []byte) error {
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return errors.New(fmt.Sprintf("unable to create %s: %s", filepath.Dir(path), err.Error()))
+	}
+
+	err = ioutil.WriteFile(path, contents, 0644)
+	if err != nil {
+		return errors.New(fmt.Sprintf("unable to write %s: %s", path, err.Error()))
+	}
+
+	return nil
+}
@@ -0,0 +1,106 @@
+package fallback
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/byuoitav/pi-designation-microservice/logging"
+)
+
+var logger = logging.New("fallback")
+
+/** lock things down here **/
+var once sync.Once
+
+/** all the good stuff lives here **/
+var directory string
+
+//where last-known-good configurations are kept - override with DESIGNATION_FALLBACK_DIRECTORY
+func Directory() string {
+	once.Do(func() {
+		directory = os.Getenv("DESIGNATION_FALLBACK_DIRECTORY")
+		if len(directory) == 0 {
+			directory = filepath.Join(os.TempDir(), "pi-designation-microservice")
+		}
+
+		logger.Infof(context.Background(), "storing last-known-good configurations in %s", directory)
+	})
+
+	return directory
+}
+
+func fileName(kind string, classID, designationID int64) string {
+	return filepath.Join(Directory(), fmt.Sprintf("%s-%d-%d", kind, classID, designationID))
+}
+
+//writes a successfully rendered configuration to disk, replacing the previous one atomically
+func Save(kind string, classID, designationID int64, data []byte) error {
+
+	err := os.MkdirAll(Directory(), 0755)
+	if err != nil {
+		msg := fmt.Sprintf("unable to create directory: %s", err.Error())
+		logger.Errorf(context.Background(), "%s", msg)
+		return errors.New(msg)
+	}
+
+	//write to a temp file first so a crash never leaves half a configuration behind
+	temp, err := ioutil.TempFile(Directory(), ".tmp-")
+	if err != nil {
+		msg := fmt.Sprintf("unable to create temp file: %s", err.Error())
+		logger.Errorf(context.Background(), "%s", msg)
+		return errors.New(msg)
+	}
+	defer os.Remove(temp.Name())
+
+	_, err = temp.Write(data)
+	if err == nil {
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		msg := fmt.Sprintf("unable to write configuration: %s", err.Error())
+		logger.Errorf(context.Background(), "%s", msg)
+		return errors.New(msg)
+	}
+
+	err = os.Rename(temp.Name(), fileName(kind, classID, designationID))
+	if err != nil {
+		msg := fmt.Sprintf("unable to replace configuration: %s", err.Error())
+		logger.Errorf(context.Background(), "%s", msg)
+		return errors.New(msg)
+	}
+
+	return nil
+}
+
+//reads the last successfully rendered configuration and when it was rendered
+func Load(kind string, classID, designationID int64) ([]byte, time.Time, error) {
+
+	name := fileName(kind, classID, designationID)
+
+	logger.Debugf(context.Background(), "loading last-known-good configuration from %s", name)
+
+	info, err := os.Stat(name)
+	if err != nil {
+		msg := fmt.Sprintf("no saved configuration: %s", err.Error())
+		logger.Errorf(context.Background(), "%s", msg)
+		return []byte{}, time.Time{}, errors.New(msg)
+	}
+
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		msg := fmt.Sprintf("unable to read saved configuration: %s", err.Error())
+		logger.Errorf(context.Background(), "%s", msg)
+		return []byte{}, time.Time{}, errors.New(msg)
+	}
+
+	return data, info.ModTime(), nil
+}
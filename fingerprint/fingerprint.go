@@ -0,0 +1,23 @@
+package fingerprint
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+//identifies the complete configuration a pi is running - shared by the service and the agent so they always agree
+func Configuration(variables, dockerCompose []byte) string {
+
+	hash := sha256.New()
+	hash.Write(variables)
+	hash.Write(dockerCompose)
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+//strong HTTP entity tag for a single rendered file
+func ETag(data []byte) string {
+
+	sum := sha256.Sum256(data)
+	return "\"" + hex.EncodeToString(sum[:]) + "\""
+}
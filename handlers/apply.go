@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+
+	ac "github.com/byuoitav/pi-designation-microservice/accessors"
+	"github.com/byuoitav/pi-designation-microservice/cache"
+	"github.com/labstack/echo"
+)
+
+//makes a class/designation match the desired state in the body - :class and :designation are IDs or names
+//?dry-run=true returns the plan without applying it
+func ApplyConfiguration(context echo.Context) error {
+
+	ctx := context.Request().Context()
+
+	classID, err := ac.ResolveDefinition(ctx, CLASS_TABLE_NAME, context.Param("class"))
+	if err != nil {
+		return Fail(context, http.StatusNotFound, err.Error(), err)
+	}
+
+	desigID, err := ac.ResolveDefinition(ctx, DESIGNATION_TABLE_NAME, context.Param("designation"))
+	if err != nil {
+		return Fail(context, http.StatusNotFound, err.Error(), err)
+	}
+
+	var desired ac.DesiredState
+	err = readDocument(context, &desired)
+	if err != nil {
+		logger.Errorf(ctx, "%s", err.Error())
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
+	}
+
+	dryRun := context.QueryParam("dry-run") == "true"
+
+	plan, err := ac.Apply(ctx, classID, desigID, desired, dryRun)
+	if err != nil {
+		msg := fmt.Sprintf("unable to apply configuration: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusInternalServerError, msg, err)
+	}
+
+	if plan.Applied {
+		cache.Invalidate(cache.VariableMappingsTag(classID, desigID), cache.MicroserviceMappingsTag(classID, desigID))
+	}
+
+	return context.JSON(http.StatusOK, plan)
+}
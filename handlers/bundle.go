@@ -0,0 +1,116 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	ac "github.com/byuoitav/pi-designation-microservice/accessors"
+	"github.com/byuoitav/pi-designation-microservice/apierrors"
+	"github.com/byuoitav/pi-designation-microservice/cache"
+	"github.com/labstack/echo"
+	yaml "gopkg.in/yaml.v2"
+)
+
+//what YAML exports are sent as
+const MIME_YAML = "application/x-yaml"
+
+//everything, by name - ?format=yaml for YAML, ?secrets=true to include the values of secret variables
+func Export(context echo.Context) error {
+
+	ctx := context.Request().Context()
+
+	bundle, err := ac.Export(ctx, context.QueryParam("secrets") == "true")
+	if err != nil {
+		msg := fmt.Sprintf("export failed: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusInternalServerError, msg, err)
+	}
+
+	if context.QueryParam("format") != "yaml" && !strings.Contains(context.Request().Header.Get(echo.HeaderAccept), "yaml") {
+		return context.JSON(http.StatusOK, bundle)
+	}
+
+	out, err := yaml.Marshal(bundle)
+	if err != nil {
+		msg := fmt.Sprintf("unable to write YAML: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusInternalServerError, msg, err)
+	}
+
+	return context.Blob(http.StatusOK, MIME_YAML, out)
+}
+
+//loads a bundle from /export - ?mode=merge (the default) or replace, and ?dry-run=true to see what would change without changing it
+//a JSON body is read as JSON, anything else as YAML
+func Import(context echo.Context) error {
+
+	ctx := context.Request().Context()
+
+	bundle, err := readBundle(context)
+	if err != nil {
+		logger.Errorf(ctx, "%s", err.Error())
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
+	}
+
+	mode := context.QueryParam("mode")
+	if len(mode) == 0 {
+		mode = ac.MERGE_IMPORT
+	}
+
+	dryRun := context.QueryParam("dry-run") == "true"
+
+	result, err := ac.Import(ctx, &bundle, mode, dryRun)
+	if err != nil {
+		msg := fmt.Sprintf("import failed: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusInternalServerError, msg, err)
+	}
+
+	if !dryRun {
+		cache.Flush()
+	}
+
+	return context.JSON(http.StatusOK, result)
+}
+
+//unknown fields are refused, so a typo doesn't quietly import as nothing
+func readBundle(context echo.Context) (ac.Bundle, error) {
+
+	var bundle ac.Bundle
+	err := readDocument(context, &bundle)
+	return bundle, err
+}
+
+//a JSON body is read as JSON, anything else as YAML - unknown fields are refused either way
+func readDocument(context echo.Context, output interface{}) error {
+
+	body, err := ioutil.ReadAll(context.Request().Body)
+	if err != nil {
+		return errors.New(fmt.Sprintf("unable to read body: %s", err.Error()))
+	}
+
+	if strings.HasPrefix(context.Request().Header.Get(echo.HeaderContentType), echo.MIMEApplicationJSON) {
+
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.DisallowUnknownFields()
+
+		err = decoder.Decode(output)
+		if err != nil {
+			return apierrors.BadRequest("", fmt.Sprintf("invalid JSON: %s", err.Error()))
+		}
+
+		return nil
+	}
+
+	err = yaml.UnmarshalStrict(body, output)
+	if err != nil {
+		return apierrors.BadRequest("", fmt.Sprintf("invalid YAML: %s", err.Error()))
+	}
+
+	return nil
+}
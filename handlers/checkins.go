@@ -0,0 +1,201 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	ac "github.com/byuoitav/pi-designation-microservice/accessors"
+	"github.com/byuoitav/pi-designation-microservice/fingerprint"
+	"github.com/labstack/echo"
+)
+
+//how a single pi compares to what it should be running
+type Drift struct {
+	Hostname             string    `json:"hostname"`
+	ClassID              int64     `json:"class"`
+	DesignationID        int64     `json:"designation"`
+	Room                 string    `json:"room"`
+	AppliedHash          string    `json:"applied-hash"`
+	CurrentHash          string    `json:"current-hash"`
+	Behind               bool      `json:"behind"`
+	MissingMicroservices []string  `json:"missing-microservices"`
+	CheckedInAt          time.Time `json:"checked-in-at"`
+	Error                string    `json:"error,omitempty"` //why what it should be running couldn't be worked out
+}
+
+//what a class/designation should look like on a pi
+type expectedConfiguration struct {
+	hash          string
+	microservices []string
+	err           error
+}
+
+func AddCheckin(context echo.Context) error {
+
+	ctx := context.Request().Context()
+
+	logger.Debugf(ctx, "binding new check-in...")
+
+	var checkin ac.Checkin
+	err := context.Bind(&checkin)
+	if err != nil {
+		msg := fmt.Sprintf("unable to bind JSON to struct: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
+	}
+
+	if checkin.ClassID == 0 || checkin.DesignationID == 0 {
+		msg := "class and designation are required"
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, nil)
+	}
+
+	err = ac.RecordCheckin(ctx, &checkin)
+	if err != nil {
+		msg := fmt.Sprintf("unable to record check-in: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
+	}
+
+	return context.JSON(http.StatusOK, "check-in recorded")
+}
+
+//lists pis that are behind the current configuration or missing microservices
+//filter with ?class=, ?designation= and ?room= - ?all=true includes pis that are up to date
+func GetDriftReport(context echo.Context) error {
+
+	ctx := context.Request().Context()
+
+	classID, err := ExtractQueryId(context, "class")
+	if err != nil {
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
+	}
+
+	designationID, err := ExtractQueryId(context, "designation")
+	if err != nil {
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
+	}
+
+	room := context.QueryParam("room")
+	all := context.QueryParam("all") == "true"
+
+	logger.Debugf(ctx, "building drift report for class: %d, designation: %d, room: '%s'", classID, designationID, room)
+
+	checkins, err := ac.GetCheckins(ctx, classID, designationID, room)
+	if err != nil {
+		msg := fmt.Sprintf("accessor error: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusInternalServerError, msg, err)
+	}
+
+	//lots of pis share a class/designation, only work each one out once
+	expected := make(map[string]*expectedConfiguration)
+
+	report := []Drift{}
+	for _, checkin := range checkins {
+
+		device := renderedFor(ctx, DOCKER_COMPOSE_CONFIGURATION, checkin.ClassID, checkin.DesignationID, Device{Room: checkin.Room, Hostname: checkin.Hostname})
+		scope := fmt.Sprintf("%d/%d/%s", checkin.ClassID, checkin.DesignationID, device.variant(DOCKER_COMPOSE_CONFIGURATION))
+		if _, ok := expected[scope]; !ok {
+			expected[scope] = getExpectedConfiguration(ctx, checkin.ClassID, checkin.DesignationID, device)
+		}
+
+		current := expected[scope]
+
+		//one class/designation that won't render shouldn't hide the rest of the fleet
+		if current.err != nil {
+			logger.Errorf(ctx, "unable to render configuration for class %d, designation %d: %s", checkin.ClassID, checkin.DesignationID, current.err.Error())
+
+			report = append(report, Drift{
+				Hostname:             checkin.Hostname,
+				ClassID:              checkin.ClassID,
+				DesignationID:        checkin.DesignationID,
+				Room:                 checkin.Room,
+				AppliedHash:          checkin.ConfigHash,
+				MissingMicroservices: []string{},
+				CheckedInAt:          checkin.CheckedInAt,
+				Error:                current.err.Error(),
+			})
+			continue
+		}
+
+		drift := Drift{
+			Hostname:             checkin.Hostname,
+			ClassID:              checkin.ClassID,
+			DesignationID:        checkin.DesignationID,
+			Room:                 checkin.Room,
+			AppliedHash:          checkin.ConfigHash,
+			CurrentHash:          current.hash,
+			Behind:               checkin.ConfigHash != current.hash,
+			MissingMicroservices: missingMicroservices(current.microservices, checkin.Containers),
+			CheckedInAt:          checkin.CheckedInAt,
+		}
+
+		if all || drift.Behind || len(drift.MissingMicroservices) > 0 {
+			report = append(report, drift)
+		}
+	}
+
+	return context.JSON(http.StatusOK, report)
+}
+
+//pis fetch their docker-compose file as themselves, so it's rendered the same way here
+func getExpectedConfiguration(ctx context.Context, classID, designationID int64, device Device) *expectedConfiguration {
+
+	//a pi that can't fetch its file as itself doesn't have an expected one either
+	err := device.Validate()
+	if err != nil {
+		return &expectedConfiguration{err: err}
+	}
+
+	variables, err := renderCached(ctx, VARIABLES_CONFIGURATION, classID, designationID, Device{}, RenderVariables)
+	if err != nil {
+		return &expectedConfiguration{err: err}
+	}
+
+	dockerCompose, err := renderCached(ctx, DOCKER_COMPOSE_CONFIGURATION, classID, designationID, device, RenderDockerCompose)
+	if err != nil {
+		return &expectedConfiguration{err: err}
+	}
+
+	microservices, err := ac.GetMicroserviceNamesByClassAndDesignation(ctx, classID, designationID)
+	if err != nil {
+		return &expectedConfiguration{err: err}
+	}
+
+	return &expectedConfiguration{
+		hash:          fingerprint.Configuration(variables, dockerCompose),
+		microservices: microservices,
+	}
+}
+
+//compose names containers <project>_<service>_<n> or <project>-<service>-<n>, so a microservice counts as running
+//if a container is named for it exactly or in one of those shapes - the project is one segment, so api doesn't count
+//for api-gateway and gateway doesn't count for proj_api-gateway_1
+func missingMicroservices(expected, containers []string) []string {
+
+	missing := []string{}
+	for _, microservice := range expected {
+
+		name := regexp.QuoteMeta(microservice)
+		pattern := regexp.MustCompile(`^(` + name + `|([^_]+_)?` + name + `(_[0-9]+)?|([^-]+-)?` + name + `(-[0-9]+)?)$`)
+
+		found := false
+		for _, container := range containers {
+			if pattern.MatchString(strings.TrimPrefix(container, "/")) {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			missing = append(missing, microservice)
+		}
+	}
+
+	return missing
+}
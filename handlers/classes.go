@@ -2,11 +2,10 @@ package handlers
 
 import (
 	"fmt"
-	"log"
 	"net/http"
 
 	ac "github.com/byuoitav/pi-designation-microservice/accessors"
-	"github.com/fatih/color"
+	"github.com/byuoitav/pi-designation-microservice/cache"
 	"github.com/labstack/echo"
 )
 
@@ -14,21 +13,23 @@ const CLASS_TABLE_NAME = "class_definitions"
 
 func AddClassDefinition(context echo.Context) error {
 
-	log.Printf("[handlers] binding new class definition...")
+	ctx := context.Request().Context()
+
+	logger.Debugf(ctx, "binding new class definition...")
 
 	var class ac.Definition
 	err := context.Bind(&class)
 	if err != nil {
 		msg := fmt.Sprintf("unable to bind JSON to struct: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[handlers] %s", msg))
-		return context.JSON(http.StatusBadRequest, msg)
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
 	}
 
-	err = ac.AddDefinition(CLASS_TABLE_NAME, &class)
+	err = ac.AddDefinition(ctx, CLASS_TABLE_NAME, &class)
 	if err != nil {
 		msg := fmt.Sprintf("accessor error: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[handlers] %s", msg))
-		return context.JSON(http.StatusBadRequest, msg)
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
 	}
 
 	return context.JSON(http.StatusOK, class)
@@ -36,76 +37,100 @@ func AddClassDefinition(context echo.Context) error {
 
 func EditClassDefinition(context echo.Context) error {
 
-	log.Printf("[handlers] editing class definition...")
+	ctx := context.Request().Context()
+
+	logger.Debugf(ctx, "editing class definition...")
+
+	version, err := ExtractIfMatch(context)
+	if err != nil {
+		return Fail(context, http.StatusPreconditionRequired, err.Error(), err)
+	}
 
 	var class ac.Definition
-	err := context.Bind(&class)
+	err = context.Bind(&class)
 	if err != nil {
 		msg := fmt.Sprintf("unable to bind JSON to struct: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[handlers] %s", msg))
-		return context.JSON(http.StatusBadRequest, msg)
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
 	}
 
-	err = ac.EditDefinition(CLASS_TABLE_NAME, &class)
+	class.Version = version
+
+	err = ac.EditDefinition(ctx, CLASS_TABLE_NAME, &class)
 	if err != nil {
 		msg := fmt.Sprintf("accessor error: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[handlers] %s", msg))
-		return context.JSON(http.StatusBadRequest, msg)
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
 	}
 
-	return context.JSON(http.StatusOK, class)
+	cache.Invalidate(cache.ClassTag(class.ID))
+
+	return SendVersioned(context, class.Version, class)
 }
 
 func GetClassDefinitionById(context echo.Context) error {
 
+	ctx := context.Request().Context()
+
 	id, err := ExtractId(context)
 	if err != nil {
-		return context.JSON(http.StatusBadRequest, err.Error())
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
 	}
 
-	log.Printf("[handlers] fetching class with id: %s", id)
+	logger.Debugf(ctx, "fetching class with id: %d", id)
 
 	var class ac.Definition
-	err = ac.GetDefinitionById(CLASS_TABLE_NAME, id, &class)
+	err = ac.GetDefinitionById(ctx, CLASS_TABLE_NAME, id, &class)
 	if err != nil {
 		msg := fmt.Sprintf("accessor error: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[handlers] %s", msg))
-		return context.JSON(http.StatusBadRequest, msg)
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
 	}
 
-	return context.JSON(http.StatusOK, class)
+	return SendVersioned(context, class.Version, class)
 }
 
 func GetAllClassDefinitions(context echo.Context) error {
 
-	log.Printf("[handlers] fetching all class definitions")
+	ctx := context.Request().Context()
+
+	logger.Debugf(ctx, "fetching all class definitions")
+
+	query, err := ExtractListQuery(context)
+	if err != nil {
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
+	}
 
 	var classes []ac.Definition
-	err := ac.GetAllDefinitions(CLASS_TABLE_NAME, &classes)
+	next, err := ac.GetAllDefinitions(ctx, CLASS_TABLE_NAME, query, &classes)
 	if err != nil {
 		msg := fmt.Sprintf("accessor error: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[handlers] %s", msg))
-		return context.JSON(http.StatusBadRequest, msg)
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
 	}
 
-	return context.JSON(http.StatusOK, classes)
+	return SendPage(context, classes, next)
 }
 
 func DeleteClassDefinition(context echo.Context) error {
 
-	log.Printf("[handlers] deleting class definition...")
+	ctx := context.Request().Context()
+
+	logger.Debugf(ctx, "deleting class definition...")
 
 	id, err := ExtractId(context)
 	if err != nil {
-		return context.JSON(http.StatusBadRequest, err.Error())
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
 	}
 
-	err = ac.DeleteDefinition(CLASS_TABLE_NAME, &id)
+	deletion, err := ac.DeleteDefinition(ctx, CLASS_TABLE_NAME, &id, context.QueryParam("force") == "true")
 	if err != nil {
 		msg := fmt.Sprintf("unable to delete definition: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[handlers] %s", msg))
-		return context.JSON(http.StatusBadRequest, msg)
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
 	}
 
-	return context.JSON(http.StatusOK, "item deleted")
+	cache.Invalidate(cache.ClassTag(id))
+
+	return context.JSON(http.StatusOK, deletion)
 }
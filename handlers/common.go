@@ -1,22 +1,135 @@
 package handlers
 
 import (
-	"errors"
 	"fmt"
+	"net/http"
 	"strconv"
+	"strings"
 
+	ac "github.com/byuoitav/pi-designation-microservice/accessors"
+	"github.com/byuoitav/pi-designation-microservice/apierrors"
+	"github.com/byuoitav/pi-designation-microservice/logging"
 	"github.com/labstack/echo"
 )
 
+var logger = logging.New("handlers")
+
+//carries the cursor of the next page of a list - absent on the last page
+const NEXT_CURSOR_HEADER = "X-Next-Cursor"
+
+//edits send back the ETag of the version they're editing
+const IF_MATCH_HEADER = "If-Match"
+
 func ExtractId(context echo.Context) (int64, error) {
 
-	stringId := context.Param("id")
+	return ExtractParamId(context, "id")
+}
+
+//reads an integer path parameter
+func ExtractParamId(context echo.Context, name string) (int64, error) {
+
+	stringId := context.Param(name)
+	intId, err := strconv.Atoi(stringId)
+	if err != nil {
+		msg := fmt.Sprintf("invalid %s: %s", name, err.Error())
+		return 0, apierrors.BadRequest(name, msg)
+	}
+
+	return int64(intId), nil
+}
+
+//reads an optional integer query parameter - missing means zero
+func ExtractQueryId(context echo.Context, name string) (int64, error) {
+
+	stringId := context.QueryParam(name)
+	if len(stringId) == 0 {
+		return 0, nil
+	}
+
 	intId, err := strconv.Atoi(stringId)
 	if err != nil {
-		msg := fmt.Sprintf("invalid ID: %s", err.Error())
-		return 0, errors.New(msg)
+		msg := fmt.Sprintf("invalid %s: %s", name, err.Error())
+		return 0, apierrors.BadRequest(name, msg)
 	}
 
 	return int64(intId), nil
+}
+
+//reads limit, cursor, search, sort and the filters in ac.LIST_FILTERS
+func ExtractListQuery(context echo.Context) (ac.ListQuery, error) {
+
+	query := ac.ListQuery{
+		Cursor:  context.QueryParam("cursor"),
+		Search:  context.QueryParam("search"),
+		Sort:    context.QueryParam("sort"),
+		Filters: make(map[string]string),
+	}
+
+	if limit := context.QueryParam("limit"); len(limit) > 0 {
+
+		var err error
+		query.Limit, err = strconv.Atoi(limit)
+		if err != nil || query.Limit < 1 {
+			msg := fmt.Sprintf("invalid limit: %s", limit)
+			return query, apierrors.BadRequest("limit", msg)
+		}
+	}
+
+	for _, name := range ac.LIST_FILTERS {
+		query.Filters[name] = context.QueryParam(name)
+	}
+
+	return query, nil
+}
+
+//sends a page of a list, pointing at the next one if there is one
+func SendPage(context echo.Context, page interface{}, next string) error {
+
+	if len(next) > 0 {
+		context.Response().Header().Set(NEXT_CURSOR_HEADER, next)
+	}
+
+	return context.JSON(http.StatusOK, page)
+}
+
+//the ETag of a definition or mapping at version
+func VersionETag(version int64) string {
+
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+//the version an edit expects, from If-Match - "*" edits whatever's there and comes back as zero
+func ExtractIfMatch(context echo.Context) (int64, error) {
+
+	header := strings.TrimSpace(context.Request().Header.Get(IF_MATCH_HEADER))
+	if len(header) == 0 {
+		return 0, apierrors.VersionRequired("edits need an If-Match header with the ETag of the version being edited")
+	}
+
+	if header == "*" {
+		return 0, nil
+	}
+
+	version, err := strconv.ParseInt(strings.Trim(strings.TrimPrefix(header, "W/"), `"`), 10, 64)
+	if err != nil || version < 1 {
+		msg := fmt.Sprintf("invalid If-Match: %s", header)
+		return 0, apierrors.BadRequest(IF_MATCH_HEADER, msg)
+	}
+
+	return version, nil
+}
+
+//sends a definition or mapping with the ETag of its version
+func SendVersioned(context echo.Context, version int64, body interface{}) error {
+
+	context.Response().Header().Set(ETAG_HEADER, VersionETag(version))
+	return context.JSON(http.StatusOK, body)
+}
+
+//responds with an apierrors.Error
+//accessor and database errors bring their own status, code and field - anything else gets status
+func Fail(context echo.Context, status int, message string, err error) error {
 
+	response := apierrors.From(err, status, message)
+	return context.JSON(response.Status(), response)
 }
@@ -0,0 +1,220 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	ac "github.com/byuoitav/pi-designation-microservice/accessors"
+	"github.com/byuoitav/pi-designation-microservice/cache"
+	"github.com/labstack/echo"
+)
+
+//everything that keeps a class/designation from being fully configured
+type CompletenessReport struct {
+	Complete           bool                `json:"complete"`
+	MissingVariables   []string            `json:"missing-variables"`   //required by the class but not mapped
+	UnmappedReferences []UnmappedReference `json:"unmapped-references"` //used in YAML but not mapped
+	DuplicateVariables []DuplicateVariable `json:"duplicate-variables"` //mapped more than once
+}
+
+type UnmappedReference struct {
+	Microservice string   `json:"microservice"`
+	Variables    []string `json:"variables"`
+}
+
+type DuplicateVariable struct {
+	Name   string   `json:"name"`
+	Values []string `json:"values"`
+}
+
+//what completeness reports are cached as
+const COMPLETENESS_REPORT = "completeness"
+
+//${NAME}, ${NAME:?err}, ${NAME:-default} and $NAME - $$ is an escaped dollar sign
+var variableReference = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)(:?[-?][^}]*)?\}|\$([A-Za-z_][A-Za-z0-9_]*)`)
+
+//.Variables.NAME and index .Variables "NAME" in templated YAML
+var templateReference = regexp.MustCompile(`\.Variables\.([A-Za-z_][A-Za-z0-9_]*)|index\s+\.Variables\s+"([^"]+)"`)
+
+func GetCompletenessReport(context echo.Context) error {
+
+	ctx := context.Request().Context()
+
+	desigInt, err := ExtractParamId(context, "designation")
+	if err != nil {
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
+	}
+
+	classInt, err := ExtractParamId(context, "class")
+	if err != nil {
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
+	}
+
+	logger.Debugf(ctx, "checking completeness of class: %d, designation: %d", classInt, desigInt)
+
+	report, err := CheckCompleteness(ctx, classInt, desigInt)
+	if err != nil {
+		msg := fmt.Sprintf("unable to check configuration: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusInternalServerError, msg, err)
+	}
+
+	return context.JSON(http.StatusOK, report)
+}
+
+//cached like the configurations it describes, so ?strict=true doesn't cost a fetch its cache hit
+func CheckCompleteness(ctx context.Context, classID, desigID int64) (CompletenessReport, error) {
+
+	var report CompletenessReport
+
+	data, err := cache.Get(cache.Key(COMPLETENESS_REPORT, classID, desigID), func() ([]byte, []string, error) {
+
+		report, tags, err := checkCompleteness(ctx, classID, desigID)
+		if err != nil {
+			return []byte{}, []string{}, err
+		}
+
+		data, err := json.Marshal(report)
+		return data, tags, err
+	})
+	if err != nil {
+		return report, err
+	}
+
+	err = json.Unmarshal(data, &report)
+	return report, err
+}
+
+//the report and the cache tags it depends on
+func checkCompleteness(ctx context.Context, classID, desigID int64) (CompletenessReport, []string, error) {
+
+	report := CompletenessReport{
+		MissingVariables:   []string{},
+		UnmappedReferences: []UnmappedReference{},
+		DuplicateVariables: []DuplicateVariable{},
+	}
+
+	vars, err := ac.GetVariablesByClassAndDesignation(ctx, classID, desigID)
+	if err != nil {
+		return report, []string{}, errors.New(fmt.Sprintf("variables not found: %s", err.Error()))
+	}
+
+	tags := []string{
+		cache.ClassTag(classID),
+		cache.DesignationTag(desigID),
+		cache.VariableMappingsTag(classID, desigID),
+		cache.VariableDefaultsTag(),
+		cache.RequiredVariablesTag(),
+		cache.MicroserviceMappingsTag(classID, desigID),
+	}
+
+	for _, variable := range vars {
+		tags = append(tags, cache.VariableTag(variable.Variable.ID))
+	}
+
+	mapped := make(map[string][]string)
+	var names []string
+	for _, variable := range vars {
+
+		if _, ok := mapped[variable.Variable.Name]; !ok {
+			names = append(names, variable.Variable.Name)
+		}
+
+		mapped[variable.Variable.Name] = append(mapped[variable.Variable.Name], variable.Value)
+	}
+
+	//each of these becomes its own export line and the last one wins
+	for _, name := range names {
+		if len(mapped[name]) > 1 {
+			report.DuplicateVariables = append(report.DuplicateVariables, DuplicateVariable{Name: name, Values: mapped[name]})
+		}
+	}
+
+	required, err := ac.GetRequiredVariables(ctx, classID)
+	if err != nil {
+		return report, []string{}, err
+	}
+
+	for _, variable := range required {
+		if _, ok := mapped[variable.Name]; !ok {
+			report.MissingVariables = append(report.MissingVariables, variable.Name)
+		}
+	}
+
+	var snippets []ac.DBMicroservice
+	err = ac.GetDockerComposeByDesignationAndClass(ctx, &snippets, classID, desigID)
+	if err != nil {
+		return report, []string{}, errors.New(fmt.Sprintf("docker-compose data not found: %s", err.Error()))
+	}
+
+	for _, snippet := range snippets {
+
+		tags = append(tags, cache.MicroserviceTag(snippet.MicroID))
+
+		var microservice ac.Microservice
+		err = ac.GetMicroserviceDefinitionById(ctx, snippet.MicroID, &microservice)
+		if err != nil {
+			return report, []string{}, err
+		}
+
+		text, err := ac.MicroserviceYAML(snippet, microservice, "")
+		if err != nil {
+			return report, []string{}, err
+		}
+
+		unmapped := unmappedReferences(text, mapped)
+		if len(unmapped) == 0 {
+			continue
+		}
+
+		report.UnmappedReferences = append(report.UnmappedReferences, UnmappedReference{Microservice: microservice.Name, Variables: unmapped})
+	}
+
+	report.Complete = len(report.MissingVariables) == 0 && len(report.UnmappedReferences) == 0 && len(report.DuplicateVariables) == 0
+
+	return report, tags, nil
+}
+
+//references without a default that no mapping provides
+func unmappedReferences(yaml string, mapped map[string][]string) []string {
+
+	found := make(map[string]bool)
+	for _, match := range variableReference.FindAllStringSubmatch(yaml, -1) {
+
+		name := match[1] + match[3]
+		if len(name) == 0 {
+			continue //$$
+		}
+
+		//compose fills in ${NAME-default} and ${NAME:-default} on its own
+		if strings.HasPrefix(strings.TrimPrefix(match[2], ":"), "-") {
+			continue
+		}
+
+		if _, ok := mapped[name]; !ok {
+			found[name] = true
+		}
+	}
+
+	for _, match := range templateReference.FindAllStringSubmatch(yaml, -1) {
+
+		name := match[1] + match[2]
+		if _, ok := mapped[name]; !ok {
+			found[name] = true
+		}
+	}
+
+	unmapped := []string{}
+	for name := range found {
+		unmapped = append(unmapped, name)
+	}
+	sort.Strings(unmapped)
+
+	return unmapped
+}
@@ -2,53 +2,82 @@ package handlers
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
-	"strconv"
 	"strings"
+	"time"
 
 	ac "github.com/byuoitav/pi-designation-microservice/accessors"
-	"github.com/fatih/color"
+	"github.com/byuoitav/pi-designation-microservice/cache"
+	"github.com/byuoitav/pi-designation-microservice/fallback"
+	"github.com/byuoitav/pi-designation-microservice/fingerprint"
+	"github.com/byuoitav/pi-designation-microservice/metrics"
 	"github.com/labstack/echo"
 )
 
+const VARIABLES_CONFIGURATION = "variables"
+const DOCKER_COMPOSE_CONFIGURATION = "docker-compose"
+
+//set when the database couldn't render a configuration and we served the last one that did
+const STALE_CONFIGURATION_HEADER = "X-Configuration-Stale"
+
+const ETAG_HEADER = "ETag"
+
+//renders a configuration and lists the cache tags it depends on
+type renderer func(ctx context.Context, classID, desigID int64, device Device) ([]byte, []string, error)
+
 func GetVariablesByDesignationAndClass(context echo.Context) error {
 
-	desig := context.Param("designation")
-	desigInt, err := strconv.Atoi(desig)
+	ctx := context.Request().Context()
+
+	desigInt, err := ExtractParamId(context, "designation")
 	if err != nil {
-		return context.JSON(http.StatusBadRequest, err.Error())
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
 	}
 
-	class := context.Param("class")
-	classInt, err := strconv.Atoi(class)
+	classInt, err := ExtractParamId(context, "class")
 	if err != nil {
-		return context.JSON(http.StatusBadRequest, err.Error())
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
 	}
 
-	log.Printf("%s", color.HiCyanString("[handlers] fetching all variables from desigation: %d, class: %d", desigInt, classInt))
+	logger.Infof(ctx, "fetching all variables from desigation: %d, class: %d", desigInt, classInt)
 
-	vars, err := ac.GetVariablesByClassAndDesignation(int64(classInt), int64(desigInt))
+	return serveConfiguration(context, VARIABLES_CONFIGURATION, classInt, desigInt, Device{}, RenderVariables)
+}
+
+//builds the variables file for a class/designation and lists the cache tags it depends on
+//the variables file is the same for every device
+func RenderVariables(ctx context.Context, classID, desigID int64, device Device) ([]byte, []string, error) {
+
+	vars, err := ac.GetVariablesByClassAndDesignation(ctx, classID, desigID)
 	if err != nil {
-		msg := fmt.Sprintf("variables not found: %s", err.Error())
-		log.Printf("%s", color.HiRedString)
-		return context.JSON(http.StatusBadRequest, msg)
+		return []byte{}, []string{}, errors.New(fmt.Sprintf("variables not found: %s", err.Error()))
 	}
 
-	file, err := ConvertVariablesToBytes(vars)
+	file, err := ConvertVariablesToBytes(ctx, vars)
 	if err != nil {
-		msg := fmt.Sprintf("error converting variables to text: %s", err.Error())
-		log.Printf("%s", color.HiRedString)
-		return context.JSON(http.StatusBadRequest, msg)
+		return []byte{}, []string{}, errors.New(fmt.Sprintf("error converting variables to text: %s", err.Error()))
 	}
 
-	return context.Blob(http.StatusOK, "text/plain", file)
+	tags := []string{
+		cache.ClassTag(classID),
+		cache.DesignationTag(desigID),
+		cache.VariableMappingsTag(classID, desigID),
+		cache.VariableDefaultsTag(),
+	}
+
+	for _, variable := range vars {
+		tags = append(tags, cache.VariableTag(variable.Variable.ID))
+	}
+
+	return file, tags, nil
 }
 
-func ConvertVariablesToBytes(vars []ac.VariableMapping) ([]byte, error) {
+func ConvertVariablesToBytes(ctx context.Context, vars []ac.VariableMapping) ([]byte, error) {
 
-	log.Printf("[handlers] converting variable structs to text...")
+	logger.Debugf(ctx, "converting variable structs to text...")
 	var output bytes.Buffer
 
 	for _, variable := range vars {
@@ -57,6 +86,9 @@ func ConvertVariablesToBytes(vars []ac.VariableMapping) ([]byte, error) {
 		output.WriteString(variable.Variable.Name)
 		output.WriteString("=")
 		output.WriteString(fmt.Sprintf("\"%v\"", strings.Trim(variable.Value, "\"")))
+		if variable.Default {
+			output.WriteString(" # default")
+		}
 		output.WriteString("\n")
 	}
 
@@ -65,52 +97,224 @@ func ConvertVariablesToBytes(vars []ac.VariableMapping) ([]byte, error) {
 
 func GetDockerComposeByDesignationAndClass(context echo.Context) error {
 
-	desig := context.Param("designation")
-	desigInt, err := strconv.Atoi(desig)
+	ctx := context.Request().Context()
+
+	desigInt, err := ExtractParamId(context, "designation")
 	if err != nil {
-		return context.JSON(http.StatusBadRequest, err.Error())
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
 	}
 
-	class := context.Param("class")
-	classInt, err := strconv.Atoi(class)
+	classInt, err := ExtractParamId(context, "class")
 	if err != nil {
-		return context.JSON(http.StatusBadRequest, err.Error())
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
 	}
 
-	log.Printf("%s", color.HiCyanString("[handlers] fetching all variables from desigation: %d, class: %d", desigInt, classInt))
+	logger.Infof(ctx, "fetching all variables from desigation: %d, class: %d", desigInt, classInt)
+
+	device, err := ExtractDevice(context)
+	if err != nil {
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
+	}
+
+	return serveConfiguration(context, DOCKER_COMPOSE_CONFIGURATION, classInt, desigInt, device, RenderDockerCompose)
+}
+
+//builds the docker-compose file for a class/designation and lists the cache tags it depends on
+func RenderDockerCompose(ctx context.Context, classID, desigID int64, device Device) ([]byte, []string, error) {
 
 	var yamlSnippets []ac.DBMicroservice
-	err = ac.GetDockerComposeByDesignationAndClass(&yamlSnippets, int64(classInt), int64(desigInt))
+	err := ac.GetDockerComposeByDesignationAndClass(ctx, &yamlSnippets, classID, desigID)
 	if err != nil {
-		msg := fmt.Sprintf("docker-compose data not found: %s", err.Error())
-		log.Printf("%s", color.HiRedString)
-		return context.JSON(http.StatusBadRequest, msg)
+		return []byte{}, []string{}, errors.New(fmt.Sprintf("docker-compose data not found: %s", err.Error()))
+	}
+
+	tags := []string{
+		cache.ClassTag(classID),
+		cache.DesignationTag(desigID),
+		cache.MicroserviceMappingsTag(classID, desigID),
+	}
+
+	//templates can use variables, so only then does the file depend on them
+	var templateContext *ac.TemplateContext
+	for _, snippet := range yamlSnippets {
+
+		if !ac.IsTemplate(snippet.YAML) {
+			continue
+		}
+
+		loaded, vars, err := NewTemplateContext(ctx, classID, desigID, device)
+		if err != nil {
+			return []byte{}, []string{}, err
+		}
+
+		templateContext = &loaded
+		tags = append(tags, cache.VariableMappingsTag(classID, desigID), cache.VariableDefaultsTag())
+		for _, variable := range vars {
+			tags = append(tags, cache.VariableTag(variable.Variable.ID))
+		}
+
+		break
 	}
 
-	file, err := ConvertYamlToBytes(yamlSnippets)
+	snippets, err := GetMicroserviceYAML(ctx, yamlSnippets, templateContext)
 	if err != nil {
-		msg := fmt.Sprintf("unable to parse YAML: %s", err.Error())
-		log.Printf("%s", color.HiRedString)
-		return context.JSON(http.StatusBadRequest, msg)
+		return []byte{}, []string{}, err
 	}
 
-	return context.Blob(http.StatusOK, "text/plain", file)
+	file, err := ConvertYamlToBytes(ctx, snippets)
+	if err != nil {
+		return []byte{}, []string{}, errors.New(fmt.Sprintf("unable to parse YAML: %s", err.Error()))
+	}
+
+	for _, snippet := range yamlSnippets {
+		tags = append(tags, cache.MicroserviceTag(snippet.MicroID), cache.ImageTagTag(snippet.MicroID, desigID))
+	}
+
+	return file, tags, nil
+}
+
+//looks up each mapping's microservice and builds its snippet
+//templateContext is only needed when one of the mappings is a template
+func GetMicroserviceYAML(ctx context.Context, mappings []ac.DBMicroservice, templateContext *ac.TemplateContext) ([]string, error) {
+
+	definitions := make(map[int64]ac.Microservice)
+	pins := make(map[int64]map[int64]string) //designation -> microservice -> tag
+
+	var snippets []string
+	for _, mapping := range mappings {
+
+		microservice, ok := definitions[mapping.MicroID]
+		if !ok {
+			err := ac.GetMicroserviceDefinitionById(ctx, mapping.MicroID, &microservice)
+			if err != nil {
+				return []string{}, errors.New(fmt.Sprintf("microservice not found: %s", err.Error()))
+			}
+
+			definitions[mapping.MicroID] = microservice
+		}
+
+		if _, ok := pins[mapping.DesigID]; !ok {
+			tags, err := ac.GetImageTagsByDesignation(ctx, mapping.DesigID)
+			if err != nil {
+				return []string{}, err
+			}
+
+			pins[mapping.DesigID] = tags
+		}
+
+		if ac.IsTemplate(mapping.YAML) {
+			if templateContext == nil {
+				return []string{}, errors.New(fmt.Sprintf("no template context for %s", microservice.Name))
+			}
+
+			rendered, err := ac.RenderTemplate(microservice.Name, mapping.YAML, *templateContext)
+			if err != nil {
+				return []string{}, err
+			}
+
+			mapping.YAML = rendered
+		}
+
+		snippet, err := ac.MicroserviceYAML(mapping, microservice, pins[mapping.DesigID][mapping.MicroID])
+		if err != nil {
+			return []string{}, err
+		}
+
+		snippets = append(snippets, snippet)
+	}
+
+	return snippets, nil
 }
 
-func ConvertYamlToBytes(microservices []ac.DBMicroservice) ([]byte, error) {
+func ConvertYamlToBytes(ctx context.Context, snippets []string) ([]byte, error) {
 
-	log.Printf("[handlers] converting microservice structs to text...")
+	logger.Debugf(ctx, "converting microservice structs to text...")
 
 	var output bytes.Buffer
 
 	output.WriteString("version: '3'\nservices:\n") //common to all JSON
 
-	for _, microservice := range microservices {
+	for _, snippet := range snippets {
 
-		output.WriteString(microservice.YAML)
+		output.WriteString(snippet)
 		output.WriteString("\n")
 	}
 
 	return output.Bytes(), nil
 
 }
+
+//serves a rendered configuration, falling back to the last one that rendered successfully if the live render fails
+//?strict=true refuses to serve a configuration that's missing something - see CheckCompleteness
+func serveConfiguration(context echo.Context, kind string, classID, desigID int64, device Device, render renderer) error {
+
+	ctx := context.Request().Context()
+
+	if context.QueryParam("strict") == "true" {
+
+		report, err := CheckCompleteness(ctx, classID, desigID)
+		if err == nil && !report.Complete {
+			logger.Errorf(ctx, "refusing to serve incomplete %s configuration for class: %d, designation: %d", kind, classID, desigID)
+			return context.JSON(http.StatusUnprocessableEntity, report)
+		}
+
+		//if we can't check, the render below fails the same way and falls back to the last good copy
+	}
+
+	device = renderedFor(ctx, kind, classID, desigID, device)
+
+	file, err := renderCached(ctx, kind, classID, desigID, device, render)
+	if err != nil {
+		logger.Errorf(ctx, "%s", err.Error())
+
+		//a pi that gets its own render only falls back to its own copy - the shared one has its room and device left blank
+		saved, renderedAt, fallbackErr := fallback.Load(device.variant(kind), classID, desigID)
+		if fallbackErr != nil {
+			return Fail(context, http.StatusBadRequest, err.Error(), err)
+		}
+
+		logger.Warnf(ctx, "serving stale %s configuration for class: %d, designation: %d rendered at %s", kind, classID, desigID, renderedAt.Format(time.RFC3339))
+
+		context.Response().Header().Set(STALE_CONFIGURATION_HEADER, "true")
+		context.Response().Header().Set(echo.HeaderLastModified, renderedAt.UTC().Format(http.TimeFormat))
+		return serveFile(context, kind, classID, desigID, saved, true)
+	}
+
+	return serveFile(context, kind, classID, desigID, file, false)
+}
+
+//tags the file so pis can tell what they got, and remembers who fetched it
+func serveFile(context echo.Context, kind string, classID, desigID int64, file []byte, stale bool) error {
+
+	etag := fingerprint.ETag(file)
+	recordFetch(context, kind, classID, desigID, etag, stale)
+
+	context.Response().Header().Set(ETAG_HEADER, etag)
+	return context.Blob(http.StatusOK, "text/plain", file)
+}
+
+//renders through the cache, keeping a copy on disk of every successful render
+//device should have been through renderedFor, so pis only get their own entry when their file is actually different
+func renderCached(ctx context.Context, kind string, classID, desigID int64, device Device, render renderer) ([]byte, error) {
+
+	key := cache.Key(device.variant(kind), classID, desigID)
+	return cache.Get(key, func() ([]byte, []string, error) {
+
+		data, tags, err := render(ctx, classID, desigID, device)
+		if err == nil {
+			metrics.ObserveRender(kind, len(data))
+			fallback.Save(device.variant(kind), classID, desigID, data) //a full disk shouldn't stop us from serving
+		}
+
+		return data, tags, err
+	})
+}
+
+func GetConfigurationCacheStats(context echo.Context) error {
+
+	ctx := context.Request().Context()
+
+	logger.Debugf(ctx, "fetching configuration cache stats...")
+
+	return context.JSON(http.StatusOK, cache.GetStats())
+}
@@ -2,11 +2,10 @@ package handlers
 
 import (
 	"fmt"
-	"log"
 	"net/http"
 
 	ac "github.com/byuoitav/pi-designation-microservice/accessors"
-	"github.com/fatih/color"
+	"github.com/byuoitav/pi-designation-microservice/cache"
 	"github.com/labstack/echo"
 )
 
@@ -14,100 +13,126 @@ const DESIGNATION_TABLE_NAME = "designation_definitions"
 
 func AddDesignationDefinition(context echo.Context) error {
 
-	log.Printf("[handlers] adding new desigation definition")
+	ctx := context.Request().Context()
+
+	logger.Debugf(ctx, "adding new desigation definition")
 
 	var designation ac.Definition
 	err := context.Bind(&designation)
 	if err != nil {
 		msg := fmt.Sprintf("unable to bind JSON to struct: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[handlers] %s", msg))
-		return context.JSON(http.StatusInternalServerError, msg)
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
 	}
 
-	err = ac.AddDefinition(DESIGNATION_TABLE_NAME, &designation)
+	err = ac.AddDefinition(ctx, DESIGNATION_TABLE_NAME, &designation)
 	if err != nil {
 		msg := fmt.Sprintf("error adding designation: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[handlers] %s", msg))
-		return context.JSON(http.StatusInternalServerError, msg)
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusInternalServerError, msg, err)
 	}
 
-	log.Printf("%s", color.HiGreenString("[handlers] successfully added desigation: %s", designation.Name))
+	logger.Infof(ctx, "successfully added desigation: %s", designation.Name)
 
 	return context.JSON(http.StatusOK, designation)
 }
 
 func EditDesignationDefinition(context echo.Context) error {
 
-	log.Printf("[handlers] editing designation definition")
+	ctx := context.Request().Context()
+
+	logger.Debugf(ctx, "editing designation definition")
+
+	version, err := ExtractIfMatch(context)
+	if err != nil {
+		return Fail(context, http.StatusPreconditionRequired, err.Error(), err)
+	}
 
 	var designation ac.Definition
-	err := context.Bind(&designation)
+	err = context.Bind(&designation)
 	if err != nil {
 		msg := fmt.Sprintf("unable to bind JSON to struct %s", err.Error())
-		log.Printf("%s", color.HiRedString("[handlers] %s", msg))
-		return context.JSON(http.StatusBadRequest, msg)
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
 	}
 
-	err = ac.EditDefinition(DESIGNATION_TABLE_NAME, &designation)
+	designation.Version = version
+
+	err = ac.EditDefinition(ctx, DESIGNATION_TABLE_NAME, &designation)
 	if err != nil {
 		msg := fmt.Sprintf("entry not updated: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[handlers] %s", msg))
-		return context.JSON(http.StatusBadRequest, msg)
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
 	}
 
-	return context.JSON(http.StatusOK, designation)
+	cache.Invalidate(cache.DesignationTag(designation.ID))
+
+	return SendVersioned(context, designation.Version, designation)
 }
 
 func GetDesignationDefinitionById(context echo.Context) error {
 
+	ctx := context.Request().Context()
+
 	id, err := ExtractId(context)
 	if err != nil {
-		return context.JSON(http.StatusBadRequest, err.Error())
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
 	}
 
-	log.Printf("[handlers] getting designation with ID: %s", id)
+	logger.Debugf(ctx, "getting designation with ID: %d", id)
 
 	var designation ac.Definition
-	err = ac.GetDefinitionById(DESIGNATION_TABLE_NAME, id, &designation)
+	err = ac.GetDefinitionById(ctx, DESIGNATION_TABLE_NAME, id, &designation)
 	if err != nil {
 		msg := fmt.Sprintf("Designation definition not found: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[handlers] %s", msg))
-		return context.JSON(http.StatusBadRequest, msg)
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
 	}
 
-	return context.JSON(http.StatusOK, designation)
+	return SendVersioned(context, designation.Version, designation)
 }
 
 func GetAllDesignationDefinitions(context echo.Context) error {
 
-	log.Printf("[handlers] fetching all designation definitions...")
+	ctx := context.Request().Context()
+
+	logger.Debugf(ctx, "fetching all designation definitions...")
+
+	query, err := ExtractListQuery(context)
+	if err != nil {
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
+	}
 
 	var designations []ac.Definition
-	err := ac.GetAllDefinitions(DESIGNATION_TABLE_NAME, &designations)
+	next, err := ac.GetAllDefinitions(ctx, DESIGNATION_TABLE_NAME, query, &designations)
 	if err != nil {
 		msg := fmt.Sprintf("Designation definitions not found: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[handlers] %s", msg))
-		return context.JSON(http.StatusBadRequest, msg)
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
 	}
 
-	return context.JSON(http.StatusOK, designations)
+	return SendPage(context, designations, next)
 }
 
 func DeleteDesignationDefinition(context echo.Context) error {
 
-	log.Printf("[handlers] deleting designation definition...")
+	ctx := context.Request().Context()
+
+	logger.Debugf(ctx, "deleting designation definition...")
 
 	id, err := ExtractId(context)
 	if err != nil {
-		return context.JSON(http.StatusBadRequest, err.Error())
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
 	}
 
-	err = ac.DeleteDefinition(DESIGNATION_TABLE_NAME, &id)
+	deletion, err := ac.DeleteDefinition(ctx, DESIGNATION_TABLE_NAME, &id, context.QueryParam("force") == "true")
 	if err != nil {
 		msg := fmt.Sprintf("unable to delete definition: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[handlers] %s", msg))
-		return context.JSON(http.StatusBadRequest, msg)
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
 	}
 
-	return context.JSON(http.StatusOK, "item deleted")
+	cache.Invalidate(cache.DesignationTag(id))
+
+	return context.JSON(http.StatusOK, deletion)
 }
@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	ac "github.com/byuoitav/pi-designation-microservice/accessors"
+	"github.com/byuoitav/pi-designation-microservice/apierrors"
+	"github.com/byuoitav/pi-designation-microservice/metrics"
+	"github.com/labstack/echo"
+)
+
+//pis identify themselves with this header - otherwise we only know their address
+const DEVICE_HOSTNAME_HEADER = "X-Device-Hostname"
+
+const DEFAULT_FETCH_LIMIT = 100
+
+//queues the fetch log to be written in the background so a slow database doesn't hold up the pi
+func recordFetch(context echo.Context, kind string, classID, desigID int64, etag string, stale bool) {
+
+	fetch := ac.Fetch{
+		Client:        context.Request().Header.Get(DEVICE_HOSTNAME_HEADER),
+		Address:       context.RealIP(),
+		ClassID:       classID,
+		DesignationID: desigID,
+		Configuration: kind,
+		ETag:          etag,
+		Stale:         stale,
+	}
+
+	if len(fetch.Client) == 0 {
+		fetch.Client = fetch.Address
+	}
+
+	metrics.ObserveFetch(kind, classID, desigID, stale)
+
+	if !ac.QueueFetch(fetch) {
+		metrics.ObserveDroppedFetch()
+	}
+}
+
+//the last time every pi fetched its configuration - filter with ?class= and ?designation=
+func GetLastSeen(context echo.Context) error {
+
+	return lastSeen(context, 0)
+}
+
+//pis that haven't fetched anything in ?hours= hours (24 by default)
+func GetUnseenDevices(context echo.Context) error {
+
+	hours := int64(24)
+
+	if len(context.QueryParam("hours")) > 0 {
+		parsed, err := strconv.Atoi(context.QueryParam("hours"))
+		if err != nil || parsed < 1 {
+			return context.JSON(http.StatusBadRequest, apierrors.BadRequest("hours", "invalid hours"))
+		}
+
+		hours = int64(parsed)
+	}
+
+	return lastSeen(context, hours)
+}
+
+func lastSeen(context echo.Context, unseenHours int64) error {
+
+	ctx := context.Request().Context()
+
+	classID, err := ExtractQueryId(context, "class")
+	if err != nil {
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
+	}
+
+	designationID, err := ExtractQueryId(context, "designation")
+	if err != nil {
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
+	}
+
+	logger.Debugf(ctx, "fetching last seen devices...")
+
+	fetches, err := ac.GetLastSeen(ctx, classID, designationID, unseenHours)
+	if err != nil {
+		msg := fmt.Sprintf("accessor error: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusInternalServerError, msg, err)
+	}
+
+	return context.JSON(http.StatusOK, fetches)
+}
+
+//the fetch history of a single pi, newest first - ?limit= defaults to 100
+func GetDeviceFetches(context echo.Context) error {
+
+	ctx := context.Request().Context()
+
+	client := context.Param("client")
+
+	limit, err := ExtractQueryId(context, "limit")
+	if err != nil {
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
+	}
+
+	if limit < 1 {
+		limit = DEFAULT_FETCH_LIMIT
+	}
+
+	logger.Debugf(ctx, "fetching configuration fetches by %s...", client)
+
+	fetches, err := ac.GetFetchesByClient(ctx, client, limit)
+	if err != nil {
+		msg := fmt.Sprintf("accessor error: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusInternalServerError, msg, err)
+	}
+
+	return context.JSON(http.StatusOK, fetches)
+}
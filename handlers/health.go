@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	ac "github.com/byuoitav/pi-designation-microservice/accessors"
+	"github.com/byuoitav/pi-designation-microservice/directory"
+	"github.com/labstack/echo"
+)
+
+//how long /ready and /status wait on the database
+const READY_TIMEOUT = 2 * time.Second
+
+//read at startup - override with DESIGNATION_VERSION_FILE
+const DEFAULT_VERSION_FILE = "version.txt"
+
+type Status struct {
+	Version       string            `json:"version"`
+	StartedAt     time.Time         `json:"started-at"`
+	Uptime        string            `json:"uptime"`
+	UptimeSeconds int64             `json:"uptime-seconds"`
+	SchemaVersion int64             `json:"schema-version"`
+	Database      DatabaseStatus    `json:"database"`
+	Directory     *directory.Status `json:"directory,omitempty"` //only when configuration comes from a directory
+}
+
+type DatabaseStatus struct {
+	Reachable          bool   `json:"reachable"`
+	Error              string `json:"error,omitempty"`
+	OpenConnections    int    `json:"open-connections"`
+	InUse              int    `json:"in-use"`
+	Idle               int    `json:"idle"`
+	MaxOpenConnections int    `json:"max-open-connections"`
+	WaitCount          int64  `json:"wait-count"`
+	WaitDuration       string `json:"wait-duration"`
+}
+
+/** all the good stuff lives here **/
+var started = time.Now()
+var version = readVersion()
+
+func readVersion() string {
+
+	path := os.Getenv("DESIGNATION_VERSION_FILE")
+	if len(path) == 0 {
+		path = DEFAULT_VERSION_FILE
+	}
+
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		logger.Warnf(context.Background(), "unable to read version from %s: %s", path, err.Error())
+		return "unknown"
+	}
+
+	return strings.TrimSpace(string(contents))
+}
+
+//the process is up - says nothing about the database
+func Health(context echo.Context) error {
+
+	return context.JSON(http.StatusOK, "healthy")
+}
+
+//the process is up and the database answers
+func Ready(context echo.Context) error {
+
+	ctx := context.Request().Context()
+
+	err := ac.PingDatabase(ctx, READY_TIMEOUT)
+	if err != nil {
+		return Fail(context, http.StatusServiceUnavailable, err.Error(), err)
+	}
+
+	return context.JSON(http.StatusOK, "ready")
+}
+
+func GetStatus(context echo.Context) error {
+
+	ctx := context.Request().Context()
+
+	uptime := time.Since(started)
+
+	status := Status{
+		Version:       version,
+		StartedAt:     started,
+		Uptime:        uptime.Truncate(time.Second).String(),
+		UptimeSeconds: int64(uptime.Seconds()),
+	}
+
+	if directory.Enabled() {
+		loaded := directory.GetStatus()
+		status.Directory = &loaded
+	}
+
+	stats := ac.GetDatabaseStats()
+	status.Database = DatabaseStatus{
+		OpenConnections:    stats.OpenConnections,
+		InUse:              stats.InUse,
+		Idle:               stats.Idle,
+		MaxOpenConnections: stats.MaxOpenConnections,
+		WaitCount:          stats.WaitCount,
+		WaitDuration:       stats.WaitDuration.String(),
+	}
+
+	err := ac.PingDatabase(ctx, READY_TIMEOUT)
+	if err == nil {
+		status.Database.Reachable = true
+		status.SchemaVersion, err = ac.GetSchemaVersion(ctx)
+	}
+
+	if err != nil {
+		msg := fmt.Sprintf("database check failed: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+
+		status.Database.Error = err.Error()
+		return context.JSON(http.StatusServiceUnavailable, status)
+	}
+
+	return context.JSON(http.StatusOK, status)
+}
@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+
+	ac "github.com/byuoitav/pi-designation-microservice/accessors"
+	"github.com/labstack/echo"
+)
+
+func GetClassDefinitionImpact(context echo.Context) error {
+
+	return getImpact(context, CLASS_TABLE_NAME)
+}
+
+func GetDesignationDefinitionImpact(context echo.Context) error {
+
+	return getImpact(context, DESIGNATION_TABLE_NAME)
+}
+
+func GetVariableDefinitionImpact(context echo.Context) error {
+
+	return getImpact(context, VARIABLE_DEFINITION_TABLE)
+}
+
+func GetMicroserviceDefinitionImpact(context echo.Context) error {
+
+	return getImpact(context, MICROSERVICE_DEFINITION_TABLE)
+}
+
+//everything a delete of the definition would remove along with it
+func getImpact(context echo.Context, table string) error {
+
+	ctx := context.Request().Context()
+
+	id, err := ExtractId(context)
+	if err != nil {
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
+	}
+
+	impact, err := ac.GetImpact(ctx, table, id)
+	if err != nil {
+		msg := fmt.Sprintf("unable to find dependents: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusInternalServerError, msg, err)
+	}
+
+	return context.JSON(http.StatusOK, impact)
+}
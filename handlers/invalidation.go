@@ -0,0 +1,36 @@
+package handlers
+
+import (
+	"context"
+
+	ac "github.com/byuoitav/pi-designation-microservice/accessors"
+)
+
+//builds a cache tag for a class/designation pair
+type scopeTagger func(classID, designationID int64) string
+
+//finds the tag for the scope a mapping lives in before it gets edited or deleted
+func mappingScopeTags(ctx context.Context, table string, id int64, tagger scopeTagger) []string {
+
+	scope, err := ac.GetMappingScope(ctx, table, id)
+	if err != nil {
+		//the write is about to fail too, so there's nothing to invalidate
+		logger.Warnf(ctx, "no cache scope for mapping %d in %s: %s", id, table, err.Error())
+		return []string{}
+	}
+
+	return []string{tagger(scope.ClassID, scope.DesigID)}
+}
+
+//every class/designation pair touched by a batch
+func batchScopeTags(ctx context.Context, batch *ac.Batch, tagger scopeTagger) []string {
+
+	var tags []string
+	for _, class := range batch.Classes {
+		for _, designation := range class.Designations {
+			tags = append(tags, tagger(class.ID, designation))
+		}
+	}
+
+	return tags
+}
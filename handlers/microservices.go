@@ -1,14 +1,15 @@
 package handlers
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
-	"strconv"
+	"strings"
 
 	ac "github.com/byuoitav/pi-designation-microservice/accessors"
-	"github.com/fatih/color"
+	"github.com/byuoitav/pi-designation-microservice/cache"
 	"github.com/labstack/echo"
 )
 
@@ -19,123 +20,145 @@ const MICROSERVICE_COLUMN_NAME = "yaml"
 
 func AddMicroserviceDefinition(context echo.Context) error {
 
-	log.Printf("[handlers] binding new microservice definition...")
+	ctx := context.Request().Context()
 
-	var microservice ac.Definition
+	logger.Debugf(ctx, "binding new microservice definition...")
+
+	var microservice ac.Microservice
 	err := context.Bind(&microservice)
 	if err != nil {
-		msg := fmt.Sprintf("unable to JSON to struct", err.Error())
-		log.Printf("%s", color.HiRedString("[handlers] %s", msg))
-		return context.JSON(http.StatusBadRequest, msg)
+		msg := fmt.Sprintf("unable to bind JSON to struct: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
 	}
 
-	err = ac.AddDefinition(MICROSERVICE_DEFINITION_TABLE, &microservice)
+	err = ac.AddMicroserviceDefinition(ctx, &microservice)
 	if err != nil {
 		msg := fmt.Sprintf("unable to add microservice %s", err.Error())
-		log.Printf("%s", color.HiRedString("[handlers] %s", msg))
-		return context.JSON(http.StatusBadRequest, msg)
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
 	}
 
-	log.Printf("%s", color.HiGreenString("[handlers] successuflly added new microservice: %s", microservice.Name))
+	logger.Infof(ctx, "successuflly added new microservice: %s", microservice.Name)
 
 	return context.JSON(http.StatusOK, microservice)
 }
 
 func EditMicroserviceDefinition(context echo.Context) error {
 
-	log.Printf("[handlers] binding microservice definition...")
+	ctx := context.Request().Context()
 
-	var microservice ac.Definition
-	err := context.Bind(&microservice)
+	logger.Debugf(ctx, "binding microservice definition...")
+
+	version, err := ExtractIfMatch(context)
+	if err != nil {
+		return Fail(context, http.StatusPreconditionRequired, err.Error(), err)
+	}
+
+	var microservice ac.Microservice
+	err = context.Bind(&microservice)
 	if err != nil {
-		msg := fmt.Sprintf("unable to JSON to struct", err.Error())
-		log.Printf("%s", color.HiRedString("[handlers] %s", msg))
-		return context.JSON(http.StatusBadRequest, msg)
+		msg := fmt.Sprintf("unable to bind JSON to struct: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
 	}
 
-	log.Printf("[handlers] editing microservice definition...")
+	microservice.Version = version
+
+	logger.Debugf(ctx, "editing microservice definition...")
 
-	err = ac.EditDefinition(MICROSERVICE_DEFINITION_TABLE, &microservice)
+	err = ac.EditMicroserviceDefinition(ctx, &microservice)
 	if err != nil {
 		msg := fmt.Sprintf("unable to add microservice %s", err.Error())
-		log.Printf("%s", color.HiRedString("[handlers] %s", msg))
-		return context.JSON(http.StatusBadRequest, msg)
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
 	}
 
-	log.Printf("%s", color.HiGreenString("[handlers] successuflly added new microservice: %s", microservice.Name))
+	cache.Invalidate(cache.MicroserviceTag(microservice.ID))
 
-	return context.JSON(http.StatusOK, microservice)
+	logger.Infof(ctx, "successuflly added new microservice: %s", microservice.Name)
+
+	return SendVersioned(context, microservice.Version, microservice)
 }
 
 func DeleteMicroserviceDefinition(context echo.Context) error {
 
-	log.Printf("[handlers] deleting microservice definition...")
+	ctx := context.Request().Context()
+
+	logger.Debugf(ctx, "deleting microservice definition...")
 
 	id, err := ExtractId(context)
 	if err != nil {
-		return context.JSON(http.StatusBadRequest, err.Error())
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
 	}
 
-	err = ac.DeleteDefinition(MICROSERVICE_DEFINITION_TABLE, &id)
+	deletion, err := ac.DeleteDefinition(ctx, MICROSERVICE_DEFINITION_TABLE, &id, context.QueryParam("force") == "true")
 	if err != nil {
 		msg := fmt.Sprintf("unable to delete definition: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[handlers] %s", msg))
-		return context.JSON(http.StatusBadRequest, msg)
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
 	}
 
-	return context.JSON(http.StatusOK, "item deleted")
+	cache.Invalidate(cache.MicroserviceTag(id))
+
+	return context.JSON(http.StatusOK, deletion)
 }
 
 func AddMicroserviceMapping(context echo.Context) error {
 
-	log.Printf("[handlers] binding microservice mapping...")
+	ctx := context.Request().Context()
 
-	//get IDs
-	class := context.Param("class")
-	desig := context.Param("designation")
-	microservice := context.Param("microservice")
+	logger.Debugf(ctx, "binding microservice mapping...")
 
-	classId, err := strconv.Atoi(class)
+	classId, err := ExtractParamId(context, "class")
 	if err != nil {
-		return err
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
 	}
 
-	desigId, err := strconv.Atoi(desig)
+	desigId, err := ExtractParamId(context, "designation")
 	if err != nil {
-		return err
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
 	}
 
-	microId, err := strconv.Atoi(microservice)
+	microId, err := ExtractParamId(context, "microservice")
 	if err != nil {
-		return err
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
 	}
 
-	request := context.Request()
-	yaml, err := ioutil.ReadAll(request.Body)
+	yaml, overrides, err := readMicroserviceMapping(context, microId, classId, desigId)
 	if err != nil {
-		return err
+		msg := fmt.Sprintf("unable to add microservice mapping: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
 	}
 
-	id, err := ac.AddMapping(
-		MICROSERVICE_MAPPINGS_TABLE,
-		MICROSERVICE_DEFINITION_COLUMN,
-		MICROSERVICE_COLUMN_NAME,
-		string(yaml),
-		int64(microId),
-		int64(classId),
-		int64(desigId))
+	var id int64
+	if overrides != nil {
+		id, err = ac.AddMicroserviceSpecMapping(ctx, *overrides, microId, classId, desigId)
+	} else {
+		id, err = ac.AddMapping(ctx,
+			MICROSERVICE_MAPPINGS_TABLE,
+			MICROSERVICE_DEFINITION_COLUMN,
+			MICROSERVICE_COLUMN_NAME,
+			yaml,
+			microId,
+			classId,
+			desigId)
+	}
 	if err != nil {
 		msg := fmt.Sprintf("unable to add microservice mapping: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[handlers] %s", msg))
-		return context.JSON(http.StatusBadRequest, msg)
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
 	}
 
+	cache.Invalidate(cache.MicroserviceMappingsTag(classId, desigId))
+
 	var entry ac.MicroserviceMapping
-	err = ac.GetMicroserviceMappingById(id, &entry)
+	err = ac.GetMicroserviceMappingById(ctx, id, &entry)
 	if err != nil {
 		msg := fmt.Sprintf("mapping entry not found: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[handlers] %s", msg))
-		return context.JSON(http.StatusBadRequest, msg)
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
 	}
 
 	return context.JSON(http.StatusOK, entry)
@@ -143,94 +166,125 @@ func AddMicroserviceMapping(context echo.Context) error {
 
 func EditMicroserviceMapping(context echo.Context) error {
 
-	log.Printf("[handlers] binding microservice mapping...")
+	ctx := context.Request().Context()
 
-	//get IDs
-	class := context.Param("class")
-	desig := context.Param("designation")
-	microservice := context.Param("microservice")
-	mapping := context.Param("mapping")
+	logger.Debugf(ctx, "binding microservice mapping...")
 
-	classId, err := strconv.Atoi(class)
+	classId, err := ExtractParamId(context, "class")
 	if err != nil {
-		return err
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
 	}
 
-	desigId, err := strconv.Atoi(desig)
+	desigId, err := ExtractParamId(context, "designation")
 	if err != nil {
-		return err
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
 	}
 
-	microId, err := strconv.Atoi(microservice)
+	microId, err := ExtractParamId(context, "microservice")
 	if err != nil {
-		return err
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
 	}
 
-	mappingId, err := strconv.Atoi(mapping)
+	mappingId, err := ExtractParamId(context, "mapping")
 	if err != nil {
-		return err
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
 	}
 
-	request := context.Request()
-	yaml, err := ioutil.ReadAll(request.Body)
+	version, err := ExtractIfMatch(context)
 	if err != nil {
-		return err
+		return Fail(context, http.StatusPreconditionRequired, err.Error(), err)
 	}
 
-	err = ac.EditMapping(
-		MICROSERVICE_MAPPINGS_TABLE,
-		MICROSERVICE_DEFINITION_COLUMN,
-		MICROSERVICE_COLUMN_NAME,
-		string(yaml),
-		int64(microId),
-		int64(classId),
-		int64(desigId),
-		int64(mappingId))
+	yaml, overrides, err := readMicroserviceMapping(context, microId, classId, desigId)
 	if err != nil {
 		msg := fmt.Sprintf("unable edit mapping: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[handlers] %s", msg))
-		return context.JSON(http.StatusBadRequest, msg)
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
 	}
 
+	tags := mappingScopeTags(ctx, MICROSERVICE_MAPPINGS_TABLE, mappingId, cache.MicroserviceMappingsTag)
+
+	var edited int64
+	if overrides != nil {
+		edited, err = ac.EditMicroserviceSpecMapping(ctx, *overrides, microId, classId, desigId, mappingId, version)
+	} else {
+		edited, err = ac.EditMapping(ctx,
+			MICROSERVICE_MAPPINGS_TABLE,
+			MICROSERVICE_DEFINITION_COLUMN,
+			MICROSERVICE_COLUMN_NAME,
+			yaml,
+			microId,
+			classId,
+			desigId,
+			mappingId,
+			version)
+	}
+	if err != nil {
+		msg := fmt.Sprintf("unable edit mapping: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
+	}
+
+	cache.Invalidate(append(tags, cache.MicroserviceMappingsTag(classId, desigId))...)
+
 	var entry ac.MicroserviceMapping
-	err = ac.GetMicroserviceMappingById(int64(mappingId), &entry)
+	err = ac.GetMicroserviceMappingById(ctx, mappingId, &entry)
 	if err != nil {
 		msg := fmt.Sprintf("new entries not found: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[handlers] %s", msg))
-		return context.JSON(http.StatusInternalServerError, msg)
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusInternalServerError, msg, err)
 	}
 
-	return context.JSON(http.StatusOK, entry)
+	//the ETag is the version this edit made, even if someone else has edited it since
+	return SendVersioned(context, edited, entry)
 }
 
 func AddMicroserviceMappings(context echo.Context) error {
 
-	log.Printf("[handlers] binding new microservice mapppings...")
+	ctx := context.Request().Context()
+
+	logger.Debugf(ctx, "binding new microservice mapppings...")
 
 	var mappings ac.Batch
 	err := context.Bind(&mappings)
 	if err != nil {
 		msg := fmt.Sprintf("unable to bind JSON to struct: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[handlers] %s", msg))
-		return context.JSON(http.StatusBadRequest, msg)
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
 	}
 
-	lastInserted, err := ac.AddMappings(
+	for _, class := range mappings.Classes {
+		for _, desigID := range class.Designations {
+
+			err = checkTemplate(ctx, mappings.Value, mappings.ID, class.ID, desigID)
+			if err != nil {
+				msg := fmt.Sprintf("mappings not added: %s", err.Error())
+				logger.Errorf(ctx, "%s", msg)
+				return Fail(context, http.StatusBadRequest, msg, err)
+			}
+		}
+	}
+
+	lastInserted, err := ac.AddMappings(ctx,
 		MICROSERVICE_MAPPINGS_TABLE,
 		MICROSERVICE_DEFINITION_COLUMN,
 		MICROSERVICE_COLUMN_NAME,
 		&mappings)
+
+	//a failed batch may still have inserted some rows
+	cache.Invalidate(batchScopeTags(ctx, &mappings, cache.MicroserviceMappingsTag)...)
+
 	if err != nil {
 		msg := fmt.Sprintf("variables not added: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[handlers] %s", msg))
-		return context.JSON(http.StatusBadRequest, msg)
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
 	}
 
-	entries, err := ac.GetMicroserviceMappingsById(lastInserted)
+	entries, err := ac.GetMicroserviceMappingsById(ctx, lastInserted)
 	if err != nil {
 		msg := fmt.Sprintf("new entries not found: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[handlers] %s", msg))
-		return context.JSON(http.StatusInternalServerError, msg)
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusInternalServerError, msg, err)
 	}
 
 	return context.JSON(http.StatusOK, entries)
@@ -238,87 +292,174 @@ func AddMicroserviceMappings(context echo.Context) error {
 
 func GetMicroserviceDefinitionById(context echo.Context) error {
 
+	ctx := context.Request().Context()
+
 	id, err := ExtractId(context)
 	if err != nil {
-		return context.JSON(http.StatusBadRequest, err.Error())
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
 	}
 
-	log.Printf("[handlers] getting variable definition with ID: %d", id)
+	logger.Debugf(ctx, "getting variable definition with ID: %d", id)
 
-	var microservice ac.Definition
-	err = ac.GetDefinitionById(MICROSERVICE_DEFINITION_TABLE, id, &microservice)
+	var microservice ac.Microservice
+	err = ac.GetMicroserviceDefinitionById(ctx, id, &microservice)
 	if err != nil {
 		msg := fmt.Sprintf("accessor error: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[handlers] %s", msg))
-		return context.JSON(http.StatusBadRequest, msg)
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
 	}
 
-	return context.JSON(http.StatusOK, microservice)
+	return SendVersioned(context, microservice.Version, microservice)
 
 }
 
 func GetAllMicroserviceDefinitions(context echo.Context) error {
 
-	log.Printf("[handlers] fetching all microservice definitions...")
+	ctx := context.Request().Context()
+
+	logger.Debugf(ctx, "fetching all microservice definitions...")
+
+	query, err := ExtractListQuery(context)
+	if err != nil {
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
+	}
 
-	var microservices []ac.Definition
-	err := ac.GetAllDefinitions(MICROSERVICE_DEFINITION_TABLE, &microservices)
+	microservices, next, err := ac.GetAllMicroserviceDefinitions(ctx, query)
 	if err != nil {
 		msg := fmt.Sprintf("accessor error: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[handlers] %s", msg))
-		return context.JSON(http.StatusBadRequest, msg)
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
 	}
 
-	return context.JSON(http.StatusOK, microservices)
+	return SendPage(context, microservices, next)
 }
 
 func GetMicroserviceMappingById(context echo.Context) error {
 
+	ctx := context.Request().Context()
+
 	id, err := ExtractId(context)
 	if err != nil {
-		return context.JSON(http.StatusBadRequest, err.Error())
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
 	}
 
-	log.Printf("[handlers] getting microservice mapping with ID: %d", id)
+	logger.Debugf(ctx, "getting microservice mapping with ID: %d", id)
 
 	var microservice ac.MicroserviceMapping
-	err = ac.GetMicroserviceMappingById(id, &microservice)
+	err = ac.GetMicroserviceMappingById(ctx, id, &microservice)
 	if err != nil {
 		msg := fmt.Sprintf("accessor error: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[handlers] %s", msg))
-		return context.JSON(http.StatusBadRequest, msg)
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
 	}
 
-	return context.JSON(http.StatusOK, microservice)
+	return SendVersioned(context, microservice.Version, microservice)
 }
 
 func GetAllMicroserviceMappings(context echo.Context) error {
 
-	log.Printf("[handlers] fetching all microservice mappings...")
+	ctx := context.Request().Context()
+
+	logger.Debugf(ctx, "fetching all microservice mappings...")
+
+	query, err := ExtractListQuery(context)
+	if err != nil {
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
+	}
 
-	microservices, err := ac.GetAllMicroserviceMappings()
+	microservices, next, err := ac.GetAllMicroserviceMappings(ctx, query)
 	if err != nil {
 		msg := fmt.Sprintf("accessor error: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[handlers] %s", msg))
-		return context.JSON(http.StatusInternalServerError, msg)
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusInternalServerError, msg, err)
 	}
 
-	return context.JSON(http.StatusOK, microservices)
+	return SendPage(context, microservices, next)
 }
 
 func DeleteMicroserviceMapping(context echo.Context) error {
 
+	ctx := context.Request().Context()
+
 	id, err := ExtractId(context)
 	if err != nil {
-		return context.JSON(http.StatusBadRequest, err.Error())
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
 	}
 
-	log.Printf("[handlers] deleting variable mapping with id %d...", id)
+	logger.Debugf(ctx, "deleting variable mapping with id %d...", id)
 
-	err = ac.DeleteMapping(MICROSERVICE_MAPPINGS_TABLE, id)
+	tags := mappingScopeTags(ctx, MICROSERVICE_MAPPINGS_TABLE, id, cache.MicroserviceMappingsTag)
+
+	deletion, err := ac.DeleteMapping(ctx, MICROSERVICE_MAPPINGS_TABLE, id)
 	if err != nil {
-		return context.JSON(http.StatusBadRequest, err.Error())
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
+	}
+
+	cache.Invalidate(tags...)
+
+	return context.JSON(http.StatusOK, deletion)
+}
+
+//a JSON body holds overrides for the microservice's spec, anything else is a hand-written YAML snippet
+func readMicroserviceMapping(context echo.Context, microserviceID, classID, desigID int64) (string, *ac.MicroserviceSpec, error) {
+
+	ctx := context.Request().Context()
+
+	request := context.Request()
+
+	if !strings.HasPrefix(request.Header.Get(echo.HeaderContentType), echo.MIMEApplicationJSON) {
+
+		yaml, err := ioutil.ReadAll(request.Body)
+		if err != nil {
+			return "", nil, err
+		}
+
+		err = checkTemplate(ctx, string(yaml), microserviceID, classID, desigID)
+		if err != nil {
+			return "", nil, err
+		}
+
+		return string(yaml), nil, nil
+	}
+
+	var overrides ac.MicroserviceSpec
+	err := context.Bind(&overrides)
+	if err != nil {
+		return "", nil, errors.New(fmt.Sprintf("unable to bind JSON to struct: %s", err.Error()))
+	}
+
+	//make sure the result is something we can render
+	var microservice ac.Microservice
+	err = ac.GetMicroserviceDefinitionById(ctx, microserviceID, &microservice)
+	if err != nil {
+		return "", nil, err
+	}
+
+	err = ac.CheckOverrides(microservice, overrides)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return "", &overrides, nil
+}
+
+//renders a templated snippet the way the class/designation would see it - see ac.CheckTemplate
+func checkTemplate(ctx context.Context, yaml string, microserviceID, classID, desigID int64) error {
+
+	if !ac.IsTemplate(yaml) {
+		return nil
+	}
+
+	var microservice ac.Microservice
+	err := ac.GetMicroserviceDefinitionById(ctx, microserviceID, &microservice)
+	if err != nil {
+		return err
+	}
+
+	templateContext, _, err := NewTemplateContext(ctx, classID, desigID, Device{})
+	if err != nil {
+		return err
 	}
 
-	return context.JSON(http.StatusOK, "item successfully deleted")
+	return ac.CheckTemplate(microservice, yaml, templateContext)
 }
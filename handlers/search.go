@@ -0,0 +1,24 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+
+	ac "github.com/byuoitav/pi-designation-microservice/accessors"
+	"github.com/labstack/echo"
+)
+
+//everything whose name, description, value or YAML contains ?q= - secret values are left out
+func Search(context echo.Context) error {
+
+	ctx := context.Request().Context()
+
+	results, err := ac.Search(ctx, context.QueryParam("q"))
+	if err != nil {
+		msg := fmt.Sprintf("search failed: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusInternalServerError, msg, err)
+	}
+
+	return context.JSON(http.StatusOK, results)
+}
@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+
+	ac "github.com/byuoitav/pi-designation-microservice/accessors"
+	"github.com/byuoitav/pi-designation-microservice/apierrors"
+	"github.com/byuoitav/pi-designation-microservice/cache"
+	"github.com/labstack/echo"
+)
+
+//body of a tag bump - either an explicit tag, or the tag currently pinned in another designation
+type TagBump struct {
+	Tag          string  `json:"tag"`
+	From         int64   `json:"from"`
+	Designations []int64 `json:"designations"`
+}
+
+func GetImageTags(context echo.Context) error {
+
+	ctx := context.Request().Context()
+
+	microID, err := ExtractQueryId(context, "microservice")
+	if err != nil {
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
+	}
+
+	desigID, err := ExtractQueryId(context, "designation")
+	if err != nil {
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
+	}
+
+	tags, err := ac.GetImageTags(ctx, microID, desigID)
+	if err != nil {
+		msg := fmt.Sprintf("unable to get image tags: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusInternalServerError, msg, err)
+	}
+
+	return context.JSON(http.StatusOK, tags)
+}
+
+func SetImageTag(context echo.Context) error {
+
+	ctx := context.Request().Context()
+
+	microID, desigID, err := extractTagIds(context)
+	if err != nil {
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
+	}
+
+	var tag ac.ImageTag
+	err = context.Bind(&tag)
+	if err != nil {
+		msg := fmt.Sprintf("unable to bind JSON to struct: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
+	}
+
+	err = ac.SetImageTag(ctx, microID, []int64{desigID}, tag.Tag)
+	if err != nil {
+		msg := fmt.Sprintf("unable to set image tag: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
+	}
+
+	cache.Invalidate(cache.ImageTagTag(microID, desigID))
+
+	logger.Infof(ctx, "pinned microservice %d to %s in designation %d", microID, tag.Tag, desigID)
+
+	return context.JSON(http.StatusOK, ac.ImageTag{MicroserviceID: microID, DesignationID: desigID, Tag: tag.Tag})
+}
+
+func DeleteImageTag(context echo.Context) error {
+
+	ctx := context.Request().Context()
+
+	microID, desigID, err := extractTagIds(context)
+	if err != nil {
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
+	}
+
+	err = ac.DeleteImageTag(ctx, microID, desigID)
+	if err != nil {
+		msg := fmt.Sprintf("unable to delete image tag: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
+	}
+
+	cache.Invalidate(cache.ImageTagTag(microID, desigID))
+
+	return context.JSON(http.StatusOK, "item deleted")
+}
+
+//moves a microservice to a new tag in several designations at once, e.g. promoting stage's release candidate to prod
+func BumpImageTag(context echo.Context) error {
+
+	ctx := context.Request().Context()
+
+	microID, err := ExtractParamId(context, "microservice")
+	if err != nil {
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
+	}
+
+	var bump TagBump
+	err = context.Bind(&bump)
+	if err != nil {
+		msg := fmt.Sprintf("unable to bind JSON to struct: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
+	}
+
+	if len(bump.Designations) == 0 {
+		return context.JSON(http.StatusBadRequest, apierrors.BadRequest("designations", "no designations to bump"))
+	}
+
+	if (len(bump.Tag) > 0) == (bump.From != 0) {
+		return context.JSON(http.StatusBadRequest, apierrors.BadRequest("tag", "specify either a tag or a designation to copy the tag from"))
+	}
+
+	if bump.From != 0 {
+		pinned, err := ac.GetImageTagsByDesignation(ctx, bump.From)
+		if err != nil {
+			msg := fmt.Sprintf("unable to get image tags: %s", err.Error())
+			logger.Errorf(ctx, "%s", msg)
+			return Fail(context, http.StatusInternalServerError, msg, err)
+		}
+
+		tag, ok := pinned[microID]
+		if !ok {
+			msg := fmt.Sprintf("microservice %d has no tag pinned in designation %d", microID, bump.From)
+			logger.Errorf(ctx, "%s", msg)
+			return Fail(context, http.StatusBadRequest, msg, nil)
+		}
+
+		bump.Tag = tag
+	}
+
+	err = ac.SetImageTag(ctx, microID, bump.Designations, bump.Tag)
+	if err != nil {
+		msg := fmt.Sprintf("unable to bump image tag: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
+	}
+
+	var tags []string
+	for _, desigID := range bump.Designations {
+		tags = append(tags, cache.ImageTagTag(microID, desigID))
+	}
+	cache.Invalidate(tags...)
+
+	logger.Infof(ctx, "bumped microservice %d to %s in designations %v", microID, bump.Tag, bump.Designations)
+
+	return context.JSON(http.StatusOK, bump)
+}
+
+func extractTagIds(context echo.Context) (int64, int64, error) {
+
+	microID, err := ExtractParamId(context, "microservice")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	desigID, err := ExtractParamId(context, "designation")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return microID, desigID, nil
+}
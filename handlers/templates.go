@@ -0,0 +1,213 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"text/template"
+	"text/template/parse"
+
+	ac "github.com/byuoitav/pi-designation-microservice/accessors"
+	"github.com/byuoitav/pi-designation-microservice/apierrors"
+	"github.com/byuoitav/pi-designation-microservice/cache"
+	"github.com/byuoitav/pi-designation-microservice/fingerprint"
+	"github.com/labstack/echo"
+)
+
+//what the answer to "does this class/designation's YAML read .Room or .Device" is cached as
+const DEVICE_FIELDS = "device-fields"
+
+//rooms and hostnames go into the YAML as-is, so only plain names are accepted
+var deviceName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+//the pi a configuration is rendered for - only known when it passes ?room= or ?device=
+type Device struct {
+	Room     string
+	Hostname string
+}
+
+func ExtractDevice(context echo.Context) (Device, error) {
+
+	device := Device{Room: context.QueryParam("room"), Hostname: context.QueryParam("device")}
+	return device, device.Validate()
+}
+
+func (device Device) Validate() error {
+
+	if len(device.Room) > 0 && !deviceName.MatchString(device.Room) {
+		return apierrors.BadRequest("room", fmt.Sprintf("invalid room %q - only letters, numbers, '.', '_' and '-' are allowed", device.Room))
+	}
+
+	if len(device.Hostname) > 0 && !deviceName.MatchString(device.Hostname) {
+		return apierrors.BadRequest("device", fmt.Sprintf("invalid device %q - only letters, numbers, '.', '_' and '-' are allowed", device.Hostname))
+	}
+
+	return nil
+}
+
+func (device Device) IsEmpty() bool {
+	return len(device.Room) == 0 && len(device.Hostname) == 0
+}
+
+//renders for a particular pi get their own cache entry and last-known-good copy
+func (device Device) variant(kind string) string {
+
+	if device.IsEmpty() {
+		return kind
+	}
+
+	return kind + "-" + fingerprint.Configuration([]byte(device.Room), []byte(device.Hostname))[:16]
+}
+
+//a docker-compose file only differs from pi to pi when one of its templates reads .Room or .Device
+//everyone else gets the file rendered without a device, so a fleet shares one cache entry and one last-known-good copy
+func renderedFor(ctx context.Context, kind string, classID, desigID int64, device Device) Device {
+
+	if kind != DOCKER_COMPOSE_CONFIGURATION || device.IsEmpty() {
+		return Device{}
+	}
+
+	//if we can't tell, rendering for the pi is never wrong
+	uses, err := usesDevice(ctx, classID, desigID)
+	if err != nil || uses {
+		return device
+	}
+
+	return Device{}
+}
+
+func usesDevice(ctx context.Context, classID, desigID int64) (bool, error) {
+
+	data, err := cache.Get(cache.Key(DEVICE_FIELDS, classID, desigID), func() ([]byte, []string, error) {
+
+		var snippets []ac.DBMicroservice
+		err := ac.GetDockerComposeByDesignationAndClass(ctx, &snippets, classID, desigID)
+		if err != nil {
+			return []byte{}, []string{}, errors.New(fmt.Sprintf("docker-compose data not found: %s", err.Error()))
+		}
+
+		tags := []string{cache.ClassTag(classID), cache.DesignationTag(desigID), cache.MicroserviceMappingsTag(classID, desigID)}
+
+		for _, snippet := range snippets {
+			if readsDevice(snippet.YAML) {
+				return []byte("true"), tags, nil
+			}
+		}
+
+		return []byte("false"), tags, nil
+	})
+
+	return string(data) == "true", err
+}
+
+//whether a template could read .Room or .Device - anything we can't be sure about counts
+func readsDevice(yaml string) bool {
+
+	if !ac.IsTemplate(yaml) {
+		return false
+	}
+
+	parsed, err := template.New("").Parse(yaml)
+	if err != nil {
+		return true
+	}
+
+	for _, defined := range parsed.Templates() {
+		if defined.Tree != nil && nodeReadsDevice(defined.Tree.Root) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func nodeReadsDevice(node parse.Node) bool {
+
+	switch node := node.(type) {
+	case *parse.ListNode:
+		if node == nil {
+			return false
+		}
+		for _, child := range node.Nodes {
+			if nodeReadsDevice(child) {
+				return true
+			}
+		}
+	case *parse.ActionNode:
+		return nodeReadsDevice(node.Pipe)
+	case *parse.PipeNode:
+		if node == nil {
+			return false
+		}
+		for _, command := range node.Cmds {
+			if nodeReadsDevice(command) {
+				return true
+			}
+		}
+	case *parse.CommandNode:
+		for _, arg := range node.Args {
+			if nodeReadsDevice(arg) {
+				return true
+			}
+		}
+	case *parse.IfNode:
+		return nodeReadsDevice(node.Pipe) || nodeReadsDevice(node.List) || nodeReadsDevice(node.ElseList)
+	case *parse.RangeNode:
+		return nodeReadsDevice(node.Pipe) || nodeReadsDevice(node.List) || nodeReadsDevice(node.ElseList)
+	case *parse.WithNode:
+		return nodeReadsDevice(node.Pipe) || nodeReadsDevice(node.List) || nodeReadsDevice(node.ElseList)
+	case *parse.TemplateNode:
+		return nodeReadsDevice(node.Pipe)
+	case *parse.FieldNode:
+		return isDeviceField(node.Ident[0])
+	case *parse.VariableNode:
+		return len(node.Ident) > 1 && isDeviceField(node.Ident[1])
+	case *parse.ChainNode:
+		return nodeReadsDevice(node.Node) || isDeviceField(node.Field[0])
+	case *parse.DotNode:
+		//the whole context can end up anywhere
+		return true
+	}
+
+	return false
+}
+
+func isDeviceField(name string) bool {
+	return name == "Room" || name == "Device"
+}
+
+//looks up everything a template can refer to, along with the variables it came from
+func NewTemplateContext(ctx context.Context, classID, desigID int64, device Device) (ac.TemplateContext, []ac.VariableMapping, error) {
+
+	templateContext := ac.TemplateContext{
+		Variables: make(map[string]string),
+		Room:      device.Room,
+		Device:    device.Hostname,
+	}
+
+	var class, designation ac.Definition
+	err := ac.GetDefinitionById(ctx, CLASS_TABLE_NAME, classID, &class)
+	if err != nil {
+		return templateContext, []ac.VariableMapping{}, err
+	}
+
+	err = ac.GetDefinitionById(ctx, DESIGNATION_TABLE_NAME, desigID, &designation)
+	if err != nil {
+		return templateContext, []ac.VariableMapping{}, err
+	}
+
+	templateContext.Class = class.Name
+	templateContext.Designation = designation.Name
+
+	vars, err := ac.GetVariablesByClassAndDesignation(ctx, classID, desigID)
+	if err != nil {
+		return templateContext, []ac.VariableMapping{}, errors.New(fmt.Sprintf("variables not found: %s", err.Error()))
+	}
+
+	for _, variable := range vars {
+		templateContext.SetVariable(variable.Variable.Name, variable.Value)
+	}
+
+	return templateContext, vars, nil
+}
@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+
+	ac "github.com/byuoitav/pi-designation-microservice/accessors"
+	"github.com/byuoitav/pi-designation-microservice/cache"
+	"github.com/labstack/echo"
+)
+
+//every deletion that hasn't been restored or purged yet, newest first
+func GetTrash(context echo.Context) error {
+
+	ctx := context.Request().Context()
+
+	deletions, err := ac.ListDeletions(ctx)
+	if err != nil {
+		msg := fmt.Sprintf("unable to list the trash: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusInternalServerError, msg, err)
+	}
+
+	return context.JSON(http.StatusOK, deletions)
+}
+
+func GetDeletion(context echo.Context) error {
+
+	ctx := context.Request().Context()
+
+	id, err := ExtractId(context)
+	if err != nil {
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
+	}
+
+	deletion, err := ac.GetDeletion(ctx, id)
+	if err != nil {
+		msg := fmt.Sprintf("unable to get deletion: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusInternalServerError, msg, err)
+	}
+
+	return context.JSON(http.StatusOK, deletion)
+}
+
+func RestoreDeletion(context echo.Context) error {
+
+	ctx := context.Request().Context()
+
+	id, err := ExtractId(context)
+	if err != nil {
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
+	}
+
+	deletion, err := ac.RestoreDeletion(ctx, id)
+	if err != nil {
+		msg := fmt.Sprintf("unable to restore deletion: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusInternalServerError, msg, err)
+	}
+
+	//a restored definition can change any number of renders
+	cache.Flush()
+
+	return context.JSON(http.StatusOK, deletion)
+}
+
+//purges a deletion now instead of waiting out the retention period
+func PurgeDeletion(context echo.Context) error {
+
+	ctx := context.Request().Context()
+
+	id, err := ExtractId(context)
+	if err != nil {
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
+	}
+
+	err = ac.PurgeDeletion(ctx, id)
+	if err != nil {
+		msg := fmt.Sprintf("unable to purge deletion: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusInternalServerError, msg, err)
+	}
+
+	return context.JSON(http.StatusOK, "deletion purged")
+}
@@ -1,12 +1,14 @@
 package handlers
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"net/http"
+	"strings"
 
 	ac "github.com/byuoitav/pi-designation-microservice/accessors"
-	"github.com/fatih/color"
+	"github.com/byuoitav/pi-designation-microservice/apierrors"
+	"github.com/byuoitav/pi-designation-microservice/cache"
 	"github.com/labstack/echo"
 )
 
@@ -17,17 +19,39 @@ const VARIABLE_DEFINITION_TABLE = "variable_definitions"
 
 func AddVariableMapping(context echo.Context) error {
 
-	log.Printf("[handlers] binding new variable mapping...")
+	ctx := context.Request().Context()
+
+	logger.Debugf(ctx, "binding new variable mapping...")
 
 	var mapping ac.VariableMapping
 	err := context.Bind(&mapping)
 	if err != nil {
 		msg := fmt.Sprintf("unable to bind JSON to struct: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[handlers] %s", msg))
-		return context.JSON(http.StatusBadRequest, msg)
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
+	}
+
+	err = ac.ValidateVariableMapping(ctx, mapping.Variable.ID, mapping.Value)
+	if err != nil {
+		msg := fmt.Sprintf("unable to add mapping: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
 	}
 
-	id, err := ac.AddMapping(
+	conflict, err := variableConflict(ctx, mapping.Variable.ID, mapping.Class.ID, mapping.Designation.ID, 0)
+	if err != nil {
+		msg := fmt.Sprintf("unable to add mapping: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusInternalServerError, msg, err)
+	}
+
+	if len(conflict) > 0 {
+		msg := fmt.Sprintf("unable to add mapping: %s", conflict)
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusConflict, msg, apierrors.Conflict("variable", msg))
+	}
+
+	id, err := ac.AddMapping(ctx,
 		VARIABLE_MAPPINGS_TABLE,
 		VARIABLE_DEFINITION_COLUMN,
 		VARIABLE_COLUMN_NAME,
@@ -37,16 +61,18 @@ func AddVariableMapping(context echo.Context) error {
 		mapping.Designation.ID)
 	if err != nil {
 		msg := fmt.Sprintf("unable to add mapping: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[handlers] %s", msg))
-		return context.JSON(http.StatusBadRequest, msg)
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
 	}
 
+	cache.Invalidate(cache.VariableMappingsTag(mapping.Class.ID, mapping.Designation.ID))
+
 	var entry ac.VariableMapping
-	err = ac.GetVariableMappingById(id, &entry)
+	err = ac.GetVariableMappingById(ctx, id, &entry)
 	if err != nil {
 		msg := fmt.Sprintf("new entry not found: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[handlers] %s", msg))
-		return context.JSON(http.StatusInternalServerError, msg)
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusInternalServerError, msg, err)
 	}
 
 	return context.JSON(http.StatusOK, entry)
@@ -56,32 +82,69 @@ func AddVariableMapping(context echo.Context) error {
 //e.g. foreign keys, duplicates, etc
 func AddVariableMappings(context echo.Context) error {
 
-	log.Printf("[handlers] binding new variable mappings...")
+	ctx := context.Request().Context()
+
+	logger.Debugf(ctx, "binding new variable mappings...")
 
 	var mappings ac.Batch
 	err := context.Bind(&mappings)
 	if err != nil {
 		msg := fmt.Sprintf("unable to bind JSON to struct: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[handlers] %s", msg))
-		return context.JSON(http.StatusBadRequest, msg)
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
+	}
+
+	err = ac.ValidateVariableMapping(ctx, mappings.ID, mappings.Value)
+	if err != nil {
+		msg := fmt.Sprintf("variables not added: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
+	}
+
+	//check the whole batch before inserting any of it
+	var conflicts []string
+	for _, class := range mappings.Classes {
+		for _, designation := range class.Designations {
+
+			conflict, err := variableConflict(ctx, mappings.ID, class.ID, designation, 0)
+			if err != nil {
+				msg := fmt.Sprintf("variables not added: %s", err.Error())
+				logger.Errorf(ctx, "%s", msg)
+				return Fail(context, http.StatusInternalServerError, msg, err)
+			}
+
+			if len(conflict) > 0 {
+				conflicts = append(conflicts, conflict)
+			}
+		}
 	}
 
-	lastInserted, err := ac.AddMappings(
+	if len(conflicts) > 0 {
+		msg := fmt.Sprintf("variables not added: %s", strings.Join(conflicts, "; "))
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusConflict, msg, apierrors.Conflict("variable", msg))
+	}
+
+	lastInserted, err := ac.AddMappings(ctx,
 		VARIABLE_MAPPINGS_TABLE,
 		VARIABLE_DEFINITION_COLUMN,
 		VARIABLE_COLUMN_NAME,
 		&mappings)
+
+	//a failed batch may still have inserted some rows
+	cache.Invalidate(batchScopeTags(ctx, &mappings, cache.VariableMappingsTag)...)
+
 	if err != nil {
 		msg := fmt.Sprintf("variables not added: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[handlers] %s", msg))
-		return context.JSON(http.StatusBadRequest, msg)
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
 	}
 
-	entries, err := ac.GetVariableMappingsById(lastInserted)
+	entries, err := ac.GetVariableMappingsById(ctx, lastInserted)
 	if err != nil {
 		msg := fmt.Sprintf("new entries not found: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[handlers] %s", msg))
-		return context.JSON(http.StatusInternalServerError, msg)
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusInternalServerError, msg, err)
 	}
 
 	return context.JSON(http.StatusOK, entries)
@@ -89,17 +152,46 @@ func AddVariableMappings(context echo.Context) error {
 
 func EditVariableMapping(context echo.Context) error {
 
-	log.Printf("[handlers] binding variable mapping...")
+	ctx := context.Request().Context()
+
+	logger.Debugf(ctx, "binding variable mapping...")
+
+	version, err := ExtractIfMatch(context)
+	if err != nil {
+		return Fail(context, http.StatusPreconditionRequired, err.Error(), err)
+	}
 
 	var mapping ac.VariableMapping
-	err := context.Bind(&mapping)
+	err = context.Bind(&mapping)
 	if err != nil {
 		msg := fmt.Sprintf("unable to bind JSON to struct: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[handlers] %s", msg))
-		return context.JSON(http.StatusBadRequest, msg)
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
 	}
 
-	err = ac.EditMapping(
+	err = ac.ValidateVariableMapping(ctx, mapping.Variable.ID, mapping.Value)
+	if err != nil {
+		msg := fmt.Sprintf("variables not added: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
+	}
+
+	conflict, err := variableConflict(ctx, mapping.Variable.ID, mapping.Class.ID, mapping.Designation.ID, mapping.ID)
+	if err != nil {
+		msg := fmt.Sprintf("edit failed: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusInternalServerError, msg, err)
+	}
+
+	if len(conflict) > 0 {
+		msg := fmt.Sprintf("edit failed: %s", conflict)
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusConflict, msg, apierrors.Conflict("variable", msg))
+	}
+
+	tags := mappingScopeTags(ctx, VARIABLE_MAPPINGS_TABLE, mapping.ID, cache.VariableMappingsTag)
+
+	edited, err := ac.EditMapping(ctx,
 		VARIABLE_MAPPINGS_TABLE,
 		VARIABLE_DEFINITION_COLUMN,
 		VARIABLE_COLUMN_NAME,
@@ -107,43 +199,53 @@ func EditVariableMapping(context echo.Context) error {
 		mapping.Variable.ID,
 		mapping.Class.ID,
 		mapping.Designation.ID,
-		mapping.ID)
+		mapping.ID,
+		version)
 	if err != nil {
 		msg := fmt.Sprintf("variables not added: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[handlers] %s", msg))
-		return context.JSON(http.StatusBadRequest, msg)
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
 	}
 
+	cache.Invalidate(append(tags, cache.VariableMappingsTag(mapping.Class.ID, mapping.Designation.ID))...)
+
 	var entry ac.VariableMapping
-	err = ac.GetVariableMappingById(mapping.ID, &entry)
+	err = ac.GetVariableMappingById(ctx, mapping.ID, &entry)
 	if err != nil {
 		msg := fmt.Sprintf("new entries not found: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[handlers] %s", msg))
-		return context.JSON(http.StatusInternalServerError, msg)
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusInternalServerError, msg, err)
 	}
 
-	return context.JSON(http.StatusOK, entry)
+	//the ETag is the version this edit made, even if someone else has edited it since
+	return SendVersioned(context, edited, entry)
 }
 
 func AddVariableDefinition(context echo.Context) error {
 
-	log.Printf("[handlers] binding new variable definition...")
+	ctx := context.Request().Context()
+
+	logger.Debugf(ctx, "binding new variable definition...")
 
-	var variable ac.Definition
+	var variable ac.Variable
 	err := context.Bind(&variable)
 	if err != nil {
 		msg := fmt.Sprintf("unable to bind JSON to struct: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[handlers] %s", msg))
-		return context.JSON(http.StatusBadRequest, msg)
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
 	}
 
-	log.Printf("[handlers] adding variable definition...")
+	logger.Debugf(ctx, "adding variable definition...")
 
-	err = ac.AddDefinition(VARIABLE_DEFINITION_TABLE, &variable)
+	err = ac.AddVariableDefinition(ctx, &variable)
 	if err != nil {
 		msg := fmt.Sprintf("variable definition failed: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[handlers] %s", msg))
-		return context.JSON(http.StatusBadRequest, msg)
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
+	}
+
+	if variable.Default != nil {
+		cache.Invalidate(cache.VariableDefaultsTag())
 	}
 
 	return context.JSON(http.StatusOK, variable)
@@ -151,129 +253,261 @@ func AddVariableDefinition(context echo.Context) error {
 
 func EditVariableDefinition(context echo.Context) error {
 
-	log.Printf("[handlers] binding variable definition...")
+	ctx := context.Request().Context()
 
-	var variable ac.Definition
-	err := context.Bind(&variable)
+	logger.Debugf(ctx, "binding variable definition...")
+
+	version, err := ExtractIfMatch(context)
+	if err != nil {
+		return Fail(context, http.StatusPreconditionRequired, err.Error(), err)
+	}
+
+	var variable ac.Variable
+	err = context.Bind(&variable)
 	if err != nil {
 		msg := fmt.Sprintf("unable to bind JSON to struct: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[handlers] %s", msg))
-		return context.JSON(http.StatusBadRequest, msg)
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
 	}
 
-	log.Printf("[handlers] editing variable definition...")
+	variable.Version = version
 
-	err = ac.EditDefinition(VARIABLE_DEFINITION_TABLE, &variable)
+	logger.Debugf(ctx, "editing variable definition...")
+
+	err = ac.EditVariableDefinition(ctx, &variable)
 	if err != nil {
 		msg := fmt.Sprintf("edit failed: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[handlers] %s", msg))
-		return context.JSON(http.StatusBadRequest, msg)
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
 	}
 
-	return context.JSON(http.StatusOK, variable)
+	tags := []string{cache.VariableTag(variable.ID)}
+	if variable.Default != nil {
+		//configurations that didn't include this variable before will now
+		tags = append(tags, cache.VariableDefaultsTag())
+	}
+
+	cache.Invalidate(tags...)
+
+	return SendVersioned(context, variable.Version, variable)
 }
 
 func GetVariableDefinitionById(context echo.Context) error {
 
+	ctx := context.Request().Context()
+
 	id, err := ExtractId(context)
 	if err != nil {
-		return context.JSON(http.StatusBadRequest, err.Error())
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
 	}
 
-	log.Printf("[handlers] getting variable definition with ID: %d", id)
+	logger.Debugf(ctx, "getting variable definition with ID: %d", id)
 
-	var variable ac.Definition
-	err = ac.GetDefinitionById(VARIABLE_DEFINITION_TABLE, id, &variable)
+	var variable ac.Variable
+	err = ac.GetVariableDefinitionById(ctx, id, &variable)
 	if err != nil {
 		msg := fmt.Sprintf("accessor error: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[handlers] %s", msg))
-		return context.JSON(http.StatusBadRequest, msg)
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
 	}
 
-	return context.JSON(http.StatusOK, variable)
+	return SendVersioned(context, variable.Version, variable)
 }
 
 func GetAllVariableDefinitions(context echo.Context) error {
 
-	log.Printf("[handlers] fetching all variable definitions...")
+	ctx := context.Request().Context()
+
+	logger.Debugf(ctx, "fetching all variable definitions...")
+
+	query, err := ExtractListQuery(context)
+	if err != nil {
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
+	}
 
-	var variables []ac.Definition
-	err := ac.GetAllDefinitions(VARIABLE_DEFINITION_TABLE, &variables)
+	variables, next, err := ac.GetAllVariableDefinitions(ctx, query)
 	if err != nil {
 		msg := fmt.Sprintf("accessor error: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[handlers] %s", msg))
-		return context.JSON(http.StatusBadRequest, msg)
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
 	}
 
-	return context.JSON(http.StatusOK, variables)
+	return SendPage(context, variables, next)
 }
 
 func DeleteVariableDefinition(context echo.Context) error {
 
-	log.Printf("[handlers] deleting variable definition...")
+	ctx := context.Request().Context()
+
+	logger.Debugf(ctx, "deleting variable definition...")
 
 	id, err := ExtractId(context)
 	if err != nil {
-		return context.JSON(http.StatusBadRequest, err.Error())
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
 	}
 
-	err = ac.DeleteDefinition(VARIABLE_DEFINITION_TABLE, &id)
+	deletion, err := ac.DeleteDefinition(ctx, VARIABLE_DEFINITION_TABLE, &id, context.QueryParam("force") == "true")
 	if err != nil {
 		msg := fmt.Sprintf("unable to delete definition: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[handlers] %s", msg))
-		return context.JSON(http.StatusBadRequest, msg)
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
 	}
 
-	return context.JSON(http.StatusOK, "item deleted")
+	cache.Invalidate(cache.VariableTag(id), cache.RequiredVariablesTag())
+
+	return context.JSON(http.StatusOK, deletion)
 }
 
 func GetVariableMappingById(context echo.Context) error {
 
+	ctx := context.Request().Context()
+
 	id, err := ExtractId(context)
 	if err != nil {
-		return context.JSON(http.StatusBadRequest, err.Error())
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
 	}
 
-	log.Printf("[handlers] getting variable mapping with ID: %d", id)
+	logger.Debugf(ctx, "getting variable mapping with ID: %d", id)
 
 	var variable ac.VariableMapping
-	err = ac.GetVariableMappingById(id, &variable)
+	err = ac.GetVariableMappingById(ctx, id, &variable)
 	if err != nil {
 		msg := fmt.Sprintf("accessor error: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[handlers] %s", msg))
-		return context.JSON(http.StatusBadRequest, msg)
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
 	}
 
-	return context.JSON(http.StatusOK, variable)
+	return SendVersioned(context, variable.Version, variable)
 }
 
 func GetAllVariableMappings(context echo.Context) error {
 
-	log.Printf("[handlers] fetching all variable mappings...")
+	ctx := context.Request().Context()
+
+	logger.Debugf(ctx, "fetching all variable mappings...")
 
-	mappings, err := ac.GetAllVariableMappings()
+	query, err := ExtractListQuery(context)
+	if err != nil {
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
+	}
+
+	mappings, next, err := ac.GetAllVariableMappings(ctx, query)
 	if err != nil {
 		msg := fmt.Sprintf("Accessor error: %s", err.Error())
-		log.Printf("%s", color.HiRedString("[handlers %s", msg))
-		return context.JSON(http.StatusInternalServerError, msg)
+		logger.Errorf(ctx, "[handlers %s", msg)
+		return Fail(context, http.StatusInternalServerError, msg, err)
 	}
 
-	return context.JSON(http.StatusOK, mappings)
+	return SendPage(context, mappings, next)
 }
 
 func DeleteVariableMapping(context echo.Context) error {
 
+	ctx := context.Request().Context()
+
+	id, err := ExtractId(context)
+	if err != nil {
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
+	}
+
+	logger.Debugf(ctx, "deleting variable mapping with id %d...", id)
+
+	tags := mappingScopeTags(ctx, VARIABLE_MAPPINGS_TABLE, id, cache.VariableMappingsTag)
+
+	deletion, err := ac.DeleteMapping(ctx, VARIABLE_MAPPINGS_TABLE, id)
+	if err != nil {
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
+	}
+
+	cache.Invalidate(tags...)
+
+	return context.JSON(http.StatusOK, deletion)
+}
+
+//replaces the classes a variable is required in - expects a JSON array of class IDs
+func SetRequiredClasses(context echo.Context) error {
+
+	ctx := context.Request().Context()
+
 	id, err := ExtractId(context)
 	if err != nil {
-		return context.JSON(http.StatusBadRequest, err.Error())
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
 	}
 
-	log.Printf("[handlers] deleting variable mapping with id %d...", id)
+	logger.Debugf(ctx, "binding required classes for variable %d...", id)
 
-	err = ac.DeleteMapping(VARIABLE_MAPPINGS_TABLE, id)
+	var classIDs []int64
+	err = context.Bind(&classIDs)
 	if err != nil {
-		return context.JSON(http.StatusBadRequest, err.Error())
+		msg := fmt.Sprintf("unable to bind JSON to struct: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
+	}
+
+	err = ac.SetRequiredClasses(ctx, id, classIDs)
+	if err != nil {
+		msg := fmt.Sprintf("unable to set required classes: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
+	}
+
+	cache.Invalidate(cache.RequiredVariablesTag())
+
+	return GetRequiredClasses(context)
+}
+
+func GetRequiredClasses(context echo.Context) error {
+
+	ctx := context.Request().Context()
+
+	id, err := ExtractId(context)
+	if err != nil {
+		return Fail(context, http.StatusBadRequest, err.Error(), err)
+	}
+
+	logger.Debugf(ctx, "getting classes that require variable %d", id)
+
+	classIDs, err := ac.GetRequiredClasses(ctx, id)
+	if err != nil {
+		msg := fmt.Sprintf("accessor error: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusBadRequest, msg, err)
+	}
+
+	return context.JSON(http.StatusOK, classIDs)
+}
+
+//a variable gets one value per class/designation - describes the mapping in the way, if there is one
+//ignoreID lets an edit keep its own value
+func variableConflict(ctx context.Context, variableID, classID, desigID, ignoreID int64) (string, error) {
+
+	ids, err := ac.GetVariableMappingIdsInScope(ctx, variableID, classID, desigID)
+	if err != nil {
+		return "", err
+	}
+
+	for _, id := range ids {
+		if id != ignoreID {
+			return fmt.Sprintf("variable %d already has a value in class %d, designation %d (mapping %d)", variableID, classID, desigID, id), nil
+		}
+	}
+
+	return "", nil
+}
+
+//lists every variable with more than one value in a class/designation - these need cleaning up before migration 006
+func GetVariableConflicts(context echo.Context) error {
+
+	ctx := context.Request().Context()
+
+	logger.Debugf(ctx, "fetching conflicting variable mappings...")
+
+	conflicts, err := ac.GetVariableConflicts(ctx)
+	if err != nil {
+		msg := fmt.Sprintf("accessor error: %s", err.Error())
+		logger.Errorf(ctx, "%s", msg)
+		return Fail(context, http.StatusInternalServerError, msg, err)
 	}
 
-	return context.JSON(http.StatusOK, "item successfully deleted")
+	return context.JSON(http.StatusOK, conflicts)
 }
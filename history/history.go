@@ -0,0 +1,346 @@
+package history
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	ac "github.com/byuoitav/pi-designation-microservice/accessors"
+	"github.com/byuoitav/pi-designation-microservice/directory"
+	"github.com/byuoitav/pi-designation-microservice/logging"
+	"github.com/labstack/echo"
+	yaml "gopkg.in/yaml.v2"
+)
+
+//where the gateway puts the caller's signed claims - authmiddleware has already checked them by the time we look
+const JWT_HEADER = "X-jwt-assertion"
+
+//the claims that name the caller, best first
+var userClaims = []string{"http://wso2.org/claims/enduser", "sub"}
+
+//who changes get attributed to when the caller can't be told
+const UNKNOWN_USER = "unknown"
+
+//who the commits come from - the author is whoever made the change
+const COMMITTER = "pi-designation-microservice"
+
+var logger = logging.New("history")
+
+/** lock things down here **/
+var once sync.Once
+var mutex sync.Mutex
+
+/** all the good stuff lives here **/
+var repository string
+
+//the git repository every change is committed to - set DESIGNATION_HISTORY_REPOSITORY to turn it on
+func Repository() string {
+	once.Do(func() {
+		repository = os.Getenv("DESIGNATION_HISTORY_REPOSITORY")
+		if len(repository) > 0 {
+			logger.Infof(context.Background(), "committing every change to %s", repository)
+		}
+	})
+
+	return repository
+}
+
+func Enabled() bool {
+	return len(Repository()) > 0
+}
+
+//commits the configuration after every write that succeeds - a failed commit is logged, never sent back to the caller
+//writes wait for each other, since each one is held until its commit is made - see commit for what that costs
+func Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+
+	if !Enabled() {
+		return next
+	}
+
+	return func(context echo.Context) error {
+
+		request := context.Request()
+		switch request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			return next(context)
+		}
+
+		//check-ins are what devices are running, not configuration
+		if context.Path() == directory.CHECKIN_PATH {
+			return next(context)
+		}
+
+		//held across the write too, so the commit has this change in it and nobody else's
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		err := next(context)
+
+		status := context.Response().Status
+		if err != nil || status < 200 || status >= 300 {
+			return err
+		}
+
+		ctx := request.Context()
+		route := fmt.Sprintf("%s %s", request.Method, request.URL.RequestURI())
+
+		commitErr := commit(ctx, User(request), route)
+		if commitErr != nil {
+			logger.Errorf(ctx, "unable to commit %s to %s: %s", route, Repository(), commitErr.Error())
+		}
+
+		return err
+	}
+}
+
+//who made a request, from the claims the gateway signed
+func User(request *http.Request) string {
+
+	parts := strings.Split(request.Header.Get(JWT_HEADER), ".")
+	if len(parts) != 3 {
+		return UNKNOWN_USER
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return UNKNOWN_USER
+	}
+
+	var claims map[string]interface{}
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return UNKNOWN_USER
+	}
+
+	for _, claim := range userClaims {
+		user, ok := claims[claim].(string)
+		if ok && len(user) > 0 {
+			return user
+		}
+	}
+
+	return UNKNOWN_USER
+}
+
+//writes out everything as it is now and commits it as user's change - a change that didn't change anything isn't committed
+//the message says what changed, with the request that changed it underneath
+//secrets are written as [redacted] - variable values, and anywhere they turn up in microservice YAML, specs and overrides - so the repository never holds them
+//every commit exports everything, rewrites the tree and runs git a few times, so it's fine for people editing configuration but slows down a script making lots of small changes - an import or an apply is one commit
+//callers hold mutex
+func commit(ctx context.Context, user, request string) error {
+
+	err := initialize()
+	if err != nil {
+		return err
+	}
+
+	bundle, err := ac.Export(ctx, false)
+	if err != nil {
+		return err
+	}
+
+	err = ac.RedactSecrets(&bundle)
+	if err != nil {
+		return err
+	}
+
+	err = directory.Write(Repository(), bundle)
+	if err != nil {
+		return err
+	}
+
+	_, err = git("add", "--all")
+	if err != nil {
+		return err
+	}
+
+	changes, err := describe()
+	if err != nil {
+		return err
+	}
+
+	if len(changes) == 0 {
+		return nil
+	}
+
+	//the first change is the subject, and the body has the rest
+	message := changes[0]
+	if len(changes) > 1 {
+		message = fmt.Sprintf("%s, and %d more\n\n%s", changes[0], len(changes)-1, strings.Join(changes, "\n"))
+	}
+
+	message += "\n\n" + request
+	if id := logging.RequestID(ctx); len(id) > 0 {
+		message += fmt.Sprintf("\nrequest %s", id)
+	}
+
+	_, err = git("commit", "--quiet", "--author", fmt.Sprintf("%s <%s>", user, user), "--message", message)
+	if err != nil {
+		return err
+	}
+
+	logger.Infof(ctx, "committed %s by %s", changes[0], user)
+	return nil
+}
+
+//what the staged files mean, like "edit variable mapping (av-control/prod: foo)"
+func describe() ([]string, error) {
+
+	staged, err := git("diff", "--cached", "--name-status", "--no-renames")
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []string
+	for _, line := range strings.Split(string(staged), "\n") {
+
+		fields := strings.SplitN(line, "\t", 2)
+		if len(fields) != 2 {
+			continue
+		}
+
+		action := "edit"
+		switch fields[0] {
+		case "A":
+			action = "add"
+		case "D":
+			action = "delete"
+		}
+
+		path := strings.Split(filepath.ToSlash(fields[1]), "/")
+		name := strings.TrimSuffix(strings.TrimSuffix(path[len(path)-1], directory.MAPPING_EXTENSION), directory.DEFINITION_EXTENSION)
+
+		switch {
+		case len(path) == 2 && path[0] == directory.DESIGNATIONS_DIRECTORY:
+			changes = append(changes, fmt.Sprintf("%s designation %s", action, name))
+
+		case len(path) == 2 && path[0] == directory.VARIABLES_DIRECTORY:
+			changes = append(changes, fmt.Sprintf("%s variable %s", action, name))
+
+		case len(path) == 2 && path[0] == directory.MICROSERVICES_DIRECTORY:
+			changes = append(changes, fmt.Sprintf("%s microservice %s", action, name))
+
+		case len(path) == 3 && path[2] == directory.CLASS_FILE:
+			changes = append(changes, fmt.Sprintf("%s class %s", action, path[1]))
+
+		case len(path) == 5 && path[4] == directory.VARIABLES_FILE:
+			mappings, err := describeVariables(fields[1], path[1]+"/"+path[3])
+			if err != nil {
+				return nil, err
+			}
+			changes = append(changes, mappings...)
+
+		case len(path) == 6 && path[4] == directory.MICROSERVICES_DIRECTORY:
+			microservice, _ := directory.MappingName(name)
+			changes = append(changes, fmt.Sprintf("%s microservice mapping (%s/%s: %s)", action, path[1], path[3], microservice))
+
+		default:
+			changes = append(changes, fmt.Sprintf("%s %s", action, fields[1]))
+		}
+	}
+
+	return changes, nil
+}
+
+//one change per variable that's different in a variables.yaml
+func describeVariables(path, scope string) ([]string, error) {
+
+	before := make(map[string]string)
+	after := make(map[string]string)
+
+	//a file that's new isn't in HEAD, and there's no HEAD at all before the first commit
+	old, err := git("show", "HEAD:"+filepath.ToSlash(path))
+	if err == nil {
+		err = yaml.Unmarshal(old, &before)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("unable to read the last %s: %s", path, err.Error()))
+		}
+	}
+
+	current, err := ioutil.ReadFile(filepath.Join(Repository(), path))
+	if err == nil {
+		err = yaml.Unmarshal(current, &after)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.New(fmt.Sprintf("unable to read %s: %s", path, err.Error()))
+	}
+
+	var names []string
+	for name := range before {
+		names = append(names, name)
+	}
+	for name := range after {
+		if _, ok := before[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var changes []string
+	for _, name := range names {
+
+		previous, wasThere := before[name]
+		value, isThere := after[name]
+
+		switch {
+		case !wasThere:
+			changes = append(changes, fmt.Sprintf("add variable mapping (%s: %s)", scope, name))
+		case !isThere:
+			changes = append(changes, fmt.Sprintf("delete variable mapping (%s: %s)", scope, name))
+		case previous != value:
+			changes = append(changes, fmt.Sprintf("edit variable mapping (%s: %s)", scope, name))
+		}
+	}
+
+	return changes, nil
+}
+
+//makes the repository if it isn't there yet
+func initialize() error {
+
+	_, err := os.Stat(filepath.Join(Repository(), ".git"))
+	if err == nil {
+		return nil
+	}
+
+	err = os.MkdirAll(Repository(), 0755)
+	if err != nil {
+		return errors.New(fmt.Sprintf("unable to create %s: %s", Repository(), err.Error()))
+	}
+
+	_, err = git("init", "--quiet")
+	if err != nil {
+		return err
+	}
+
+	logger.Infof(context.Background(), "created a git repository in %s", Repository())
+	return nil
+}
+
+func git(args ...string) ([]byte, error) {
+
+	//the service commits as itself, whatever git config the host has
+	command := exec.Command("git", append([]string{"-c", "user.name=" + COMMITTER, "-c", "user.email=" + COMMITTER}, args...)...)
+	command.Dir = Repository()
+
+	var stderr bytes.Buffer
+	command.Stderr = &stderr
+
+	out, err := command.Output()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("git %s failed: %s %s", args[0], err.Error(), strings.TrimSpace(stderr.String())))
+	}
+
+	return bytes.TrimSpace(out), nil
+}
@@ -0,0 +1,183 @@
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+type Level int
+
+const (
+	DEBUG Level = iota
+	INFO
+	WARN
+	ERROR
+)
+
+//DESIGNATION_LOG_FORMAT=color gets the old colored lines back for local development
+const JSON_FORMAT = "json"
+const COLOR_FORMAT = "color"
+
+const REDACTED = "[redacted]"
+
+var levelNames = map[Level]string{DEBUG: "debug", INFO: "info", WARN: "warn", ERROR: "error"}
+
+//one log line in JSON format
+type entry struct {
+	Time      string `json:"time"`
+	Level     string `json:"level"`
+	Component string `json:"component"`
+	RequestID string `json:"request_id,omitempty"`
+	Message   string `json:"message"`
+}
+
+//logs for one package - the component ends up in every line it writes
+type Logger struct {
+	component string
+}
+
+type requestIDKey struct{}
+
+/** lock things down here **/
+var mutex sync.Mutex
+
+/** all the good stuff lives here **/
+var output io.Writer = os.Stdout
+var minimum = parseLevel(os.Getenv("DESIGNATION_LOG_LEVEL"))
+var format = parseFormat(os.Getenv("DESIGNATION_LOG_FORMAT"))
+var secrets []string
+
+func parseLevel(name string) Level {
+
+	for level, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return level
+		}
+	}
+
+	return INFO
+}
+
+func parseFormat(name string) string {
+
+	if strings.EqualFold(name, COLOR_FORMAT) {
+		return COLOR_FORMAT
+	}
+
+	return JSON_FORMAT
+}
+
+func New(component string) Logger {
+	return Logger{component: component}
+}
+
+//anything logged after this has the secret replaced
+func AddSecret(secret string) {
+
+	if len(secret) == 0 {
+		return
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	secrets = append(secrets, secret)
+}
+
+func Redact(message string) string {
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for _, secret := range secrets {
+		message = strings.Replace(message, secret, REDACTED, -1)
+	}
+
+	return message
+}
+
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+func RequestID(ctx context.Context) string {
+
+	if ctx == nil {
+		return ""
+	}
+
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func (logger Logger) Debugf(ctx context.Context, message string, args ...interface{}) {
+	logger.write(ctx, DEBUG, message, args...)
+}
+
+func (logger Logger) Infof(ctx context.Context, message string, args ...interface{}) {
+	logger.write(ctx, INFO, message, args...)
+}
+
+func (logger Logger) Warnf(ctx context.Context, message string, args ...interface{}) {
+	logger.write(ctx, WARN, message, args...)
+}
+
+func (logger Logger) Errorf(ctx context.Context, message string, args ...interface{}) {
+	logger.write(ctx, ERROR, message, args...)
+}
+
+func (logger Logger) write(ctx context.Context, level Level, message string, args ...interface{}) {
+
+	if level < minimum {
+		return
+	}
+
+	line := entry{
+		Time:      time.Now().UTC().Format(time.RFC3339Nano),
+		Level:     levelNames[level],
+		Component: logger.component,
+		RequestID: RequestID(ctx),
+		Message:   Redact(fmt.Sprintf(message, args...)),
+	}
+
+	var out []byte
+	if format == COLOR_FORMAT {
+		out = []byte(colorLine(line, level) + "\n")
+	} else {
+		out, _ = json.Marshal(line)
+		out = append(out, '\n')
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	output.Write(out)
+}
+
+//what log.Printf and color used to print
+func colorLine(line entry, level Level) string {
+
+	text := fmt.Sprintf("%s [%s] %s", line.Time, line.Component, line.Message)
+	if len(line.RequestID) > 0 {
+		text += " request=" + line.RequestID
+	}
+
+	switch level {
+	case ERROR:
+		return color.HiRedString("%s", text)
+	case WARN:
+		return color.HiYellowString("%s", text)
+	case INFO:
+		return color.HiCyanString("%s", text)
+	}
+
+	return text
+}
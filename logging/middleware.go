@@ -0,0 +1,58 @@
+package logging
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"regexp"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const REQUEST_ID_HEADER = "X-Request-ID"
+
+//ids passed in by a proxy are kept if they look harmless
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+var requests = New("http")
+
+//tags each request with an ID - from X-Request-ID if the caller sent one - and logs it when it's done
+func Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(context echo.Context) error {
+
+		start := time.Now()
+		request := context.Request()
+
+		id := request.Header.Get(REQUEST_ID_HEADER)
+		if !requestIDPattern.MatchString(id) {
+			id = newRequestID()
+		}
+
+		ctx := WithRequestID(request.Context(), id)
+		context.SetRequest(request.WithContext(ctx))
+		context.Response().Header().Set(REQUEST_ID_HEADER, id)
+
+		err := next(context)
+		if err != nil {
+			context.Error(err)
+		}
+
+		status := context.Response().Status
+		log := requests.Infof
+		if status >= 500 {
+			log = requests.Errorf
+		}
+
+		log(ctx, "%s %s %d %s", request.Method, request.URL.Path, status, time.Since(start))
+
+		return nil
+	}
+}
+
+func newRequestID() string {
+
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,136 @@
+package metrics
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const NAMESPACE = "designation"
+
+/** lock things down here **/
+var routesOnce sync.Once
+
+/** all the good stuff lives here **/
+var routes = make(map[string]bool)
+
+var requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: NAMESPACE,
+	Name:      "http_requests_total",
+	Help:      "HTTP requests by route, method and status code.",
+}, []string{"route", "method", "status"})
+
+var requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: NAMESPACE,
+	Name:      "http_request_duration_seconds",
+	Help:      "HTTP request latency by route, method and status code.",
+	Buckets:   prometheus.DefBuckets,
+}, []string{"route", "method", "status"})
+
+var queries = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: NAMESPACE,
+	Name:      "database_queries_total",
+	Help:      "Database queries by operation, table and outcome.",
+}, []string{"operation", "table", "outcome"})
+
+var queryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: NAMESPACE,
+	Name:      "database_query_duration_seconds",
+	Help:      "Database query latency by operation and table.",
+	Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+}, []string{"operation", "table"})
+
+var renderSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: NAMESPACE,
+	Name:      "rendered_configuration_bytes",
+	Help:      "Size of rendered configurations.",
+	Buckets:   prometheus.ExponentialBuckets(256, 2, 10),
+}, []string{"configuration"})
+
+var fetches = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: NAMESPACE,
+	Name:      "configuration_fetches_total",
+	Help:      "Configurations served by class, designation and whether they were stale.",
+}, []string{"configuration", "class", "designation", "stale"})
+
+var droppedFetches = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: NAMESPACE,
+	Name:      "configuration_fetches_dropped_total",
+	Help:      "Fetches that weren't logged because the write queue was full.",
+})
+
+func init() {
+	prometheus.MustRegister(requests, requestDuration, queries, queryDuration, renderSize, fetches, droppedFetches)
+}
+
+//serves everything in the Prometheus text format
+func Handler() echo.HandlerFunc {
+	return echo.WrapHandler(promhttp.Handler())
+}
+
+//counts and times every request by the route it matched, not the URL, so IDs don't blow up the number of series
+func Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(context echo.Context) error {
+
+		start := time.Now()
+
+		err := next(context)
+		if err != nil {
+			context.Error(err) //writes the status so we can see it
+		}
+
+		labels := prometheus.Labels{
+			"route":  route(context),
+			"method": context.Request().Method,
+			"status": strconv.Itoa(context.Response().Status),
+		}
+
+		requests.With(labels).Inc()
+		requestDuration.With(labels).Observe(time.Since(start).Seconds())
+
+		return nil
+	}
+}
+
+//unmatched requests report their own URL as the path - lump them together
+func route(context echo.Context) string {
+
+	routesOnce.Do(func() {
+		for _, r := range context.Echo().Routes() {
+			routes[r.Path] = true
+		}
+	})
+
+	if !routes[context.Path()] {
+		return "unmatched"
+	}
+
+	return context.Path()
+}
+
+func ObserveQuery(operation, table string, duration time.Duration, err error) {
+
+	outcome := "ok"
+	if err != nil {
+		outcome = "error"
+	}
+
+	queries.WithLabelValues(operation, table, outcome).Inc()
+	queryDuration.WithLabelValues(operation, table).Observe(duration.Seconds())
+}
+
+func ObserveRender(configuration string, size int) {
+	renderSize.WithLabelValues(configuration).Observe(float64(size))
+}
+
+func ObserveFetch(configuration string, classID, designationID int64, stale bool) {
+	fetches.WithLabelValues(configuration, strconv.FormatInt(classID, 10), strconv.FormatInt(designationID, 10), strconv.FormatBool(stale)).Inc()
+}
+
+func ObserveDroppedFetch() {
+	droppedFetches.Inc()
+}
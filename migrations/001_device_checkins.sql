@@ -0,0 +1,18 @@
+-- tracks the most recent check-in from every pi
+
+CREATE TABLE IF NOT EXISTS `device_checkins` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `hostname` varchar(100) NOT NULL,
+  `class_id` int(11) NOT NULL,
+  `designation_id` int(11) NOT NULL,
+  `room` varchar(100) NOT NULL DEFAULT '',
+  `config_hash` varchar(64) NOT NULL,
+  `containers` text NOT NULL,
+  `checked_in_at` timestamp NOT NULL DEFAULT current_timestamp() ON UPDATE current_timestamp(),
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `hostname` (`hostname`),
+  KEY `class_id` (`class_id`),
+  KEY `designation_id` (`designation_id`),
+  CONSTRAINT `device_checkins_ibfk_1` FOREIGN KEY (`class_id`) REFERENCES `class_definitions` (`id`) ON DELETE CASCADE ON UPDATE CASCADE,
+  CONSTRAINT `device_checkins_ibfk_2` FOREIGN KEY (`designation_id`) REFERENCES `designation_definitions` (`id`) ON DELETE CASCADE ON UPDATE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
@@ -0,0 +1,16 @@
+-- records every configuration served and who fetched it
+
+CREATE TABLE IF NOT EXISTS `configuration_fetches` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `client` varchar(100) NOT NULL,
+  `address` varchar(45) NOT NULL,
+  `class_id` int(11) NOT NULL,
+  `designation_id` int(11) NOT NULL,
+  `configuration` varchar(20) NOT NULL,
+  `etag` varchar(66) NOT NULL,
+  `stale` tinyint(1) NOT NULL DEFAULT 0,
+  `fetched_at` timestamp NOT NULL DEFAULT current_timestamp(),
+  PRIMARY KEY (`id`),
+  KEY `client` (`client`,`id`),
+  KEY `fetched_at` (`fetched_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
@@ -0,0 +1,5 @@
+-- variable definitions declare what kind of value their mappings may hold
+
+ALTER TABLE `variable_definitions`
+  ADD COLUMN `type` varchar(20) NOT NULL DEFAULT 'string',
+  ADD COLUMN `validation` varchar(1024) NOT NULL DEFAULT '';
@@ -0,0 +1,12 @@
+-- variables every configuration in a class has to map
+
+CREATE TABLE IF NOT EXISTS `required_variables` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `variable_id` int(11) NOT NULL,
+  `class_id` int(11) NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `variable_id` (`variable_id`,`class_id`),
+  KEY `class_id` (`class_id`),
+  CONSTRAINT `required_variables_ibfk_1` FOREIGN KEY (`variable_id`) REFERENCES `variable_definitions` (`id`) ON DELETE CASCADE ON UPDATE CASCADE,
+  CONSTRAINT `required_variables_ibfk_2` FOREIGN KEY (`class_id`) REFERENCES `class_definitions` (`id`) ON DELETE CASCADE ON UPDATE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
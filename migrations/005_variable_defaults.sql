@@ -0,0 +1,4 @@
+-- a variable's value in every class/designation that doesn't map one
+
+ALTER TABLE `variable_definitions`
+  ADD COLUMN `default_value` varchar(80) DEFAULT NULL;
@@ -0,0 +1,12 @@
+-- one value per variable per class/designation
+--
+-- this fails while conflicting mappings exist. list them with
+-- GET /variables/mappings/conflicts (or the query below), delete the
+-- ones that shouldn't win and run this again.
+--
+-- SELECT class_id, designation_id, variable_id, COUNT(*) FROM variable_mappings
+--   GROUP BY class_id, designation_id, variable_id HAVING COUNT(*) > 1;
+
+ALTER TABLE `variable_mappings`
+  DROP INDEX `designation_id`,
+  ADD UNIQUE KEY `designation_id` (`designation_id`,`class_id`,`variable_id`);
@@ -0,0 +1,7 @@
+-- microservices can be described by a spec instead of a hand-written YAML snippet
+
+ALTER TABLE `microservice_definitions`
+  ADD COLUMN `spec` text NOT NULL DEFAULT '';
+
+ALTER TABLE `microservice_mappings`
+  ADD COLUMN `overrides` text NOT NULL DEFAULT '';
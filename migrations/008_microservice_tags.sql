@@ -0,0 +1,13 @@
+-- the image tag each microservice runs in each designation
+
+CREATE TABLE IF NOT EXISTS `microservice_tags` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `microservice_id` int(11) NOT NULL,
+  `designation_id` int(11) NOT NULL,
+  `tag` varchar(255) NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `microservice_id` (`microservice_id`,`designation_id`),
+  KEY `designation_id` (`designation_id`),
+  CONSTRAINT `microservice_tags_ibfk_1` FOREIGN KEY (`microservice_id`) REFERENCES `microservice_definitions` (`id`) ON DELETE CASCADE ON UPDATE CASCADE,
+  CONSTRAINT `microservice_tags_ibfk_2` FOREIGN KEY (`designation_id`) REFERENCES `designation_definitions` (`id`) ON DELETE CASCADE ON UPDATE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
@@ -0,0 +1,10 @@
+-- records which migrations have been applied - /status reports the highest one
+-- every migration from here on ends by inserting its own number
+
+CREATE TABLE IF NOT EXISTS `schema_migrations` (
+  `version` int(11) NOT NULL,
+  `applied_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`version`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+INSERT IGNORE INTO `schema_migrations` (`version`) VALUES (1),(2),(3),(4),(5),(6),(7),(8),(9);
@@ -0,0 +1,6 @@
+-- secret variables are served like any other but left out of search results
+
+ALTER TABLE `variable_definitions`
+  ADD COLUMN `secret` tinyint(1) NOT NULL DEFAULT 0;
+
+INSERT IGNORE INTO `schema_migrations` (`version`) VALUES (10);
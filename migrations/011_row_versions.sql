@@ -0,0 +1,21 @@
+-- bumped on every edit - served as the ETag of a definition or mapping and checked against If-Match
+
+ALTER TABLE `class_definitions`
+  ADD COLUMN `version` int(11) NOT NULL DEFAULT 1;
+
+ALTER TABLE `designation_definitions`
+  ADD COLUMN `version` int(11) NOT NULL DEFAULT 1;
+
+ALTER TABLE `variable_definitions`
+  ADD COLUMN `version` int(11) NOT NULL DEFAULT 1;
+
+ALTER TABLE `microservice_definitions`
+  ADD COLUMN `version` int(11) NOT NULL DEFAULT 1;
+
+ALTER TABLE `variable_mappings`
+  ADD COLUMN `version` int(11) NOT NULL DEFAULT 1;
+
+ALTER TABLE `microservice_mappings`
+  ADD COLUMN `version` int(11) NOT NULL DEFAULT 1;
+
+INSERT IGNORE INTO `schema_migrations` (`version`) VALUES (11);
@@ -0,0 +1,63 @@
+-- deletes move rows to the trash instead of removing them - see the trash section of the README
+-- deleted rows point at their deletion and have a NULL alive, which keeps them out of the unique keys
+-- purging a deletion removes its rows for real through the foreign keys
+
+CREATE TABLE IF NOT EXISTS `deletions` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `table_name` varchar(64) NOT NULL,
+  `row_id` int(11) NOT NULL,
+  `name` varchar(1024) NOT NULL,
+  `deleted_at` timestamp NOT NULL DEFAULT current_timestamp(),
+  PRIMARY KEY (`id`),
+  KEY `deleted_at` (`deleted_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+ALTER TABLE `class_definitions`
+  ADD COLUMN `alive` tinyint(1) DEFAULT 1,
+  ADD COLUMN `deletion_id` int(11) DEFAULT NULL,
+  DROP INDEX `name`,
+  ADD UNIQUE KEY `name` (`name`,`alive`),
+  ADD KEY `deletion_id` (`deletion_id`),
+  ADD CONSTRAINT `class_definitions_deletion` FOREIGN KEY (`deletion_id`) REFERENCES `deletions` (`id`) ON DELETE CASCADE;
+
+ALTER TABLE `designation_definitions`
+  ADD COLUMN `alive` tinyint(1) DEFAULT 1,
+  ADD COLUMN `deletion_id` int(11) DEFAULT NULL,
+  DROP INDEX `name`,
+  ADD UNIQUE KEY `name` (`name`,`alive`),
+  ADD KEY `deletion_id` (`deletion_id`),
+  ADD CONSTRAINT `designation_definitions_deletion` FOREIGN KEY (`deletion_id`) REFERENCES `deletions` (`id`) ON DELETE CASCADE;
+
+ALTER TABLE `variable_definitions`
+  ADD COLUMN `alive` tinyint(1) DEFAULT 1,
+  ADD COLUMN `deletion_id` int(11) DEFAULT NULL,
+  DROP INDEX `name`,
+  ADD UNIQUE KEY `name` (`name`,`alive`),
+  ADD KEY `deletion_id` (`deletion_id`),
+  ADD CONSTRAINT `variable_definitions_deletion` FOREIGN KEY (`deletion_id`) REFERENCES `deletions` (`id`) ON DELETE CASCADE;
+
+ALTER TABLE `microservice_definitions`
+  ADD COLUMN `alive` tinyint(1) DEFAULT 1,
+  ADD COLUMN `deletion_id` int(11) DEFAULT NULL,
+  DROP INDEX `name`,
+  ADD UNIQUE KEY `name` (`name`,`alive`),
+  ADD KEY `deletion_id` (`deletion_id`),
+  ADD CONSTRAINT `microservice_definitions_deletion` FOREIGN KEY (`deletion_id`) REFERENCES `deletions` (`id`) ON DELETE CASCADE;
+
+ALTER TABLE `variable_mappings`
+  ADD COLUMN `alive` tinyint(1) DEFAULT 1,
+  ADD COLUMN `deletion_id` int(11) DEFAULT NULL,
+  DROP INDEX `designation_id`,
+  ADD UNIQUE KEY `designation_id` (`designation_id`,`class_id`,`variable_id`,`alive`),
+  ADD KEY `deletion_id` (`deletion_id`),
+  ADD CONSTRAINT `variable_mappings_deletion` FOREIGN KEY (`deletion_id`) REFERENCES `deletions` (`id`) ON DELETE CASCADE;
+
+ALTER TABLE `microservice_mappings`
+  ADD COLUMN `alive` tinyint(1) DEFAULT 1,
+  ADD COLUMN `deletion_id` int(11) DEFAULT NULL,
+  DROP INDEX `designation_id`,
+  ADD UNIQUE KEY `designation_id` (`designation_id`,`class_id`,`microservice_id`,`yaml`(512),`alive`),
+  ADD KEY `deletion_id` (`deletion_id`),
+  ADD CONSTRAINT `microservice_mappings_deletion` FOREIGN KEY (`deletion_id`) REFERENCES `deletions` (`id`) ON DELETE CASCADE;
+
+INSERT IGNORE INTO `schema_migrations` (`version`) VALUES (12);
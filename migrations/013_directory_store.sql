@@ -0,0 +1,11 @@
+-- a database a directory store has loaded into belongs to it - see the directory store section of the README
+-- directory mode refuses to load into a database that already holds configuration and has no row here
+
+CREATE TABLE IF NOT EXISTS `directory_store` (
+  `id` int(11) NOT NULL,
+  `root` varchar(1024) NOT NULL,
+  `claimed_at` timestamp NOT NULL DEFAULT current_timestamp(),
+  PRIMARY KEY (`id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+INSERT IGNORE INTO `schema_migrations` (`version`) VALUES (13);
@@ -26,8 +26,13 @@ CREATE TABLE `class_definitions` (
   `id` int(11) NOT NULL AUTO_INCREMENT,
   `name` varchar(100) NOT NULL,
   `description` varchar(1024) NOT NULL,
+  `version` int(11) NOT NULL DEFAULT 1,
+  `alive` tinyint(1) DEFAULT 1,
+  `deletion_id` int(11) DEFAULT NULL,
   PRIMARY KEY (`id`),
-  UNIQUE KEY `name` (`name`)
+  UNIQUE KEY `name` (`name`,`alive`),
+  KEY `deletion_id` (`deletion_id`),
+  CONSTRAINT `class_definitions_deletion` FOREIGN KEY (`deletion_id`) REFERENCES `deletions` (`id`) ON DELETE CASCADE
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
 /*!40101 SET character_set_client = @saved_cs_client */;
 
@@ -40,6 +45,65 @@ LOCK TABLES `class_definitions` WRITE;
 /*!40000 ALTER TABLE `class_definitions` ENABLE KEYS */;
 UNLOCK TABLES;
 
+--
+-- Table structure for table `configuration_fetches`
+--
+
+DROP TABLE IF EXISTS `configuration_fetches`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `configuration_fetches` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `client` varchar(100) NOT NULL,
+  `address` varchar(45) NOT NULL,
+  `class_id` int(11) NOT NULL,
+  `designation_id` int(11) NOT NULL,
+  `configuration` varchar(20) NOT NULL,
+  `etag` varchar(66) NOT NULL,
+  `stale` tinyint(1) NOT NULL DEFAULT 0,
+  `fetched_at` timestamp NOT NULL DEFAULT current_timestamp(),
+  PRIMARY KEY (`id`),
+  KEY `client` (`client`,`id`),
+  KEY `fetched_at` (`fetched_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Dumping data for table `configuration_fetches`
+--
+
+LOCK TABLES `configuration_fetches` WRITE;
+/*!40000 ALTER TABLE `configuration_fetches` DISABLE KEYS */;
+/*!40000 ALTER TABLE `configuration_fetches` ENABLE KEYS */;
+UNLOCK TABLES;
+
+--
+-- Table structure for table `deletions`
+--
+
+DROP TABLE IF EXISTS `deletions`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `deletions` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `table_name` varchar(64) NOT NULL,
+  `row_id` int(11) NOT NULL,
+  `name` varchar(1024) NOT NULL,
+  `deleted_at` timestamp NOT NULL DEFAULT current_timestamp(),
+  PRIMARY KEY (`id`),
+  KEY `deleted_at` (`deleted_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Dumping data for table `deletions`
+--
+
+LOCK TABLES `deletions` WRITE;
+/*!40000 ALTER TABLE `deletions` DISABLE KEYS */;
+/*!40000 ALTER TABLE `deletions` ENABLE KEYS */;
+UNLOCK TABLES;
+
 --
 -- Table structure for table `designation_definitions`
 --
@@ -51,8 +115,13 @@ CREATE TABLE `designation_definitions` (
   `id` int(11) NOT NULL AUTO_INCREMENT,
   `name` varchar(100) NOT NULL,
   `description` varchar(1024) NOT NULL,
+  `version` int(11) NOT NULL DEFAULT 1,
+  `alive` tinyint(1) DEFAULT 1,
+  `deletion_id` int(11) DEFAULT NULL,
   PRIMARY KEY (`id`),
-  UNIQUE KEY `name` (`name`)
+  UNIQUE KEY `name` (`name`,`alive`),
+  KEY `deletion_id` (`deletion_id`),
+  CONSTRAINT `designation_definitions_deletion` FOREIGN KEY (`deletion_id`) REFERENCES `deletions` (`id`) ON DELETE CASCADE
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
 /*!40101 SET character_set_client = @saved_cs_client */;
 
@@ -65,6 +134,40 @@ LOCK TABLES `designation_definitions` WRITE;
 /*!40000 ALTER TABLE `designation_definitions` ENABLE KEYS */;
 UNLOCK TABLES;
 
+--
+-- Table structure for table `device_checkins`
+--
+
+DROP TABLE IF EXISTS `device_checkins`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `device_checkins` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `hostname` varchar(100) NOT NULL,
+  `class_id` int(11) NOT NULL,
+  `designation_id` int(11) NOT NULL,
+  `room` varchar(100) NOT NULL DEFAULT '',
+  `config_hash` varchar(64) NOT NULL,
+  `containers` text NOT NULL,
+  `checked_in_at` timestamp NOT NULL DEFAULT current_timestamp() ON UPDATE current_timestamp(),
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `hostname` (`hostname`),
+  KEY `class_id` (`class_id`),
+  KEY `designation_id` (`designation_id`),
+  CONSTRAINT `device_checkins_ibfk_1` FOREIGN KEY (`class_id`) REFERENCES `class_definitions` (`id`) ON DELETE CASCADE ON UPDATE CASCADE,
+  CONSTRAINT `device_checkins_ibfk_2` FOREIGN KEY (`designation_id`) REFERENCES `designation_definitions` (`id`) ON DELETE CASCADE ON UPDATE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Dumping data for table `device_checkins`
+--
+
+LOCK TABLES `device_checkins` WRITE;
+/*!40000 ALTER TABLE `device_checkins` DISABLE KEYS */;
+/*!40000 ALTER TABLE `device_checkins` ENABLE KEYS */;
+UNLOCK TABLES;
+
 --
 -- Table structure for table `microservice_definitions`
 --
@@ -76,8 +179,14 @@ CREATE TABLE `microservice_definitions` (
   `id` int(11) NOT NULL AUTO_INCREMENT,
   `name` varchar(100) NOT NULL,
   `description` varchar(1024) NOT NULL,
+  `spec` text NOT NULL DEFAULT '',
+  `version` int(11) NOT NULL DEFAULT 1,
+  `alive` tinyint(1) DEFAULT 1,
+  `deletion_id` int(11) DEFAULT NULL,
   PRIMARY KEY (`id`),
-  UNIQUE KEY `name` (`name`)
+  UNIQUE KEY `name` (`name`,`alive`),
+  KEY `deletion_id` (`deletion_id`),
+  CONSTRAINT `microservice_definitions_deletion` FOREIGN KEY (`deletion_id`) REFERENCES `deletions` (`id`) ON DELETE CASCADE
 ) ENGINE=InnoDB AUTO_INCREMENT=2 DEFAULT CHARSET=utf8;
 /*!40101 SET character_set_client = @saved_cs_client */;
 
@@ -87,7 +196,7 @@ CREATE TABLE `microservice_definitions` (
 
 LOCK TABLES `microservice_definitions` WRITE;
 /*!40000 ALTER TABLE `microservice_definitions` DISABLE KEYS */;
-INSERT INTO `microservice_definitions` VALUES (1,'configuration-database-microservice','fronts the av config db');
+INSERT INTO `microservice_definitions` VALUES (1,'configuration-database-microservice','fronts the av config db','');
 /*!40000 ALTER TABLE `microservice_definitions` ENABLE KEYS */;
 UNLOCK TABLES;
 
@@ -104,13 +213,19 @@ CREATE TABLE `microservice_mappings` (
   `designation_id` int(11) NOT NULL,
   `class_id` int(11) NOT NULL,
   `microservice_id` int(11) NOT NULL,
+  `overrides` text NOT NULL DEFAULT '',
+  `version` int(11) NOT NULL DEFAULT 1,
+  `alive` tinyint(1) DEFAULT 1,
+  `deletion_id` int(11) DEFAULT NULL,
   PRIMARY KEY (`id`),
-  UNIQUE KEY `designation_id` (`designation_id`,`class_id`,`microservice_id`,`yaml`(512)),
+  UNIQUE KEY `designation_id` (`designation_id`,`class_id`,`microservice_id`,`yaml`(512),`alive`),
   KEY `class_id` (`class_id`),
   KEY `microservice_id` (`microservice_id`),
+  KEY `deletion_id` (`deletion_id`),
   CONSTRAINT `designation` FOREIGN KEY (`designation_id`) REFERENCES `designation_definitions` (`id`) ON DELETE CASCADE ON UPDATE CASCADE,
   CONSTRAINT `microservice_mappings_ibfk_4` FOREIGN KEY (`class_id`) REFERENCES `class_definitions` (`id`) ON DELETE CASCADE ON UPDATE CASCADE,
-  CONSTRAINT `microservice_mappings_ibfk_5` FOREIGN KEY (`microservice_id`) REFERENCES `microservice_definitions` (`id`) ON DELETE CASCADE ON UPDATE CASCADE
+  CONSTRAINT `microservice_mappings_ibfk_5` FOREIGN KEY (`microservice_id`) REFERENCES `microservice_definitions` (`id`) ON DELETE CASCADE ON UPDATE CASCADE,
+  CONSTRAINT `microservice_mappings_deletion` FOREIGN KEY (`deletion_id`) REFERENCES `deletions` (`id`) ON DELETE CASCADE
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
 /*!40101 SET character_set_client = @saved_cs_client */;
 
@@ -123,6 +238,63 @@ LOCK TABLES `microservice_mappings` WRITE;
 /*!40000 ALTER TABLE `microservice_mappings` ENABLE KEYS */;
 UNLOCK TABLES;
 
+--
+-- Table structure for table `microservice_tags`
+--
+
+DROP TABLE IF EXISTS `microservice_tags`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `microservice_tags` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `microservice_id` int(11) NOT NULL,
+  `designation_id` int(11) NOT NULL,
+  `tag` varchar(255) NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `microservice_id` (`microservice_id`,`designation_id`),
+  KEY `designation_id` (`designation_id`),
+  CONSTRAINT `microservice_tags_ibfk_1` FOREIGN KEY (`microservice_id`) REFERENCES `microservice_definitions` (`id`) ON DELETE CASCADE ON UPDATE CASCADE,
+  CONSTRAINT `microservice_tags_ibfk_2` FOREIGN KEY (`designation_id`) REFERENCES `designation_definitions` (`id`) ON DELETE CASCADE ON UPDATE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Dumping data for table `microservice_tags`
+--
+
+LOCK TABLES `microservice_tags` WRITE;
+/*!40000 ALTER TABLE `microservice_tags` DISABLE KEYS */;
+/*!40000 ALTER TABLE `microservice_tags` ENABLE KEYS */;
+UNLOCK TABLES;
+
+--
+-- Table structure for table `required_variables`
+--
+
+DROP TABLE IF EXISTS `required_variables`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `required_variables` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `variable_id` int(11) NOT NULL,
+  `class_id` int(11) NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `variable_id` (`variable_id`,`class_id`),
+  KEY `class_id` (`class_id`),
+  CONSTRAINT `required_variables_ibfk_1` FOREIGN KEY (`variable_id`) REFERENCES `variable_definitions` (`id`) ON DELETE CASCADE ON UPDATE CASCADE,
+  CONSTRAINT `required_variables_ibfk_2` FOREIGN KEY (`class_id`) REFERENCES `class_definitions` (`id`) ON DELETE CASCADE ON UPDATE CASCADE
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Dumping data for table `required_variables`
+--
+
+LOCK TABLES `required_variables` WRITE;
+/*!40000 ALTER TABLE `required_variables` DISABLE KEYS */;
+/*!40000 ALTER TABLE `required_variables` ENABLE KEYS */;
+UNLOCK TABLES;
+
 --
 -- Table structure for table `rooms`
 --
@@ -150,6 +322,30 @@ LOCK TABLES `rooms` WRITE;
 /*!40000 ALTER TABLE `rooms` ENABLE KEYS */;
 UNLOCK TABLES;
 
+--
+-- Table structure for table `schema_migrations`
+--
+
+DROP TABLE IF EXISTS `schema_migrations`;
+/*!40101 SET @saved_cs_client     = @@character_set_client */;
+/*!40101 SET character_set_client = utf8 */;
+CREATE TABLE `schema_migrations` (
+  `version` int(11) NOT NULL,
+  `applied_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`version`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+/*!40101 SET character_set_client = @saved_cs_client */;
+
+--
+-- Dumping data for table `schema_migrations`
+--
+
+LOCK TABLES `schema_migrations` WRITE;
+/*!40000 ALTER TABLE `schema_migrations` DISABLE KEYS */;
+INSERT INTO `schema_migrations` (`version`) VALUES (1),(2),(3),(4),(5),(6),(7),(8),(9),(10),(11),(12);
+/*!40000 ALTER TABLE `schema_migrations` ENABLE KEYS */;
+UNLOCK TABLES;
+
 --
 -- Table structure for table `variable_definitions`
 --
@@ -161,8 +357,17 @@ CREATE TABLE `variable_definitions` (
   `id` int(11) NOT NULL AUTO_INCREMENT,
   `name` varchar(100) NOT NULL,
   `description` varchar(1024) NOT NULL,
+  `type` varchar(20) NOT NULL DEFAULT 'string',
+  `validation` varchar(1024) NOT NULL DEFAULT '',
+  `default_value` varchar(80) DEFAULT NULL,
+  `secret` tinyint(1) NOT NULL DEFAULT 0,
+  `version` int(11) NOT NULL DEFAULT 1,
+  `alive` tinyint(1) DEFAULT 1,
+  `deletion_id` int(11) DEFAULT NULL,
   PRIMARY KEY (`id`),
-  UNIQUE KEY `name` (`name`)
+  UNIQUE KEY `name` (`name`,`alive`),
+  KEY `deletion_id` (`deletion_id`),
+  CONSTRAINT `variable_definitions_deletion` FOREIGN KEY (`deletion_id`) REFERENCES `deletions` (`id`) ON DELETE CASCADE
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
 /*!40101 SET character_set_client = @saved_cs_client */;
 
@@ -188,13 +393,18 @@ CREATE TABLE `variable_mappings` (
   `designation_id` int(11) NOT NULL,
   `class_id` int(11) NOT NULL,
   `variable_id` int(11) NOT NULL,
+  `version` int(11) NOT NULL DEFAULT 1,
+  `alive` tinyint(1) DEFAULT 1,
+  `deletion_id` int(11) DEFAULT NULL,
   PRIMARY KEY (`id`),
-  UNIQUE KEY `designation_id` (`designation_id`,`class_id`,`variable_id`,`value`),
+  UNIQUE KEY `designation_id` (`designation_id`,`class_id`,`variable_id`,`alive`),
   KEY `class_id` (`class_id`),
   KEY `variable_id` (`variable_id`),
+  KEY `deletion_id` (`deletion_id`),
   CONSTRAINT `variable_mappings_ibfk_4` FOREIGN KEY (`designation_id`) REFERENCES `designation_definitions` (`id`) ON DELETE CASCADE ON UPDATE CASCADE,
   CONSTRAINT `variable_mappings_ibfk_5` FOREIGN KEY (`class_id`) REFERENCES `class_definitions` (`id`) ON DELETE CASCADE ON UPDATE CASCADE,
-  CONSTRAINT `variable_mappings_ibfk_6` FOREIGN KEY (`variable_id`) REFERENCES `variable_definitions` (`id`) ON DELETE CASCADE ON UPDATE CASCADE
+  CONSTRAINT `variable_mappings_ibfk_6` FOREIGN KEY (`variable_id`) REFERENCES `variable_definitions` (`id`) ON DELETE CASCADE ON UPDATE CASCADE,
+  CONSTRAINT `variable_mappings_deletion` FOREIGN KEY (`deletion_id`) REFERENCES `deletions` (`id`) ON DELETE CASCADE
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
 /*!40101 SET character_set_client = @saved_cs_client */;
 
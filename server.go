@@ -1,27 +1,49 @@
 package main
 
 import (
-	"log"
+	"context"
 	"net/http"
+	"time"
 
 	"github.com/byuoitav/authmiddleware"
+	"github.com/byuoitav/pi-designation-microservice/accessors"
+	"github.com/byuoitav/pi-designation-microservice/directory"
 	"github.com/byuoitav/pi-designation-microservice/handlers"
-	"github.com/fatih/color"
+	"github.com/byuoitav/pi-designation-microservice/history"
+	"github.com/byuoitav/pi-designation-microservice/logging"
+	"github.com/byuoitav/pi-designation-microservice/metrics"
 	"github.com/labstack/echo"
 	"github.com/labstack/echo/middleware"
 )
 
 const PORT = ":5001"
 
+//how often deletions older than accessors.TrashDays and fetches older than accessors.FetchRetentionDays are purged
+const PURGE_INTERVAL = time.Hour
+
+var logger = logging.New("server")
+
 func main() {
 
-	log.Printf("%s", color.HiGreenString("Starting room designation microservice..."))
+	logger.Infof(context.Background(), "Starting room designation microservice...")
 
 	router := echo.New()
 	router.Pre(middleware.RemoveTrailingSlash())
-	router.Use(middleware.CORS())
-
-	secure := router.Group("", echo.WrapMiddleware(authmiddleware.Authenticate))
+	router.Use(middleware.CORSWithConfig(middleware.CORSConfig{
+		ExposeHeaders: []string{handlers.ETAG_HEADER, handlers.NEXT_CURSOR_HEADER, logging.REQUEST_ID_HEADER},
+	}))
+	router.Use(logging.Middleware)
+	router.Use(metrics.Middleware)
+
+	//unauthenticated so load balancers can check on us
+	router.GET("/health", handlers.Health)
+	router.GET("/ready", handlers.Ready)
+	router.GET("/status", handlers.GetStatus)
+	router.GET("/metrics", metrics.Handler())
+
+	//when configuration comes from a directory, only reads (and device check-ins) get through
+	//every write that does get through is committed to the history repository, if there is one
+	secure := router.Group("", echo.WrapMiddleware(authmiddleware.Authenticate), directory.ReadOnly, history.Middleware)
 
 	//add definition
 	secure.POST("/designations/definitions", handlers.AddDesignationDefinition)
@@ -39,6 +61,7 @@ func main() {
 	secure.PUT("/designations/definitions", handlers.EditDesignationDefinition)
 	secure.PUT("/classes/definitions", handlers.EditClassDefinition)
 	secure.PUT("/variables/definitions", handlers.EditVariableDefinition)
+	secure.PUT("/variables/definitions/:id/required", handlers.SetRequiredClasses)
 	secure.PUT("/microservices/definitions", handlers.EditMicroserviceDefinition)
 
 	//edit mapping
@@ -52,15 +75,23 @@ func main() {
 	secure.GET("designations/definitions/single/:id", handlers.GetDesignationDefinitionById)
 	secure.GET("variables/definitions/all", handlers.GetAllVariableDefinitions)
 	secure.GET("variables/definitions/single/:id", handlers.GetVariableDefinitionById)
+	secure.GET("variables/definitions/:id/required", handlers.GetRequiredClasses)
 	secure.GET("microservices/definitions/all", handlers.GetAllMicroserviceDefinitions)
 	secure.GET("microservices/definitions/single/:id", handlers.GetMicroserviceDefinitionById)
 
 	//get mapping
 	secure.GET("variables/mappings/all", handlers.GetAllVariableMappings)
 	secure.GET("variables/mappings/single/:id", handlers.GetVariableMappingById)
+	secure.GET("variables/mappings/conflicts", handlers.GetVariableConflicts)
 	secure.GET("microservices/mappings/all", handlers.GetAllMicroserviceMappings)
 	secure.GET("microservices/mappings/single/:id", handlers.GetMicroserviceMappingById)
 
+	//see what deleting a definition would take with it
+	secure.GET("classes/definitions/:id/impact", handlers.GetClassDefinitionImpact)
+	secure.GET("designations/definitions/:id/impact", handlers.GetDesignationDefinitionImpact)
+	secure.GET("variables/definitions/:id/impact", handlers.GetVariableDefinitionImpact)
+	secure.GET("microservices/definitions/:id/impact", handlers.GetMicroserviceDefinitionImpact)
+
 	//delete definition
 	secure.DELETE("/classes/definitions/:id", handlers.DeleteClassDefinition)
 	secure.DELETE("/designations/definitions/:id", handlers.DeleteDesignationDefinition)
@@ -71,9 +102,45 @@ func main() {
 	secure.DELETE("/variables/mappings/:id", handlers.DeleteVariableMapping)
 	secure.DELETE("/microservices/mappings/:id", handlers.DeleteMicroserviceMapping)
 
+	//undo a delete, or make it permanent
+	secure.GET("/trash", handlers.GetTrash)
+	secure.GET("/trash/:id", handlers.GetDeletion)
+	secure.POST("/trash/:id/restore", handlers.RestoreDeletion)
+	secure.DELETE("/trash/:id", handlers.PurgeDeletion)
+
+	//image tags
+	secure.GET("/microservices/tags", handlers.GetImageTags)
+	secure.PUT("/microservices/:microservice/designations/:designation/tag", handlers.SetImageTag)
+	secure.DELETE("/microservices/:microservice/designations/:designation/tag", handlers.DeleteImageTag)
+	secure.POST("/microservices/:microservice/tags/bump", handlers.BumpImageTag)
+
 	//where the magic happens
 	secure.GET("/configurations/designations/:class/:designation/variables", handlers.GetVariablesByDesignationAndClass)
 	secure.GET("/configurations/designations/:class/:designation/docker-compose", handlers.GetDockerComposeByDesignationAndClass)
+	secure.GET("/configurations/designations/:class/:designation/validate", handlers.GetCompletenessReport)
+	secure.GET("/configurations/cache", handlers.GetConfigurationCacheStats)
+	secure.PUT("/configurations/designations/:class/:designation", handlers.ApplyConfiguration)
+
+	//where is this used?
+	secure.GET("/search", handlers.Search)
+
+	//everything at once, by name
+	secure.GET("/export", handlers.Export)
+	secure.POST("/import", handlers.Import)
+
+	//device check-ins
+	secure.POST("/devices/checkins", handlers.AddCheckin)
+	secure.GET("/devices/drift", handlers.GetDriftReport)
+	secure.GET("/devices/last-seen", handlers.GetLastSeen)
+	secure.GET("/devices/unseen", handlers.GetUnseenDevices)
+	secure.GET("/devices/:client/fetches", handlers.GetDeviceFetches)
+
+	go accessors.WriteFetches()
+	go purge()
+
+	if directory.Enabled() {
+		go directory.Watch()
+	}
 
 	server := http.Server{
 		Addr:           PORT,
@@ -82,3 +149,25 @@ func main() {
 
 	router.StartServer(&server)
 }
+
+func purge() {
+
+	ctx := context.Background()
+
+	for range time.Tick(PURGE_INTERVAL) {
+
+		purged, err := accessors.PurgeExpiredDeletions(ctx)
+		if err != nil {
+			logger.Errorf(ctx, "unable to purge the trash: %s", err.Error())
+		} else if purged > 0 {
+			logger.Infof(ctx, "purged %d deletions older than %d days", purged, accessors.TrashDays())
+		}
+
+		purged, err = accessors.PurgeExpiredFetches(ctx)
+		if err != nil {
+			logger.Errorf(ctx, "unable to purge fetches: %s", err.Error())
+		} else if purged > 0 {
+			logger.Infof(ctx, "purged %d fetches older than %d days", purged, accessors.FetchRetentionDays())
+		}
+	}
+}